@@ -10,6 +10,7 @@
 package main
 
 import (
+	"context"
 	. "github.com/kubaroth/Vec3"
 	"errors"
 	"fmt"
@@ -64,10 +65,8 @@ func main() {
 	
 	fmt.Println("\nsaving into:", path)
 
-	done := make(chan int)
-
 	// Option 1 - inner sample loop
-	img := Render(cam, samples, &world, nil, done)  // pass bvh instead of nil to use BVH_node container
+	img := Render(context.Background(), cam, samples, &world, nil).Image()  // pass bvh instead of nil to use BVH_node container
 
 	
 	// saving png
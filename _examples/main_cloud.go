@@ -0,0 +1,83 @@
+// A heterogeneous cloud from a voxel grid. The grid is read from a raw
+// voxel file when given, otherwise a noise cloud is generated and saved to
+// cloud.vox.
+//
+// go run main_cloud.go [cloud.vox]
+
+package main
+
+import (
+	"context"
+	. "github.com/kubaroth/Vec3"
+	"fmt"
+	"image/png"
+	"math"
+	"os"
+	"time"
+)
+
+func noiseCloud(n int) *VoxelGrid {
+	grid := NewVoxelGrid(n, n/2, n, NewVec3(-1, 0, -3), NewVec3(1, 1, -1))
+	noise := NewPerlin(3)
+	for z := 0; z < n; z++ {
+		for y := 0; y < n/2; y++ {
+			for x := 0; x < n; x++ {
+				p := NewVec3(float32(x)/float32(n)*2-1, float32(y)/float32(n/2), float32(z)/float32(n)*2-1)
+				// ellipsoid falloff eroded by turbulence
+				r := math.Sqrt(float64(p.At(0)*p.At(0) + 4*(p.At(1)-0.5)*(p.At(1)-0.5) + p.At(2)*p.At(2)))
+				d := 1 - float32(r) - 0.6*noise.Turbulence(p.MultF(4), 5)
+				if d > 0 {
+					grid.Set(x, y, z, d)
+				}
+			}
+		}
+	}
+	return grid
+}
+
+func main() {
+	var grid *VoxelGrid
+	if len(os.Args) > 1 {
+		var err error
+		if grid, err = LoadVoxelGrid(os.Args[1]); err != nil {
+			panic(err)
+		}
+	} else {
+		grid = noiseCloud(64)
+		f, err := os.Create("cloud.vox")
+		if err != nil {
+			panic(err)
+		}
+		if err = EncodeVoxelGrid(f, grid); err != nil {
+			panic(err)
+		}
+		f.Close()
+	}
+
+	world := HittableList{}
+	world.Add(Surface{Quad{NewVec3(-20, 0, 20), NewVec3(40, 0, 0), NewVec3(0, 0, -40)}, Lambertian{SolidColor{NewVec3(0.5, 0.5, 0.5)}}})
+	world.Add(NewVoxelVolume(grid, 20, NewVec3(0.95, 0.95, 0.95), HenyeyGreenstein{0.5}))
+
+	sky := NewPreethamSky(30, 120, 3)
+	sun := sky.Sun(1)
+	scene := &Scene{
+		World:      NewDynamicBVH(world.Objects),
+		Lights:     []Light{sun},
+		Background: sky,
+		MaxDepth:   16,
+	}
+
+	cam := NewCamera(NewVec3(0, 0.6, 1), NewVec3(0, 0.5, -2), 400)
+	start := time.Now()
+	img := RenderScene(context.Background(), cam, 32, scene).Image()
+	fmt.Println("time", time.Since(start))
+
+	f, err := os.Create("cloud.png")
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+	if err = png.Encode(f, img); err != nil {
+		fmt.Printf("failed to encode: %v", err)
+	}
+}
@@ -0,0 +1,57 @@
+// Image based lighting: a few spheres on a ground plane lit only by an
+// equirectangular .hdr environment. Without an argument the gradient sky
+// is used instead.
+//
+// go run main_envmap.go [studio.hdr]
+
+package main
+
+import (
+	"context"
+	. "github.com/kubaroth/Vec3"
+	"fmt"
+	"image/png"
+	"os"
+	"time"
+)
+
+func main() {
+	orange := Principled{BaseColor: SolidColor{NewVec3(0.8, 0.4, 0.1)}, Roughness: 0.4, Specular: 0.5, Clearcoat: 1, ClearcoatGloss: 0.9}
+	gold := Conductor{SolidColor{NewVec3(1.0, 0.78, 0.34)}, 0.3}
+	glass := Dielectric{1.5, 0}
+
+	world := HittableList{}
+	checker := Lambertian{Checker{SolidColor{NewVec3(0.8, 0.8, 0.8)}, SolidColor{NewVec3(0.2, 0.2, 0.2)}, 2, false}}
+	marble := Lambertian{NoiseTexture{NewPerlin(1), NewVec3(0.9, 0.9, 0.9), 4, 7}}
+	world.Add(Surface{Quad{NewVec3(-20, 0, 20), NewVec3(40, 0, 0), NewVec3(0, 0, -40)}, checker})
+	world.Add(Surface{Sphere{NewVec3(0, 0.5, -2), 0.5}, orange})
+	world.Add(Surface{Sphere{NewVec3(-1.1, 0.5, -2.3), 0.5}, marble})
+	world.Add(Surface{Sphere{NewVec3(1.1, 0.5, -2.3), 0.5}, gold})
+	world.Add(Surface{Sphere{NewVec3(0.45, 0.25, -1.3), 0.25}, glass})
+
+	scene := &Scene{World: NewDynamicBVH(world.Objects)}
+	if len(os.Args) > 1 {
+		env, err := LoadEnvMap(os.Args[1], 1)
+		if err != nil {
+			panic(err)
+		}
+		scene.Background = env
+		scene.Lights = []Light{env}
+	} else {
+		scene.Background = GradientBackground{NewVec3(1, 1, 1), NewVec3(0.5, 0.7, 1.0)}
+	}
+
+	cam := NewCamera(NewVec3(0, 1, 1), NewVec3(0, 0.5, -2), 400)
+	start := time.Now()
+	img := RenderScene(context.Background(), cam, 32, scene).Image()
+	fmt.Println("time", time.Since(start))
+
+	f, err := os.Create("envmap.png")
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+	if err = png.Encode(f, img); err != nil {
+		fmt.Printf("failed to encode: %v", err)
+	}
+}
@@ -0,0 +1,91 @@
+// Distributed rendering: a coordinator hands out tiles to workers on other
+// machines, which build the same scene and send back the rendered tiles.
+//
+// go run main_farm.go -listen :8080
+// go run main_farm.go -coordinator http://localhost:8080   (on every worker)
+
+package main
+
+import (
+	"context"
+	"flag"
+	. "github.com/kubaroth/Vec3"
+	"fmt"
+	"image/png"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Every process builds the scene itself
+func farmScene() (Camera, *Scene) {
+	white := Lambertian{SolidColor{NewVec3(0.73, 0.73, 0.73)}}
+	red := Lambertian{SolidColor{NewVec3(0.65, 0.05, 0.05)}}
+
+	world := HittableList{}
+	for _, wall := range NewBox(NewVec3(-1.5, 0, -4), NewVec3(1.5, 2.5, 0.5)) {
+		world.Add(Surface{wall, white})
+	}
+	world.Add(Surface{Sphere{NewVec3(-0.5, 0.5, -2.6), 0.5}, red})
+	world.Add(Surface{Sphere{NewVec3(0.6, 0.4, -2.2), 0.4}, white})
+	bulb := SphereLight{NewVec3(0, 2, -2.5), 0.2, NewVec3(20, 18, 15)}
+	world.Add(bulb)
+
+	scene := &Scene{
+		World:  NewDynamicBVH(world.Objects),
+		Lights: []Light{bulb},
+	}
+	return NewCamera(NewVec3(0, 1.2, 0.3), NewVec3(0, 1, -2.5), 800), scene
+}
+
+func main() {
+	listen := flag.String("listen", "", "address the coordinator listens on, ie. :8080")
+	coordinator := flag.String("coordinator", "", "URL of the coordinator to work for")
+	flag.Parse()
+
+	cam, scene := farmScene()
+
+	if *coordinator != "" {
+		worker := Worker{Coordinator: *coordinator, Camera: cam, Scene: scene, PollInterval: time.Second}
+		if err := worker.Run(context.Background()); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if *listen == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	film := NewFilm(cam.Width, cam.Height)
+	c := NewCoordinator(film, Distributed{TileSize: 64, Passes: 8, SamplesPerPass: 16, Timeout: 5 * time.Minute})
+	go func() {
+		log.Fatal(http.ListenAndServe(*listen, c))
+	}()
+
+	start := time.Now()
+	done := make(chan RenderResult)
+	go func() { done <- c.Wait(context.Background()) }()
+	var result RenderResult
+	for waiting := true; waiting; {
+		select {
+		case result = <-done:
+			waiting = false
+		case <-time.After(10 * time.Second):
+			fmt.Printf("%.0f%%\n", 100*c.Progress())
+		}
+	}
+	fmt.Println("time", time.Since(start))
+
+	f, err := os.Create("farm.png")
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+	if err = png.Encode(f, result.Image()); err != nil {
+		fmt.Printf("failed to encode: %v", err)
+	}
+	// let the workers see the render is over before exiting
+	time.Sleep(2 * time.Second)
+}
@@ -0,0 +1,51 @@
+// Participating media: a box of blue smoke next to a lamp, the whole room
+// filled with thin forward scattering fog so the spot light beam shows.
+//
+// go run main_fog.go
+
+package main
+
+import (
+	"context"
+	. "github.com/kubaroth/Vec3"
+	"fmt"
+	"image/png"
+	"os"
+	"time"
+)
+
+func main() {
+	white := Lambertian{SolidColor{NewVec3(0.73, 0.73, 0.73)}}
+
+	world := HittableList{}
+	for _, wall := range NewBox(NewVec3(-1.5, 0, -4), NewVec3(1.5, 2.5, 0.5)) {
+		world.Add(Surface{wall, white})
+	}
+	smoke := HittableList{NewBox(NewVec3(-0.9, 0, -2.8), NewVec3(-0.2, 1.2, -2.1))}
+	world.Add(ConstantMedium{&smoke, 3, NewVec3(0.3, 0.5, 0.9), nil})
+	world.Add(Surface{Sphere{NewVec3(0.6, 0.4, -2.4), 0.4}, white})
+
+	bulb := SphereLight{NewVec3(0.2, 1.6, -3.2), 0.1, NewVec3(20, 16, 10)}
+	spot := SpotLight{NewVec3(1.2, 2.3, -1), NewVec3(-0.6, -1.4, -0.8), NewVec3(15, 15, 15), 12, 4}
+	world.Add(bulb)
+
+	scene := &Scene{
+		World:  NewDynamicBVH(world.Objects),
+		Lights: []Light{bulb, spot},
+		Fog:    &Fog{Density: 0.08, Albedo: NewVec3(0.9, 0.9, 0.9), Phase: HenyeyGreenstein{0.4}},
+	}
+
+	cam := NewCamera(NewVec3(0, 1.2, 0.3), NewVec3(0, 1, -2.5), 400)
+	start := time.Now()
+	img := RenderScene(context.Background(), cam, 64, scene).Image()
+	fmt.Println("time", time.Since(start))
+
+	f, err := os.Create("fog.png")
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+	if err = png.Encode(f, img); err != nil {
+		fmt.Printf("failed to encode: %v", err)
+	}
+}
@@ -0,0 +1,86 @@
+// An interior lit only by lamps: a box with a rectangle light in the
+// ceiling, a spot light and a small glowing sphere. There is no sky.
+//
+// The AOVs and ID mattes are saved next to the image in lights.exr.
+// Previews with less than 16 samples are denoised.
+//
+// go run main_lights.go [samples]
+
+package main
+
+import (
+	"context"
+	. "github.com/kubaroth/Vec3"
+	"fmt"
+	"image/png"
+	"os"
+	"strconv"
+	"time"
+)
+
+func main() {
+	white := Lambertian{SolidColor{NewVec3(0.73, 0.73, 0.73)}}
+	red := Lambertian{SolidColor{NewVec3(0.65, 0.05, 0.05)}}
+	green := Lambertian{SolidColor{NewVec3(0.12, 0.45, 0.15)}}
+
+	world := HittableList{}
+	names := []string{} // of the objects in world for the ID mattes
+	walls := NewBox(NewVec3(-1, 0, -3), NewVec3(1, 2, 0.5))
+	for i, wall := range walls {
+		mat := Material(white)
+		name := "walls"
+		if i == 2 {
+			mat, name = green, "right_wall"
+		} else if i == 3 {
+			mat, name = red, "left_wall"
+		}
+		// walls face out of the box, the camera sees their back side
+		world.Add(Surface{wall, mat})
+		names = append(names, name)
+	}
+	world.Add(Surface{Sphere{NewVec3(-0.4, 0.35, -1.8), 0.35}, white})
+	names = append(names, "sphere")
+
+	ceiling := RectLight{Quad{NewVec3(-0.3, 1.99, -1.8), NewVec3(0.6, 0, 0), NewVec3(0, 0, 0.6)}, NewVec3(12, 12, 12)}
+	bulb := SphereLight{NewVec3(0.5, 0.2, -1.5), 0.1, NewVec3(8, 6, 3)}
+	spot := SpotLight{NewVec3(0.8, 1.8, -0.5), NewVec3(-1, -1.2, -1), NewVec3(3, 3, 3), 25, 10}
+	world.Add(ceiling)
+	world.Add(bulb)
+	names = append(names, "ceiling_light", "bulb")
+
+	scene := &Scene{
+		World:  NewDynamicBVH(world.Objects),
+		Lights: []Light{ceiling, bulb, spot},
+	}
+
+	samples := 64
+	if len(os.Args) > 1 {
+		var err error
+		if samples, err = strconv.Atoi(os.Args[1]); err != nil {
+			panic(err)
+		}
+	}
+
+	cam := NewCamera(NewVec3(0, 1, 0.4), NewVec3(0, 0.9, -1), 400)
+	start := time.Now()
+	film := NewFilm(cam.Width, cam.Height, AOVDepth, AOVNormal, AOVAlbedo, AOVObjectId)
+	film.Cryptomatte = NewCryptomatte(cam.Width, cam.Height, "CryptoObject", names)
+	if samples < 16 {
+		film.Denoiser = &Denoiser{}
+	}
+	RenderFilm(context.Background(), cam, samples, scene, film)
+	fmt.Println("time", time.Since(start))
+	if err := film.SaveEXR("lights.exr"); err != nil {
+		panic(err)
+	}
+	img := film.Image()
+
+	f, err := os.Create("lights.png")
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+	if err = png.Encode(f, img); err != nil {
+		fmt.Printf("failed to encode: %v", err)
+	}
+}
@@ -13,6 +13,7 @@
 package main
 
 import (
+	"context"
 	. "github.com/kubaroth/Vec3"
 	"errors"
 	"fmt"
@@ -66,10 +67,10 @@ func main() {
 	
 	fmt.Println("\nsaving into:", path)
 
-	done := make(chan int)
-
 	// Option 2 - outer sample loop
-	RenderSamples(cam, samples, &world, nil, done, path)
+	if result := RenderSamples(context.Background(), cam, samples, &world, nil, path); result.Err != nil {
+		fmt.Println("render failed:", result.Err)
+	}
 
 	fmt.Println("Waiting...")
 
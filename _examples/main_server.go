@@ -0,0 +1,29 @@
+// A render server to preview renders in a browser, without an X server.
+//
+// go run main_server.go
+// curl --data @scene.json 'localhost:8080/jobs?passes=64'
+// open http://localhost:8080/jobs/1/stream in a browser
+// curl -X DELETE localhost:8080/jobs/1
+//
+// See LoadSceneJSON for the scene format.
+
+package main
+
+import (
+	"flag"
+	. "github.com/kubaroth/Vec3"
+	"log"
+	"net/http"
+)
+
+func main() {
+	listen := flag.String("listen", ":8080", "address to listen on")
+	jobs := flag.Int("jobs", 1, "jobs rendered at the same time")
+	flag.Parse()
+
+	server := NewServer(ServerOptions{MaxJobs: *jobs})
+	http.Handle("/jobs", server)
+	http.Handle("/jobs/", server)
+	log.Println("listening on", *listen)
+	log.Fatal(http.ListenAndServe(*listen, nil))
+}
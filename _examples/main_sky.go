@@ -0,0 +1,64 @@
+// Outdoor lighting without an HDRI: the analytic Preetham sky and its sun.
+// The smooth sky needs few samples, they are spent adaptively on the
+// shadows instead, sky_samples.exr shows where.
+//
+// go run main_sky.go [elevation azimuth turbidity]
+
+package main
+
+import (
+	"context"
+	. "github.com/kubaroth/Vec3"
+	"fmt"
+	"image/png"
+	"os"
+	"strconv"
+	"time"
+)
+
+func main() {
+	elevation, azimuth, turbidity := 25.0, 60.0, 3.0
+	if len(os.Args) == 4 {
+		elevation, _ = strconv.ParseFloat(os.Args[1], 64)
+		azimuth, _ = strconv.ParseFloat(os.Args[2], 64)
+		turbidity, _ = strconv.ParseFloat(os.Args[3], 64)
+	}
+	sky := NewPreethamSky(elevation, azimuth, turbidity)
+
+	gray := Lambertian{SolidColor{NewVec3(0.5, 0.5, 0.5)}}
+	world := HittableList{}
+	world.Add(Surface{Quad{NewVec3(-20, 0, 20), NewVec3(40, 0, 0), NewVec3(0, 0, -40)}, gray})
+	for _, box := range [][2]Vec3{
+		{NewVec3(-1.5, 0, -4), NewVec3(-0.5, 2, -3)},
+		{NewVec3(0.2, 0, -3.5), NewVec3(1.4, 1, -2.5)},
+	} {
+		for _, side := range NewBox(box[0], box[1]) {
+			world.Add(Surface{side, gray})
+		}
+	}
+
+	scene := &Scene{
+		World:      NewDynamicBVH(world.Objects),
+		Background: sky,
+		Lights:     []Light{sky.Sun(3)},
+	}
+
+	cam := NewCamera(NewVec3(0, 1, 1), NewVec3(0, 0.8, -3), 400)
+	start := time.Now()
+	film := NewFilm(cam.Width, cam.Height, AOVSampleCount, AOVNoise)
+	RenderAdaptive(context.Background(), cam, scene, film, AdaptiveSampling{MinSamples: 8, MaxSamples: 128, Threshold: 0.02})
+	fmt.Println("time", time.Since(start))
+	if err := film.SaveEXR("sky_samples.exr"); err != nil {
+		panic(err)
+	}
+	img := film.Image()
+
+	f, err := os.Create("sky.png")
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+	if err = png.Encode(f, img); err != nil {
+		fmt.Printf("failed to encode: %v", err)
+	}
+}
@@ -5,6 +5,7 @@
 // Esc - exits
 // w - move camera forward
 // s - move camera backward
+// drag with the left button - renders the region at more samples
 
 
 // Get dependencies for this example:
@@ -15,12 +16,14 @@
 package main
 
 import (
+	"context"
 	. "github.com/kubaroth/Vec3"
 	"errors"
 	"fmt"
+	"image"
 _	"image/png"
 	"os"
-_	"sync"
+	"sync"
 
 	
 	"time"
@@ -52,12 +55,38 @@ type RenderSetup struct {
 	cam Camera
 	samples int 
 	world HittableList
-	done chan int
+	bvh *DynamicBVH // built once, updated incrementally when objects change
 	X *xgbutil.XUtil
 	win *xwindow.Window
 }
 
-// func renderSetup(cam Camera, world HittableList, done chan int, X *xgbutil.XUtil, win *xwindow.Window){
+// Every render runs with its own context, starting a new one cancels the
+// previous render.
+var render_mu sync.Mutex
+var cancel_render context.CancelFunc = func() {}
+
+func newRenderContext() context.Context {
+	render_mu.Lock()
+	defer render_mu.Unlock()
+	cancel_render()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel_render = cancel
+	return ctx
+}
+
+func cancelRender() {
+	render_mu.Lock()
+	defer render_mu.Unlock()
+	cancel_render()
+}
+
+// film of the last render, dragged regions are refined in it. film_mu
+// guards it and is held while a region renders into it, so a region
+// cancelled by a newer render is over before the film changes hands.
+var film_mu sync.Mutex
+var last_film *Film
+
+// func renderSetup(cam Camera, world HittableList, X *xgbutil.XUtil, win *xwindow.Window){
 func renderSetup(parms RenderSetup){
 
 	// Enable this to see BVH culling in action. 5sec vs 28sec for []Hittablelist
@@ -65,11 +94,12 @@ func renderSetup(parms RenderSetup){
 	// 	world.Add(Sphere{NewVec3(0,float32(i)/10., float32(i + 1)), 0.5})
 	// }
 
-	// TODO: for now here but move it out into a separate step which
-	//       get executed only if we add new objects
-	bvh := NewBVHSplit(parms.world.Objects,0,len(parms.world.Objects))
-	_ = bvh
-	
+	// The tree is only updated when objects change. Rebuild it once the
+	// incremental updates make traversal noticeably slower.
+	if parms.bvh.NeedsRebuild(1.5) {
+		parms.bvh.Rebuild()
+	}
+
 	start := time.Now(); _ = start
 
 	path := os.Getenv("HOME") + "/storage/downloads/img.png" // termux preview
@@ -77,16 +107,43 @@ func renderSetup(parms RenderSetup){
 		path = "img.png"
 	}
 	
-	img := Render(parms.cam, parms.samples, &parms.world, nil, parms.done)  // pass bvh instead of nil to use BVH_node container
+	result := Render(newRenderContext(), parms.cam, parms.samples, &parms.world, parms.bvh)  // pass nil instead of bvh to traverse the flat list
+	if result.Err != nil {
+		fmt.Printf("Interrupt rendering at %.0f%%: %v\n", 100*result.Progress, result.Err)
+	}
+	film_mu.Lock()
+	last_film = result.Film
+	film_mu.Unlock()
+	show(parms, result.Image())
+	
+	fmt.Println("time", time.Since(start))
+}
 
-	// Write image to pixmap and update content of the window
+// regionSetup renders more samples inside bounds over the last render.
+func regionSetup(parms RenderSetup, bounds image.Rectangle){
+	ctx := newRenderContext()
+	film_mu.Lock()
+	defer film_mu.Unlock()
+	if last_film == nil {
+		return
+	}
+	start := time.Now()
+	scene := &Scene{World: parms.bvh}
+	result := RenderRegion(ctx, parms.cam, 8*parms.samples, scene, last_film, bounds, RayColorWorld)
+	if result.Err != nil {
+		fmt.Printf("Interrupt rendering at %.0f%%: %v\n", 100*result.Progress, result.Err)
+	}
+	show(parms, result.Image())
+	fmt.Println("region", bounds, "time", time.Since(start))
+}
+
+// Write image to pixmap and update content of the window
+func show(parms RenderSetup, img image.Image){
 	ximg := xgraphics.NewConvert(parms.X, img)
 	ximg.XSurfaceSet(parms.win.Id)
 	ximg.XDraw()
 	ximg.XPaint(parms.win.Id)
 	parms.win.Resize(parms.cam.Width, parms.cam.Height)
-	
-	fmt.Println("time", time.Since(start))
 }
 
 
@@ -155,32 +212,25 @@ func main(){
 			log.Println("Painting")
 		}).Connect(X, win.Id, "1", false, true)
 
-	// var prev_rx, prev_ry int
-	// mousebind.Drag(X, win.Id, win.Id, "1", false,
-	// 	func(X *xgbutil.XUtil, rx, ry, ex, ey int) (bool, xproto.Cursor) {
-	// 		log.Println("starting", rx, ry)
-	// 		bounds.Min.X = rx
-	// 		bounds.Min.Y = ry
-	// 		prev_rx = rx
-	// 		prev_ry = ry
-	// 		return true, 0
-	// 	},
-	// 	func(X *xgbutil.XUtil, rx, ry, ex, ey int) {
-	// 		// log.Println("painting", rx, ry)
-	// 		prev_rx = rx
-	// 		prev_ry = ry
-
-	// 	},
-	// 	func(X *xgbutil.XUtil, rx, ry, ex, ey int) {
-	// 		log.Println("release", rx, ry)
-	// 		bounds.Max.X = rx
-	// 		bounds.Max.Y = ry
-	// 	})
-
-	done := make(chan int)
 	cam := NewCamera(NewVec3(0,0,0), NewVec3(0,0,-1), 400)
 
-	render_parms := RenderSetup{cam, 2 /*samples*/, world, done, X, win}
+	render_parms := RenderSetup{cam, 2 /*samples*/, world, NewDynamicBVH(nil), X, win}
+
+	// Drag a region to render it at more samples
+	var bounds image.Rectangle
+	mousebind.Drag(X, win.Id, win.Id, "1", false,
+		func(X *xgbutil.XUtil, rx, ry, ex, ey int) (bool, xproto.Cursor) {
+			log.Println("starting", ex, ey)
+			bounds.Min = image.Pt(ex, ey)
+			return true, 0
+		},
+		func(X *xgbutil.XUtil, rx, ry, ex, ey int) {
+		},
+		func(X *xgbutil.XUtil, rx, ry, ex, ey int) {
+			log.Println("release", ex, ey)
+			bounds = image.Rectangle{bounds.Min, image.Pt(ex, ey)}.Canon()
+			go regionSetup(render_parms, bounds)
+		})
 
 	keybind.KeyPressFun(
 		func(X *xgbutil.XUtil, e xevent.KeyPressEvent) {
@@ -192,8 +242,8 @@ func main(){
 			win.Destroy()
 			xevent.Quit(X)
 
-			// close the done chanell on exit
-			close(done)
+			// stop the render on exit
+			cancelRender()
 
 		}).Connect(X, win.Id, "Escape", true)
 
@@ -201,6 +251,7 @@ func main(){
 		render_parms.world.Add(Sphere{NewVec3(0,0,-1), 0.2})
 		render_parms.world.Add(Cylinder{Center:NewVec3(0,1,-1), Radius:0.1, Height:1.0})
 		render_parms.world.Add(Sphere{NewVec3(0,-100.5,-1), 100.0})
+		render_parms.bvh = NewDynamicBVH(render_parms.world.Objects)
 
 		renderSetup(render_parms)
 	}
@@ -216,9 +267,7 @@ func main(){
 	keybind.KeyPressFun(
 		func(X *xgbutil.XUtil, e xevent.KeyPressEvent) {
 			fmt.Println("cancelling...")
-			go func(){
-				done <- 1
-			}()
+			cancelRender()
 		}).Connect(X, win.Id, "bracketleft", true)
 
 	// A test with different number of objects in the scene
@@ -228,6 +277,7 @@ func main(){
 			go func(){
 				render_parms.world.Objects = nil // clear the slice
 				render_parms.world.Add(Sphere{NewVec3(0,0,-1), 0.5}) // add only a single sphere
+				render_parms.bvh = NewDynamicBVH(render_parms.world.Objects)
 				renderSetup(render_parms)
 			}()
 		}).Connect(X, win.Id, "p", true)
@@ -238,9 +288,6 @@ func main(){
 		func(X *xgbutil.XUtil, e xevent.KeyReleaseEvent) {  // NOTE: The 'release' is also triggered on press and not release
 			fmt.Println("key W was released...")
 
-			go func(){  // stop previous run
-				done <- 1 
-			}()
 			go func(){
 				render_parms.cam = NewCamera( render_parms.cam.Origin.Add(NewVec3(0,0,-0.01)), NewVec3(0,0,-1), render_parms.cam.Width)
 				renderSetup(render_parms)
@@ -252,9 +299,6 @@ func main(){
 	// Move bacwkward
 	keybind.KeyPressFun(
 		func(X *xgbutil.XUtil, e xevent.KeyPressEvent) {
-			go func(){ // stop previous run
-				done <- 1 
-			}()
 			go func(){
 				render_parms.cam = NewCamera( render_parms.cam.Origin.Add(NewVec3(0,0,0.01)), NewVec3(0,0,-1), render_parms.cam.Width)
 				renderSetup(render_parms)
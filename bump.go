@@ -0,0 +1,108 @@
+package raytrace
+
+import "math/rand"
+
+// NormalMapped shades Mat with normals read from a tangent space normal
+// map: the RGB of Map in [0,1] is the normal in the TangentFrame() of the
+// hit, (0.5, 0.5, 1) leaves the surface unchanged. Strength scales the
+// tilt, 0 is treated as 1.
+//
+// The map needs linear data, see LoadDataTexture().
+type NormalMapped struct {
+	Mat      Material
+	Map      Texture
+	Strength float32
+}
+
+func (m NormalMapped) perturb(rec *HitRecord) *HitRecord {
+	shaded := *rec
+	c := m.Map.Value(rec.U, rec.V, rec.P)
+	strength := m.Strength
+	if strength == 0 {
+		strength = 1
+	}
+	local := NewVec3((2*c.x-1)*strength, (2*c.y-1)*strength, 2*c.z-1)
+	if local.z <= 0 { // invalid texel, keep the surface normal
+		return &shaded
+	}
+	shaded.set_shading_normal(rec.TangentFrame().Local(local))
+	return &shaded
+}
+
+func (m NormalMapped) albedo(rec *HitRecord) Vec3 {
+	return albedoOf(m.Mat, rec)
+}
+
+func (m NormalMapped) Emitted(rec *HitRecord, wo Vec3) Vec3 {
+	return m.Mat.Emitted(rec, wo)
+}
+
+func (m NormalMapped) Sample(rec *HitRecord, wo Vec3, rng *rand.Rand) (BSDFSample, bool) {
+	return m.Mat.Sample(m.perturb(rec), wo, rng)
+}
+
+func (m NormalMapped) Eval(rec *HitRecord, wo, wi Vec3) Vec3 {
+	return m.Mat.Eval(m.perturb(rec), wo, wi)
+}
+
+func (m NormalMapped) Pdf(rec *HitRecord, wo, wi Vec3) float32 {
+	return m.Mat.Pdf(m.perturb(rec), wo, wi)
+}
+
+// BumpMapped shades Mat as if the surface was displaced along its normal
+// by Scale times the luminance of Height (Blinn's bump mapping). The
+// slope is found with finite differences in UV space.
+type BumpMapped struct {
+	Mat    Material
+	Height Texture
+	Scale  float32
+}
+
+// UV step of the finite differences
+const bumpDelta = 1.0 / 1024
+
+func (m BumpMapped) perturb(rec *HitRecord) *HitRecord {
+	shaded := *rec
+	if rec.Tangent.LengthSquared() == 0 || rec.Bitangent.LengthSquared() == 0 {
+		return &shaded
+	}
+	height := func(du, dv float32) float32 {
+		p := rec.P.Add(rec.Tangent.MultF(du)).Add(rec.Bitangent.MultF(dv))
+		return m.Scale * luminance(m.Height.Value(rec.U+du, rec.V+dv, p))
+	}
+	h := height(0, 0)
+	dh_du := (height(bumpDelta, 0) - h) / bumpDelta
+	dh_dv := (height(0, bumpDelta) - h) / bumpDelta
+	// displaced derivatives, the change of the normal itself is ignored
+	n := rec.Normal
+	dpdu := rec.Tangent.Add(n.MultF(dh_du))
+	dpdv := rec.Bitangent.Add(n.MultF(dh_dv))
+	// dpdu x dpdv may point either way, set_shading_normal() orients it
+	// and the normal then tilts away from rising height in both cases
+	bumped := dpdv.Cross(dpdu) // dpdu x dpdv
+	if bumped.LengthSquared() == 0 {
+		return &shaded
+	}
+	shaded.set_shading_normal(bumped)
+	return &shaded
+}
+
+func (m BumpMapped) albedo(rec *HitRecord) Vec3 {
+	return albedoOf(m.Mat, rec)
+}
+
+func (m BumpMapped) Emitted(rec *HitRecord, wo Vec3) Vec3 {
+	return m.Mat.Emitted(rec, wo)
+}
+
+func (m BumpMapped) Sample(rec *HitRecord, wo Vec3, rng *rand.Rand) (BSDFSample, bool) {
+	return m.Mat.Sample(m.perturb(rec), wo, rng)
+}
+
+func (m BumpMapped) Eval(rec *HitRecord, wo, wi Vec3) Vec3 {
+	return m.Mat.Eval(m.perturb(rec), wo, wi)
+}
+
+func (m BumpMapped) Pdf(rec *HitRecord, wo, wi Vec3) float32 {
+	return m.Mat.Pdf(m.perturb(rec), wo, wi)
+}
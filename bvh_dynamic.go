@@ -0,0 +1,421 @@
+package raytrace
+
+import (
+	"math"
+	"sort"
+)
+
+// DynamicBVH is a BVH which can be updated after it has been built.
+// Unlike NewBVHSplit() all nodes live in a single slice and objects are
+// referenced by a handle, so moving, adding or removing an object only
+// touches its ancestors instead of rebuilding the whole tree.
+//
+// Every update makes the tree a bit worse. Quality() compares the current
+// SAH cost with the cost measured right after the last full build, and
+// NeedsRebuild() tells the caller when it is time to call Rebuild().
+type DynamicBVH struct {
+	nodes  []dynNode
+	free   []int // recycled node slots
+	root   int
+	leaves map[int]int // object handle -> leaf node index
+	nextId int
+
+	buildCost float32 // SAH cost right after the last Rebuild()
+}
+
+const nullNode = -1
+
+// SAH constants used by Cost()
+const (
+	sahTraversalCost    = 1.0
+	sahIntersectionCost = 1.0
+)
+
+type dynNode struct {
+	Box                 AABB
+	Parent, Left, Right int
+	Object              Hittable // nil for inner nodes
+	Id                  int      // object handle, only valid for leaves
+}
+
+func (n *dynNode) isLeaf() bool {
+	return n.Left == nullNode
+}
+
+// helper used while building the tree top-down
+type dynItem struct {
+	Id       int
+	Object   Hittable
+	Box      AABB
+	Centroid Vec3
+}
+
+// NewDynamicBVH builds a tree over objects. Handles of the initial objects
+// are their indices in the slice, which matches the ObjectId reported by
+// HittableList.Hit().
+func NewDynamicBVH(objects []Hittable) *DynamicBVH {
+	bvh := &DynamicBVH{root: nullNode, leaves: map[int]int{}}
+	items := make([]dynItem, 0, len(objects))
+	for i, object := range objects {
+		items = append(items, newDynItem(i, object))
+	}
+	bvh.nextId = len(objects)
+	bvh.build(items)
+	return bvh
+}
+
+func newDynItem(id int, object Hittable) dynItem {
+	box := NewAABBUninit()
+	object.BBox(&box)
+	centroid := box.Min().Add(box.Max()).MultF(0.5)
+	return dynItem{id, object, box, centroid}
+}
+
+// Len returns the number of objects in the tree.
+func (bvh *DynamicBVH) Len() int {
+	return len(bvh.leaves)
+}
+
+// Object returns the object stored under the handle.
+func (bvh *DynamicBVH) Object(id int) (Hittable, bool) {
+	leaf, ok := bvh.leaves[id]
+	if !ok {
+		return nil, false
+	}
+	return bvh.nodes[leaf].Object, true
+}
+
+// Rebuild throws away the current topology and builds a fresh tree over the
+// same objects. Handles stay valid.
+func (bvh *DynamicBVH) Rebuild() {
+	items := make([]dynItem, 0, len(bvh.leaves))
+	for id, leaf := range bvh.leaves {
+		items = append(items, newDynItem(id, bvh.nodes[leaf].Object))
+	}
+	// map iteration is random, keep the build deterministic
+	sort.Slice(items, func(i, j int) bool { return items[i].Id < items[j].Id })
+	bvh.build(items)
+}
+
+func (bvh *DynamicBVH) build(items []dynItem) {
+	bvh.nodes = bvh.nodes[:0]
+	bvh.free = bvh.free[:0]
+	bvh.leaves = make(map[int]int, len(items))
+	bvh.root = nullNode
+	if len(items) > 0 {
+		bvh.root = bvh.buildRange(items, nullNode)
+	}
+	bvh.buildCost = bvh.Cost()
+}
+
+// Top-down build: split at the median centroid along the longest axis.
+func (bvh *DynamicBVH) buildRange(items []dynItem, parent int) int {
+	if len(items) == 1 {
+		return bvh.newLeaf(items[0].Id, items[0].Object, items[0].Box, parent)
+	}
+
+	centroids := NewAABB(items[0].Centroid, items[0].Centroid)
+	for _, item := range items[1:] {
+		centroids = Surrounding_box(centroids, NewAABB(item.Centroid, item.Centroid))
+	}
+	extent := centroids.Max().Subtr(centroids.Min())
+	axis := 0
+	if extent.At(1) > extent.At(axis) {
+		axis = 1
+	}
+	if extent.At(2) > extent.At(axis) {
+		axis = 2
+	}
+	sort.SliceStable(items, func(i, j int) bool {
+		return items[i].Centroid.At(axis) < items[j].Centroid.At(axis)
+	})
+
+	node := bvh.allocNode()
+	bvh.nodes[node].Parent = parent
+	mid := len(items) / 2
+	left := bvh.buildRange(items[:mid], node)
+	right := bvh.buildRange(items[mid:], node)
+	bvh.nodes[node].Left = left
+	bvh.nodes[node].Right = right
+	bvh.nodes[node].Box = Surrounding_box(bvh.nodes[left].Box, bvh.nodes[right].Box)
+	return node
+}
+
+func (bvh *DynamicBVH) allocNode() int {
+	if n := len(bvh.free); n > 0 {
+		index := bvh.free[n-1]
+		bvh.free = bvh.free[:n-1]
+		bvh.nodes[index] = dynNode{Parent: nullNode, Left: nullNode, Right: nullNode, Id: -1}
+		return index
+	}
+	bvh.nodes = append(bvh.nodes, dynNode{Parent: nullNode, Left: nullNode, Right: nullNode, Id: -1})
+	return len(bvh.nodes) - 1
+}
+
+func (bvh *DynamicBVH) freeNode(index int) {
+	bvh.nodes[index] = dynNode{Parent: nullNode, Left: nullNode, Right: nullNode, Id: -1}
+	bvh.free = append(bvh.free, index)
+}
+
+func (bvh *DynamicBVH) newLeaf(id int, object Hittable, box AABB, parent int) int {
+	leaf := bvh.allocNode()
+	bvh.nodes[leaf].Box = box
+	bvh.nodes[leaf].Parent = parent
+	bvh.nodes[leaf].Object = object
+	bvh.nodes[leaf].Id = id
+	bvh.leaves[id] = leaf
+	return leaf
+}
+
+// Insert adds an object to the tree and returns its handle.
+// The sibling is chosen greedily by the smallest growth of surface area.
+func (bvh *DynamicBVH) Insert(object Hittable) int {
+	id := bvh.nextId
+	bvh.nextId++
+
+	item := newDynItem(id, object)
+	leaf := bvh.newLeaf(id, object, item.Box, nullNode)
+	if bvh.root == nullNode {
+		bvh.root = leaf
+		return id
+	}
+
+	box := item.Box
+	index := bvh.root
+	for !bvh.nodes[index].isLeaf() {
+		n := bvh.nodes[index]
+		area := n.Box.Area()
+		combined := Surrounding_box(n.Box, box).Area()
+
+		// cost of creating a new parent for this node and the new leaf
+		cost := 2 * combined
+		// minimum cost of pushing the leaf further down the tree
+		inheritance := 2 * (combined - area)
+
+		descend := func(child int) float32 {
+			c := bvh.nodes[child]
+			grown := Surrounding_box(c.Box, box).Area()
+			if c.isLeaf() {
+				return grown + inheritance
+			}
+			return grown - c.Box.Area() + inheritance
+		}
+		cost_left := descend(n.Left)
+		cost_right := descend(n.Right)
+
+		if cost < cost_left && cost < cost_right {
+			break
+		}
+		if cost_left < cost_right {
+			index = n.Left
+		} else {
+			index = n.Right
+		}
+	}
+
+	sibling := index
+	old_parent := bvh.nodes[sibling].Parent
+	parent := bvh.allocNode()
+	bvh.nodes[parent].Parent = old_parent
+	bvh.nodes[parent].Left = sibling
+	bvh.nodes[parent].Right = leaf
+	bvh.nodes[sibling].Parent = parent
+	bvh.nodes[leaf].Parent = parent
+
+	if old_parent == nullNode {
+		bvh.root = parent
+	} else if bvh.nodes[old_parent].Left == sibling {
+		bvh.nodes[old_parent].Left = parent
+	} else {
+		bvh.nodes[old_parent].Right = parent
+	}
+	bvh.refitUp(parent)
+	return id
+}
+
+// Remove deletes the object stored under the handle.
+func (bvh *DynamicBVH) Remove(id int) bool {
+	leaf, ok := bvh.leaves[id]
+	if !ok {
+		return false
+	}
+	delete(bvh.leaves, id)
+
+	parent := bvh.nodes[leaf].Parent
+	bvh.freeNode(leaf)
+	if parent == nullNode {
+		bvh.root = nullNode
+		return true
+	}
+
+	sibling := bvh.nodes[parent].Left
+	if sibling == leaf {
+		sibling = bvh.nodes[parent].Right
+	}
+	grand_parent := bvh.nodes[parent].Parent
+	bvh.nodes[sibling].Parent = grand_parent
+	bvh.freeNode(parent)
+
+	if grand_parent == nullNode {
+		bvh.root = sibling
+		return true
+	}
+	if bvh.nodes[grand_parent].Left == parent {
+		bvh.nodes[grand_parent].Left = sibling
+	} else {
+		bvh.nodes[grand_parent].Right = sibling
+	}
+	bvh.refitUp(grand_parent)
+	return true
+}
+
+// Update replaces the object stored under the handle (ie. a moved copy of a
+// Sphere) and refits the boxes of its ancestors.
+func (bvh *DynamicBVH) Update(id int, object Hittable) bool {
+	leaf, ok := bvh.leaves[id]
+	if !ok {
+		return false
+	}
+	box := NewAABBUninit()
+	object.BBox(&box)
+	bvh.nodes[leaf].Object = object
+	bvh.nodes[leaf].Box = box
+	bvh.refitUp(bvh.nodes[leaf].Parent)
+	return true
+}
+
+// Refit recomputes every bounding box bottom-up. Use it when objects were
+// stored as pointers and moved in place.
+func (bvh *DynamicBVH) Refit() {
+	if bvh.root != nullNode {
+		bvh.refitNode(bvh.root)
+	}
+}
+
+func (bvh *DynamicBVH) refitNode(index int) AABB {
+	n := &bvh.nodes[index]
+	if n.isLeaf() {
+		box := NewAABBUninit()
+		n.Object.BBox(&box)
+		n.Box = box
+		return box
+	}
+	left, right := n.Left, n.Right
+	box := Surrounding_box(bvh.refitNode(left), bvh.refitNode(right))
+	bvh.nodes[index].Box = box
+	return box
+}
+
+func (bvh *DynamicBVH) refitUp(index int) {
+	for index != nullNode {
+		n := &bvh.nodes[index]
+		n.Box = Surrounding_box(bvh.nodes[n.Left].Box, bvh.nodes[n.Right].Box)
+		index = n.Parent
+	}
+}
+
+// Cost returns the SAH cost of the tree. Areas are normalised by the total
+// area of the leaves (instead of the root) so the value does not drop just
+// because objects spread apart and the root box grew.
+func (bvh *DynamicBVH) Cost() float32 {
+	if bvh.root == nullNode {
+		return 0
+	}
+	var inner_area, leaf_area float32
+	for index := range bvh.nodes {
+		n := &bvh.nodes[index]
+		if n.Object != nil {
+			leaf_area += n.Box.Area()
+		} else if n.Left != nullNode {
+			inner_area += n.Box.Area()
+		}
+	}
+	if leaf_area <= 0 {
+		return 0
+	}
+	return (sahTraversalCost*inner_area + sahIntersectionCost*leaf_area) / leaf_area
+}
+
+// Quality returns the ratio of the current SAH cost to the cost right after
+// the last full build. 1.0 means the tree is as good as a fresh one.
+func (bvh *DynamicBVH) Quality() float32 {
+	if bvh.buildCost == 0 {
+		if bvh.Len() > 1 {
+			return float32(math.Inf(1)) // built empty, objects added since
+		}
+		return 1
+	}
+	return bvh.Cost() / bvh.buildCost
+}
+
+// NeedsRebuild reports whether the tree degraded past the threshold
+// (ie. 1.5 - traversal is expected to be 50% slower than after a rebuild).
+func (bvh *DynamicBVH) NeedsRebuild(threshold float32) bool {
+	return bvh.Quality() > threshold
+}
+
+func (bvh *DynamicBVH) Hit(r *Ray, t_min, t_max float32, rec *HitRecord) bool {
+	if bvh.root == nullNode {
+		return false
+	}
+	var temp_rec HitRecord
+	hit_anything := false
+	closest_so_far := t_max
+
+	var buf [64]int
+	stack := append(buf[:0], bvh.root)
+	for len(stack) > 0 {
+		index := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		n := &bvh.nodes[index]
+		if !n.Box.HitSlab(r, t_min, closest_so_far) {
+			continue
+		}
+		if n.isLeaf() {
+			temp_rec = NewHitRecord()
+			if n.Object.Hit(r, t_min, closest_so_far, &temp_rec) {
+				closest_so_far = temp_rec.T
+				hit_anything = true
+				setObjectId(&temp_rec, n.Object, n.Id)
+				*rec = temp_rec
+			}
+			continue
+		}
+		stack = append(stack, n.Left, n.Right)
+	}
+	return hit_anything
+}
+
+func (bvh *DynamicBVH) Occluded(r *Ray, t_min, t_max float32) bool {
+	if bvh.root == nullNode {
+		return false
+	}
+	var buf [64]int
+	stack := append(buf[:0], bvh.root)
+	for len(stack) > 0 {
+		index := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		n := &bvh.nodes[index]
+		if !n.Box.HitSlab(r, t_min, t_max) {
+			continue
+		}
+		if n.isLeaf() {
+			if n.Object.Occluded(r, t_min, t_max) {
+				return true
+			}
+			continue
+		}
+		stack = append(stack, n.Left, n.Right)
+	}
+	return false
+}
+
+func (bvh *DynamicBVH) BBox(output_box *AABB) bool {
+	if bvh.root == nullNode {
+		return false
+	}
+	*output_box = bvh.nodes[bvh.root].Box
+	return true
+}
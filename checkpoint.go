@@ -0,0 +1,297 @@
+package raytrace
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+)
+
+// Checkpoint is the state of a RenderProgressive, enough to continue it
+// with ResumeProgressive after the process died. The random generators are
+// seeded from Seed, the pass and the pixel, so they need no state of
+// their own. The Denoiser of the film is not saved.
+type Checkpoint struct {
+	Pass           int // passes completed, some rows may have the next one too
+	Seed           int64
+	SamplesPerPass int
+	Film           *Film
+}
+
+// Checkpoint files are little endian: checkpointHeader followed by the
+// AOVs as int32, the mean and m2 of the colors as float32 triples, the
+// sample counts as int32, the hit counts as int32 when a AOV needs them
+// and every layer of the AOVs as float32 triples, in the order of the
+// AOVs. Then the Cryptomatte, when HasCrypto is 1: its layer, names and
+// instance names as strings (an int32 length and the bytes), the total
+// weight of every pixel as float32 and for every pixel the number of
+// objects seen as int32, followed by the int32 InstanceId and ObjectId and
+// the float32 weight of each.
+const checkpointMagic = "CKP1"
+
+type checkpointHeader struct {
+	Magic                     [4]byte
+	Width, Height             int32
+	Seed                      int64
+	Pass, SamplesPerPass      int32
+	NumAOVs, HasCrypto, Ranks int32
+}
+
+// Largest film and strings accepted by DecodeCheckpoint
+const (
+	maxCheckpointPixels = 1 << 28
+	maxCheckpointString = 1 << 16
+)
+
+var (
+	errCheckpointFormat   = errors.New("checkpoint: invalid format")
+	errCheckpointMismatch = errors.New("checkpoint: does not match the render")
+)
+
+// SaveCheckpoint writes c to path, replacing it atomically so that a crash
+// while saving leaves the previous checkpoint.
+func SaveCheckpoint(path string, c *Checkpoint) error {
+	return replaceFile(path, func(w io.Writer) error {
+		return EncodeCheckpoint(w, c)
+	})
+}
+
+func LoadCheckpoint(path string) (*Checkpoint, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return DecodeCheckpoint(f)
+}
+
+// EncodeCheckpoint writes c in the format read by DecodeCheckpoint.
+func EncodeCheckpoint(w io.Writer, c *Checkpoint) error {
+	f := c.Film
+	h := checkpointHeader{
+		Width:          int32(f.Width),
+		Height:         int32(f.Height),
+		Seed:           c.Seed,
+		Pass:           int32(c.Pass),
+		SamplesPerPass: int32(c.SamplesPerPass),
+		NumAOVs:        int32(len(f.aovs)),
+	}
+	copy(h.Magic[:], checkpointMagic)
+	if f.Cryptomatte != nil {
+		h.HasCrypto = 1
+		h.Ranks = int32(f.Cryptomatte.Ranks)
+	}
+	bw := bufio.NewWriter(w)
+	e := &checkpointEncoder{w: bw}
+	e.write(&h)
+	aovs := make([]int32, len(f.aovs))
+	for i, a := range f.aovs {
+		aovs[i] = int32(a)
+	}
+	e.write(aovs)
+	e.vec3s(f.mean)
+	e.vec3s(f.m2)
+	e.ints(f.samples)
+	if f.hits != nil {
+		e.ints(f.hits)
+	}
+	for _, a := range f.aovs {
+		if layer, ok := f.layers[a]; ok {
+			e.vec3s(layer)
+		}
+	}
+	if c := f.Cryptomatte; c != nil {
+		e.string(c.Layer)
+		for _, names := range [][]string{c.Names, c.InstanceNames} {
+			e.write(int32(len(names)))
+			for _, name := range names {
+				e.string(name)
+			}
+		}
+		e.write(c.total)
+		for _, pixel := range c.pixels {
+			e.write(int32(len(pixel)))
+			for _, coverage := range pixel {
+				e.write(int32(coverage.instance))
+				e.write(int32(coverage.id))
+				e.write(coverage.weight)
+			}
+		}
+	}
+	if e.err != nil {
+		return e.err
+	}
+	return bw.Flush()
+}
+
+// DecodeCheckpoint reads a checkpoint written by EncodeCheckpoint.
+func DecodeCheckpoint(r io.Reader) (*Checkpoint, error) {
+	return decodeCheckpoint(r, nil)
+}
+
+// decodeCheckpoint is DecodeCheckpoint calling accept, when not nil, with
+// the header before the film is allocated. An error of accept stops it.
+func decodeCheckpoint(r io.Reader, accept func(h *checkpointHeader) error) (*Checkpoint, error) {
+	br := bufio.NewReader(r)
+	var h checkpointHeader
+	if err := binary.Read(br, binary.LittleEndian, &h); err != nil {
+		return nil, err
+	}
+	if string(h.Magic[:]) != checkpointMagic || h.Width <= 0 || h.Height <= 0 ||
+		int64(h.Width)*int64(h.Height) > maxCheckpointPixels ||
+		h.Pass < 0 || h.SamplesPerPass <= 0 || h.NumAOVs < 0 || h.NumAOVs > int32(len(aovNames)) {
+		return nil, errCheckpointFormat
+	}
+	if accept != nil {
+		if err := accept(&h); err != nil {
+			return nil, err
+		}
+	}
+	d := &checkpointDecoder{r: br}
+	aovs := make([]int32, h.NumAOVs)
+	d.read(aovs)
+	if d.err != nil {
+		return nil, d.err
+	}
+	film_aovs := make([]AOV, len(aovs))
+	for i, a := range aovs {
+		if a < 0 || int(a) >= len(aovNames) {
+			return nil, errCheckpointFormat
+		}
+		film_aovs[i] = AOV(a)
+	}
+	f := NewFilm(int(h.Width), int(h.Height), film_aovs...)
+	d.vec3s(f.mean)
+	d.vec3s(f.m2)
+	d.ints(f.samples)
+	if f.hits != nil {
+		d.ints(f.hits)
+	}
+	for _, a := range f.aovs {
+		if layer, ok := f.layers[a]; ok {
+			d.vec3s(layer)
+		}
+	}
+	if h.HasCrypto != 0 {
+		layer := d.string()
+		var names [2][]string
+		for k := range names {
+			var num_names int32
+			d.read(&num_names)
+			if d.err != nil {
+				return nil, d.err
+			}
+			if num_names < 0 || num_names > maxCheckpointString {
+				return nil, errCheckpointFormat
+			}
+			names[k] = make([]string, num_names)
+			for i := range names[k] {
+				names[k][i] = d.string()
+			}
+		}
+		c := NewCryptomatte(f.Width, f.Height, layer, names[0])
+		c.InstanceNames = names[1]
+		c.Ranks = int(h.Ranks)
+		d.read(c.total)
+		for i := range c.pixels {
+			var n int32
+			d.read(&n)
+			if d.err != nil {
+				return nil, d.err
+			}
+			if n < 0 || n > maxCheckpointString {
+				return nil, errCheckpointFormat
+			}
+			for k := int32(0); k < n; k++ {
+				var instance, id int32
+				var weight float32
+				d.read(&instance)
+				d.read(&id)
+				d.read(&weight)
+				c.pixels[i] = append(c.pixels[i], cryptoCoverage{int(instance), int(id), weight})
+			}
+		}
+		f.Cryptomatte = c
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	return &Checkpoint{int(h.Pass), h.Seed, int(h.SamplesPerPass), f}, nil
+}
+
+// checkpointEncoder keeps the first error, later writes do nothing.
+type checkpointEncoder struct {
+	w   io.Writer
+	err error
+}
+
+func (e *checkpointEncoder) write(data interface{}) {
+	if e.err == nil {
+		e.err = binary.Write(e.w, binary.LittleEndian, data)
+	}
+}
+
+func (e *checkpointEncoder) vec3s(v []Vec3) {
+	floats := make([]float32, 3*len(v))
+	for i, p := range v {
+		floats[3*i], floats[3*i+1], floats[3*i+2] = p.x, p.y, p.z
+	}
+	e.write(floats)
+}
+
+func (e *checkpointEncoder) ints(v []int) {
+	ints := make([]int32, len(v))
+	for i, n := range v {
+		ints[i] = int32(n)
+	}
+	e.write(ints)
+}
+
+func (e *checkpointEncoder) string(s string) {
+	e.write(int32(len(s)))
+	e.write([]byte(s))
+}
+
+// checkpointDecoder keeps the first error, later reads do nothing.
+type checkpointDecoder struct {
+	r   io.Reader
+	err error
+}
+
+func (d *checkpointDecoder) read(data interface{}) {
+	if d.err == nil {
+		d.err = binary.Read(d.r, binary.LittleEndian, data)
+	}
+}
+
+func (d *checkpointDecoder) vec3s(v []Vec3) {
+	floats := make([]float32, 3*len(v))
+	d.read(floats)
+	for i := range v {
+		v[i] = NewVec3(floats[3*i], floats[3*i+1], floats[3*i+2])
+	}
+}
+
+func (d *checkpointDecoder) ints(v []int) {
+	ints := make([]int32, len(v))
+	d.read(ints)
+	for i, n := range ints {
+		v[i] = int(n)
+	}
+}
+
+func (d *checkpointDecoder) string() string {
+	var n int32
+	d.read(&n)
+	if d.err != nil {
+		return ""
+	}
+	if n < 0 || n > maxCheckpointString {
+		d.err = errCheckpointFormat
+		return ""
+	}
+	b := make([]byte, n)
+	d.read(b)
+	return string(b)
+}
@@ -0,0 +1,233 @@
+package raytrace
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/bits"
+	"sort"
+)
+
+// Cryptomatte records anti-aliased ID mattes in the Cryptomatte layout:
+// every object name is hashed to a float ID and each pixel stores the IDs
+// covering it with their coverage, ordered by coverage, two ranks per RGBA
+// layer (Layer00, Layer01, ...). The EXR header carries the name to ID
+// manifest, so that compositors can pick objects by name.
+//
+// Set Film.Cryptomatte to record one while rendering. Objects with the
+// same name share a matte. Hits through an Instance are named after the
+// instance rather than the primitive of its shared BVH, all the primitives
+// of an instance share a matte.
+type Cryptomatte struct {
+	Layer         string   // ie. "CryptoObject"
+	Names         []string // object names indexed by ObjectId
+	InstanceNames []string // instance names indexed by InstanceId
+	Ranks         int      // number of ID/coverage pairs written, 0 is 6
+
+	width, height int
+	total         []float32 // weight of all samples per pixel
+	pixels        [][]cryptoCoverage
+}
+
+type cryptoCoverage struct {
+	instance, id int
+	weight       float32
+}
+
+func NewCryptomatte(width, height int, layer string, names []string) *Cryptomatte {
+	return &Cryptomatte{
+		Layer:  layer,
+		Names:  names,
+		width:  width,
+		height: height,
+		total:  make([]float32, width*height),
+		pixels: make([][]cryptoCoverage, width*height),
+	}
+}
+
+// name of an object, made up for objects beyond Names and InstanceNames
+func (c *Cryptomatte) name(instance, id int) string {
+	if instance >= 0 {
+		if instance < len(c.InstanceNames) && c.InstanceNames[instance] != "" {
+			return c.InstanceNames[instance]
+		}
+		return fmt.Sprintf("instance%d", instance)
+	}
+	if id < len(c.Names) && c.Names[id] != "" {
+		return c.Names[id]
+	}
+	return fmt.Sprintf("object%d", id)
+}
+
+// Add records a sample of the object id (-1 for the background) in pixel
+// x, y. instance is the InstanceId of a hit through an Instance, -1
+// otherwise.
+func (c *Cryptomatte) Add(x, y, instance, id int) {
+	i := y*c.width + x
+	c.total[i]++
+	if id < 0 {
+		return
+	}
+	for k := range c.pixels[i] {
+		if c.pixels[i][k].instance == instance && c.pixels[i][k].id == id {
+			c.pixels[i][k].weight++
+			return
+		}
+	}
+	c.pixels[i] = append(c.pixels[i], cryptoCoverage{instance, id, 1})
+}
+
+// Coverage returns the fraction of pixel x, y covered by the named object.
+func (c *Cryptomatte) Coverage(x, y int, name string) float32 {
+	i := y*c.width + x
+	var weight float32
+	for _, e := range c.pixels[i] {
+		if c.name(e.instance, e.id) == name {
+			weight += e.weight
+		}
+	}
+	if weight == 0 {
+		return 0
+	}
+	return weight / c.total[i]
+}
+
+func (c *Cryptomatte) ranks() int {
+	if c.Ranks <= 0 {
+		return 6
+	}
+	return c.Ranks
+}
+
+// Channels returns the EXR channels, Layer00.R holds the ID of rank 0,
+// .G its coverage, .B and .A the same for rank 1 and so on.
+func (c *Cryptomatte) Channels() []EXRChannel {
+	ranks := c.ranks()
+	layers := (ranks + 1) / 2
+	channels := make([]EXRChannel, 0, 4*layers)
+	for l := 0; l < layers; l++ {
+		for _, suffix := range []string{"R", "G", "B", "A"} {
+			name := fmt.Sprintf("%s%02d.%s", c.Layer, l, suffix)
+			channels = append(channels, EXRChannel{name, make([]float32, c.width*c.height)})
+		}
+	}
+	type entry struct {
+		hash   uint32
+		weight float32
+	}
+	var sorted []entry
+	for i, pixel := range c.pixels {
+		// merge objects of the same name
+		sorted = sorted[:0]
+	merge:
+		for _, e := range pixel {
+			hash := murmur3([]byte(c.name(e.instance, e.id)), 0)
+			for k := range sorted {
+				if sorted[k].hash == hash {
+					sorted[k].weight += e.weight
+					continue merge
+				}
+			}
+			sorted = append(sorted, entry{hash, e.weight})
+		}
+		sort.Slice(sorted, func(a, b int) bool {
+			if sorted[a].weight != sorted[b].weight {
+				return sorted[a].weight > sorted[b].weight
+			}
+			return sorted[a].hash < sorted[b].hash
+		})
+		for rank, e := range sorted {
+			if rank == ranks {
+				break
+			}
+			channels[2*rank].Data[i] = hashToFloat(e.hash)
+			channels[2*rank+1].Data[i] = e.weight / c.total[i]
+		}
+	}
+	return channels
+}
+
+// Manifest maps all Names and InstanceNames, and the made up names of
+// other objects seen by the camera, to the bits of their IDs as hex
+// strings.
+func (c *Cryptomatte) Manifest() map[string]string {
+	manifest := make(map[string]string)
+	add := func(name string) {
+		id := hashToFloat(murmur3([]byte(name), 0))
+		manifest[name] = fmt.Sprintf("%08x", math.Float32bits(id))
+	}
+	for i := range c.Names {
+		add(c.name(-1, i))
+	}
+	for i := range c.InstanceNames {
+		add(c.name(i, -1))
+	}
+	for _, pixel := range c.pixels {
+		for _, e := range pixel {
+			add(c.name(e.instance, e.id))
+		}
+	}
+	return manifest
+}
+
+// Attributes returns the EXR header metadata of the layer.
+func (c *Cryptomatte) Attributes() map[string]string {
+	manifest, _ := json.Marshal(c.Manifest())
+	key := fmt.Sprintf("cryptomatte/%07x/", murmur3([]byte(c.Layer), 0)>>4)
+	return map[string]string{
+		key + "name":       c.Layer,
+		key + "hash":       "MurmurHash3_32",
+		key + "conversion": "uint32_to_float32",
+		key + "manifest":   string(manifest),
+	}
+}
+
+// hashToFloat reinterprets a name hash as a float32 ID. Hashes which
+// would be a denormal, Inf or NaN have a bit of the exponent flipped.
+func hashToFloat(hash uint32) float32 {
+	exponent := hash >> 23 & 0xff
+	if exponent == 0 || exponent == 0xff {
+		hash ^= 1 << 23
+	}
+	return math.Float32frombits(hash)
+}
+
+// MurmurHash3_x86_32
+func murmur3(data []byte, seed uint32) uint32 {
+	const c1, c2 = 0xcc9e2d51, 0x1b873593
+	h := seed
+	n := len(data) / 4
+	for i := 0; i < n; i++ {
+		k := binary.LittleEndian.Uint32(data[4*i:])
+		k *= c1
+		k = bits.RotateLeft32(k, 15)
+		k *= c2
+		h ^= k
+		h = bits.RotateLeft32(h, 13)
+		h = h*5 + 0xe6546b64
+	}
+	var k uint32
+	tail := data[4*n:]
+	switch len(tail) {
+	case 3:
+		k ^= uint32(tail[2]) << 16
+		fallthrough
+	case 2:
+		k ^= uint32(tail[1]) << 8
+		fallthrough
+	case 1:
+		k ^= uint32(tail[0])
+		k *= c1
+		k = bits.RotateLeft32(k, 15)
+		k *= c2
+		h ^= k
+	}
+	h ^= uint32(len(data))
+	h ^= h >> 16
+	h *= 0x85ebca6b
+	h ^= h >> 13
+	h *= 0xc2b2ae35
+	h ^= h >> 16
+	return h
+}
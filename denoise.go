@@ -0,0 +1,239 @@
+package raytrace
+
+import (
+	"image"
+	"math"
+	"runtime"
+	"sync"
+)
+
+// Denoiser is a non-local means filter for noisy renders (Rousselle et al.
+// 2012, "Adaptive Rendering with Non-Local Means Filtering"). Neighbours
+// are averaged with weights from the distance of small patches around
+// them, measured relative to the variance estimated by the Film, so that
+// only differences explained by the noise are smoothed away. The AOVs
+// recorded by the film guide the filter:
+//   - AOVAlbedo: textures are divided out before filtering and put back after
+//   - AOVNormal, AOVDepth and AOVAlbedo: edges between surfaces and
+//     materials are kept sharp
+//
+// Zero fields take the defaults.
+type Denoiser struct {
+	Radius      int     // of the search window, 7
+	PatchRadius int     // 1, 3x3 patches
+	Strength    float32 // k of the paper, higher smooths more, 1
+	NormalSigma float32 // 0.3
+	AlbedoSigma float32 // 0.1
+	DepthSigma  float32 // relative difference, 0.05
+}
+
+func (d Denoiser) withDefaults() Denoiser {
+	if d.Radius <= 0 {
+		d.Radius = 7
+	}
+	if d.PatchRadius <= 0 {
+		d.PatchRadius = 1
+	}
+	if d.Strength <= 0 {
+		d.Strength = 1
+	}
+	if d.NormalSigma <= 0 {
+		d.NormalSigma = 0.3
+	}
+	if d.AlbedoSigma <= 0 {
+		d.AlbedoSigma = 0.1
+	}
+	if d.DepthSigma <= 0 {
+		d.DepthSigma = 0.05
+	}
+	return d
+}
+
+// Albedo below which the color is not demodulated
+const denoiseMinAlbedo = 0.01
+
+// Denoise filters the beauty pass of film.
+func (d Denoiser) Denoise(film *Film) *HDRImage {
+	d = d.withDefaults()
+	w, h := film.Width, film.Height
+	color := film.Beauty()
+	albedo := film.AOV(AOVAlbedo)
+	normal := film.AOV(AOVNormal)
+	depth := film.AOV(AOVDepth)
+
+	// demodulated color and the variance of its mean
+	variance := NewHDRImage(w, h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			variance.Set(x, y, film.Variance(x, y))
+		}
+	}
+	if albedo != nil {
+		for i := range color.Pix {
+			a := demodulation(albedo.Pix[i])
+			color.Pix[i] = color.Pix[i].Div(a)
+			variance.Pix[i] = variance.Pix[i].Div(a.Mult(a))
+		}
+	}
+	variance = smoothVariance(variance, color)
+	guides := [3]*HDRImage{albedo, normal, depth}
+
+	out := NewHDRImage(w, h)
+	rows := make(chan int, h)
+	for y := 0; y < h; y++ {
+		rows <- y
+	}
+	close(rows)
+	var wg sync.WaitGroup
+	for n := 0; n < runtime.NumCPU(); n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for y := range rows {
+				for x := 0; x < w; x++ {
+					out.Set(x, y, d.filter(x, y, color, variance, guides))
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if albedo != nil {
+		for i := range out.Pix {
+			out.Pix[i] = out.Pix[i].Mult(demodulation(albedo.Pix[i]))
+		}
+	}
+	return out
+}
+
+// albedo the color is divided by, 1 where it is too dark
+func demodulation(albedo Vec3) Vec3 {
+	a := [3]float32{albedo.x, albedo.y, albedo.z}
+	for c := range a {
+		if a[c] < denoiseMinAlbedo {
+			a[c] = 1
+		}
+	}
+	return NewVec3(a[0], a[1], a[2])
+}
+
+// smoothVariance averages the variance over 3x3 pixels, which is itself
+// noisy. Pixels with less than two samples get the spatial variance of
+// the colors around them instead.
+func smoothVariance(variance, color *HDRImage) *HDRImage {
+	w, h := variance.Width, variance.Height
+	out := NewHDRImage(w, h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var sum, mean, squares Vec3
+			unknown := false
+			for dy := -1; dy <= 1; dy++ {
+				for dx := -1; dx <= 1; dx++ {
+					qx, qy := clampIndex(x+dx, w), clampIndex(y+dy, h)
+					v := variance.At(qx, qy)
+					if math.IsInf(float64(v.x), 1) {
+						unknown = true
+					}
+					c := color.At(qx, qy)
+					sum = sum.Add(v)
+					mean = mean.Add(c)
+					squares = squares.Add(c.Mult(c))
+				}
+			}
+			if unknown {
+				mean = mean.DivF(9)
+				out.Set(x, y, squares.DivF(9).Subtr(mean.Mult(mean)))
+			} else {
+				out.Set(x, y, sum.DivF(9))
+			}
+		}
+	}
+	return out
+}
+
+func (d Denoiser) filter(x, y int, color, variance *HDRImage, guides [3]*HDRImage) Vec3 {
+	w, h := color.Width, color.Height
+	k2 := d.Strength * d.Strength
+	patch_size := float32(3 * (2*d.PatchRadius + 1) * (2*d.PatchRadius + 1))
+	var sum Vec3
+	var total float32
+	for qy := y - d.Radius; qy <= y+d.Radius; qy++ {
+		if qy < 0 || qy >= h {
+			continue
+		}
+		for qx := x - d.Radius; qx <= x+d.Radius; qx++ {
+			if qx < 0 || qx >= w {
+				continue
+			}
+			weight := d.featureWeight(x, y, qx, qy, guides)
+			if weight == 0 {
+				continue
+			}
+			// patch distance, the expected difference due to noise is
+			// subtracted so that it is about 0 for similar patches
+			var dist float32
+			for oy := -d.PatchRadius; oy <= d.PatchRadius; oy++ {
+				for ox := -d.PatchRadius; ox <= d.PatchRadius; ox++ {
+					p := color.At(clampIndex(x+ox, w), clampIndex(y+oy, h))
+					q := color.At(clampIndex(qx+ox, w), clampIndex(qy+oy, h))
+					vp := variance.At(clampIndex(x+ox, w), clampIndex(y+oy, h))
+					vq := variance.At(clampIndex(qx+ox, w), clampIndex(qy+oy, h))
+					for c := 0; c < 3; c++ {
+						diff := p.At(c) - q.At(c)
+						var_p, var_q := vp.At(c), vq.At(c)
+						dist += (diff*diff - (var_p + float32(math.Min(float64(var_p), float64(var_q))))) /
+							(1e-10 + k2*(var_p+var_q))
+					}
+				}
+			}
+			dist /= patch_size
+			if dist > 0 {
+				weight *= float32(math.Exp(-float64(dist)))
+			}
+			sum = sum.Add(color.At(qx, qy).MultF(weight))
+			total += weight
+		}
+	}
+	if total == 0 {
+		return color.At(x, y)
+	}
+	return sum.DivF(total)
+}
+
+// weight of neighbour q of p from the guiding AOVs: albedo, normal and
+// depth, each of them may be nil
+func (d Denoiser) featureWeight(px, py, qx, qy int, guides [3]*HDRImage) float32 {
+	albedo, normal, depth := guides[0], guides[1], guides[2]
+	weight := 1.0
+	if depth != nil {
+		dp, dq := float64(depth.At(px, py).x), float64(depth.At(qx, qy).x)
+		switch {
+		case math.IsInf(dp, 1) && math.IsInf(dq, 1): // both background
+		case math.IsInf(dp, 1) || math.IsInf(dq, 1):
+			return 0
+		default:
+			rel := (dp - dq) / (float64(d.DepthSigma) * math.Max(math.Abs(dp), 1e-3))
+			weight *= math.Exp(-rel * rel)
+		}
+	}
+	if normal != nil {
+		dn := normal.At(px, py).Subtr(normal.At(qx, qy)).LengthSquared()
+		weight *= math.Exp(-float64(dn) / float64(d.NormalSigma*d.NormalSigma))
+	}
+	if albedo != nil {
+		da := albedo.At(px, py).Subtr(albedo.At(qx, qy)).LengthSquared()
+		weight *= math.Exp(-float64(da) / float64(d.AlbedoSigma*d.AlbedoSigma))
+	}
+	return float32(weight)
+}
+
+// ToRGBA converts img like Write_color() does for a single sample.
+func ToRGBA(img *HDRImage) *image.RGBA {
+	rgba := image.NewRGBA(image.Rect(0, 0, img.Width, img.Height))
+	for y := 0; y < img.Height; y++ {
+		for x := 0; x < img.Width; x++ {
+			rgba.SetRGBA(x, y, Write_color(img.At(x, y), 1))
+		}
+	}
+	return rgba
+}
@@ -0,0 +1,362 @@
+package raytrace
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// A distributed render splits the frame into work units, a pass of
+// samples over a tile, which a Coordinator hands out to Worker processes
+// over HTTP. Every worker builds the same scene and camera itself, only
+// the units and the rendered tiles go over the wire:
+//
+//	GET  /work         200 with a WorkUnit as JSON, 204 while all the
+//	                   remaining units are out, 410 once the render is over
+//	POST /result?id=N  the tile of unit N as a checkpoint, see EncodeCheckpoint
+//
+// Units which are not returned within the timeout are handed out again,
+// the first result of a unit is merged and later ones are dropped. Tiles
+// arrive in any order, so the film may differ from run to run in the
+// last bits.
+type Distributed struct {
+	TileSize       int // 0 is 64, the size of the frame renders sample ranges
+	Passes         int // 0 is 1
+	SamplesPerPass int // 0 is 1
+	Seed           int64
+	Timeout        time.Duration // before a unit is handed out again, 0 is a minute
+}
+
+func (d Distributed) withDefaults() Distributed {
+	if d.TileSize <= 0 {
+		d.TileSize = 64
+	}
+	if d.Passes <= 0 {
+		d.Passes = 1
+	}
+	if d.SamplesPerPass <= 0 {
+		d.SamplesPerPass = 1
+	}
+	if d.Timeout <= 0 {
+		d.Timeout = time.Minute
+	}
+	return d
+}
+
+// WorkUnit is a pass of Samples samples over Tile, in film coordinates
+// with row 0 at the top, recording the AOVs and the Cryptomatte of the
+// film on the coordinator.
+type WorkUnit struct {
+	Id            int
+	Width, Height int // of the frame
+	Tile          image.Rectangle
+	Pass, Samples int
+	Seed          int64
+	AOVs          []AOV
+	Cryptomatte   bool
+}
+
+var (
+	errWorkUnit   = errors.New("distributed: work unit does not match the camera")
+	errWorkResult = errors.New("distributed: result does not match the work unit")
+)
+
+// resultSize is the largest checkpoint a worker sends for the unit: the
+// colors, sample and hit counts and AOV layers of the tile, and at most a
+// Cryptomatte entry per sample, with room for the header and names.
+func (u WorkUnit) resultSize() int64 {
+	pixels := int64(u.Tile.Dx()) * int64(u.Tile.Dy())
+	per_pixel := int64(2*12 + 4 + 4 + 12*len(u.AOVs))
+	if u.Cryptomatte {
+		per_pixel += 4 + 4 + 12*int64(u.Samples)
+	}
+	return pixels*per_pixel + 1<<16
+}
+
+// checkResult accepts the checkpoint header of a result of the unit
+func (u WorkUnit) checkResult(h *checkpointHeader) error {
+	if int(h.Width) != u.Tile.Dx() || int(h.Height) != u.Tile.Dy() || int(h.Pass) != u.Pass ||
+		h.Seed != u.Seed || int(h.SamplesPerPass) != u.Samples ||
+		int(h.NumAOVs) != len(u.AOVs) || (h.HasCrypto != 0) != u.Cryptomatte {
+		return errWorkResult
+	}
+	return nil
+}
+
+// Coordinator serves the work units of a render into film, mount it on a
+// server with http.Handle or http.StripPrefix.
+type Coordinator struct {
+	film    *Film
+	timeout time.Duration
+	planned int // samples
+
+	mu        sync.Mutex
+	units     []WorkUnit
+	leases    []time.Time // when a unit was handed out, zero before
+	done      []bool
+	remaining int
+	merged    int // samples
+	closed    bool
+	finished  chan struct{}
+}
+
+func NewCoordinator(film *Film, d Distributed) *Coordinator {
+	d = d.withDefaults()
+	c := &Coordinator{
+		film:     film,
+		timeout:  d.Timeout,
+		planned:  film.Width * film.Height * d.Passes * d.SamplesPerPass,
+		finished: make(chan struct{}),
+	}
+	// pass by pass, so that a part of the units covers the whole frame
+	for pass := 1; pass <= d.Passes; pass++ {
+		for y := 0; y < film.Height; y += d.TileSize {
+			for x := 0; x < film.Width; x += d.TileSize {
+				tile := image.Rect(x, y, x+d.TileSize, y+d.TileSize).Intersect(image.Rect(0, 0, film.Width, film.Height))
+				c.units = append(c.units, WorkUnit{
+					Id:          len(c.units),
+					Width:       film.Width,
+					Height:      film.Height,
+					Tile:        tile,
+					Pass:        pass,
+					Samples:     d.SamplesPerPass,
+					Seed:        d.Seed,
+					AOVs:        film.AOVs(),
+					Cryptomatte: film.Cryptomatte != nil,
+				})
+			}
+		}
+	}
+	c.leases = make([]time.Time, len(c.units))
+	c.done = make([]bool, len(c.units))
+	c.remaining = len(c.units)
+	if c.remaining == 0 {
+		close(c.finished)
+	}
+	return c
+}
+
+func (c *Coordinator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/work":
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		unit, status := c.lease()
+		if status != http.StatusOK {
+			w.WriteHeader(status)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(unit)
+	case "/result":
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		id, err := strconv.Atoi(r.URL.Query().Get("id"))
+		if err != nil || id < 0 || id >= len(c.units) {
+			http.Error(w, "unknown work unit", http.StatusBadRequest)
+			return
+		}
+		// the header is checked before the tile is allocated
+		unit := c.units[id]
+		checkpoint, err := decodeCheckpoint(http.MaxBytesReader(w, r.Body, unit.resultSize()), unit.checkResult)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(c.merge(id, checkpoint))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// lease hands out the first unit which was never handed out or timed out
+func (c *Coordinator) lease() (WorkUnit, int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed || c.remaining == 0 {
+		return WorkUnit{}, http.StatusGone
+	}
+	now := time.Now()
+	for i, unit := range c.units {
+		if !c.done[i] && (c.leases[i].IsZero() || now.Sub(c.leases[i]) >= c.timeout) {
+			c.leases[i] = now
+			return unit, http.StatusOK
+		}
+	}
+	return WorkUnit{}, http.StatusNoContent
+}
+
+// merge adds the result of unit id, checked by checkResult, to the film,
+// returns the HTTP status
+func (c *Coordinator) merge(id int, checkpoint *Checkpoint) int {
+	unit := c.units[id]
+	tile := checkpoint.Film
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed || c.remaining == 0 {
+		return http.StatusGone
+	}
+	if c.done[id] { // a late result of a unit handed out again
+		return http.StatusNoContent
+	}
+	c.film.Merge(tile, unit.Tile.Min)
+	c.done[id] = true
+	c.merged += tile.totalSamples()
+	c.remaining--
+	if c.remaining == 0 {
+		close(c.finished)
+	}
+	return http.StatusNoContent
+}
+
+// Progress returns the fraction of the samples merged so far.
+func (c *Coordinator) Progress() float32 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.planned == 0 {
+		return 1
+	}
+	return float32(c.merged) / float32(c.planned)
+}
+
+// Wait returns once every unit was merged or ctx is done. Results which
+// arrive later are not merged, the film belongs to the caller.
+func (c *Coordinator) Wait(ctx context.Context) RenderResult {
+	select {
+	case <-c.finished:
+		return RenderResult{c.film, 1, nil}
+	case <-ctx.Done():
+	}
+	c.mu.Lock()
+	c.closed = true
+	c.mu.Unlock()
+	select {
+	case <-c.finished: // the last unit came in meanwhile
+		return RenderResult{c.film, 1, nil}
+	default:
+	}
+	return RenderResult{c.film, c.Progress(), ctx.Err()}
+}
+
+// Worker renders the work units of a Coordinator.
+type Worker struct {
+	Coordinator  string // URL, ie. "http://farm1:8080"
+	Camera       Camera
+	Scene        *Scene
+	Integrator   Integrator    // nil is RayColorNEE
+	Client       *http.Client  // nil is http.DefaultClient
+	PollInterval time.Duration // while all units are out, 0 is 100ms
+}
+
+// Run renders work units until the coordinator has none left, ctx is done
+// or a request fails.
+func (w Worker) Run(ctx context.Context) error {
+	if w.Client == nil {
+		w.Client = http.DefaultClient
+	}
+	if w.PollInterval <= 0 {
+		w.PollInterval = 100 * time.Millisecond
+	}
+	for {
+		unit, status, err := w.lease(ctx)
+		if err != nil {
+			return err
+		}
+		switch status {
+		case http.StatusGone:
+			return nil
+		case http.StatusNoContent:
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(w.PollInterval):
+			}
+			continue
+		}
+		tile, err := w.render(ctx, unit)
+		if err != nil {
+			return err
+		}
+		status, err = w.post(ctx, unit, tile)
+		if err != nil {
+			return err
+		}
+		if status == http.StatusGone {
+			return nil
+		}
+	}
+}
+
+func (w Worker) lease(ctx context.Context) (WorkUnit, int, error) {
+	var unit WorkUnit
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, w.Coordinator+"/work", nil)
+	if err != nil {
+		return unit, 0, err
+	}
+	resp, err := w.Client.Do(req)
+	if err != nil {
+		return unit, 0, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		err = json.NewDecoder(resp.Body).Decode(&unit)
+	case http.StatusNoContent, http.StatusGone:
+	default:
+		err = fmt.Errorf("distributed: %s from %s", resp.Status, req.URL)
+	}
+	return unit, resp.StatusCode, err
+}
+
+func (w Worker) render(ctx context.Context, unit WorkUnit) (*Film, error) {
+	tile := unit.Tile
+	if unit.Width != w.Camera.Width || unit.Height != w.Camera.Height ||
+		!tile.In(image.Rect(0, 0, unit.Width, unit.Height)) || tile.Empty() {
+		return nil, errWorkUnit
+	}
+	film := NewFilm(tile.Dx(), tile.Dy(), unit.AOVs...)
+	if unit.Cryptomatte {
+		film.Cryptomatte = NewCryptomatte(tile.Dx(), tile.Dy(), "", nil)
+	}
+	integrator := w.Integrator
+	if integrator == nil {
+		integrator = RayColorNEE
+	}
+	samples := func(x, y int) int { return unit.Samples }
+	err := renderPass(ctx, w.Camera, w.Scene, film, tile.Min, integrator, samples, passSeed(unit.Seed, unit.Pass))
+	return film, err
+}
+
+func (w Worker) post(ctx context.Context, unit WorkUnit, tile *Film) (int, error) {
+	var body bytes.Buffer
+	if err := EncodeCheckpoint(&body, &Checkpoint{unit.Pass, unit.Seed, unit.Samples, tile}); err != nil {
+		return 0, err
+	}
+	url := fmt.Sprintf("%s/result?id=%d", w.Coordinator, unit.Id)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, &body)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err := w.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNoContent, http.StatusGone:
+		return resp.StatusCode, nil
+	}
+	return resp.StatusCode, fmt.Errorf("distributed: %s from %s", resp.Status, req.URL)
+}
@@ -0,0 +1,129 @@
+package raytrace
+
+import (
+	"math"
+	"math/rand"
+)
+
+// Background is the radiance arriving from infinitely far away, seen by
+// rays which escape the scene.
+type Background interface {
+	Radiance(dir Vec3) Vec3
+}
+
+// ConstantBackground is a uniform color in every direction.
+type ConstantBackground struct {
+	Color Vec3
+}
+
+func (b ConstantBackground) Radiance(dir Vec3) Vec3 {
+	return b.Color
+}
+
+// GradientBackground blends linearly from Bottom (looking down) to Top
+// (looking up).
+type GradientBackground struct {
+	Bottom, Top Vec3
+}
+
+func (b GradientBackground) Radiance(dir Vec3) Vec3 {
+	t := 0.5 * (dir.UnitVec().y + 1.0)
+	return b.Top.MultF(t).Add(b.Bottom.MultF(1 - t))
+}
+
+// The white to light blue sky used by RayColor()
+var defaultSky = GradientBackground{NewVec3(1, 1, 1), NewVec3(0.5, 0.7, 1.0)}
+
+// Relative luminance of a linear RGB color (Rec. 709)
+func luminance(c Vec3) float32 {
+	return 0.2126*c.x + 0.7152*c.y + 0.0722*c.z
+}
+
+// EnvMap is an equirectangular (latitude-longitude) environment image with
+// +Y up: the top row is the zenith and u = 0 looks along +X, u = 0.25
+// along +Z. It is also a Light: directions are importance sampled by the
+// luminance of the pixels, so add it to the scene's Lights as well as
+// setting it as the Background for image based lighting.
+type EnvMap struct {
+	Image *HDRImage
+	Scale float32 // intensity multiplier
+	dist  *Distribution2D
+}
+
+// NewEnvMap builds the sampling distribution of img.
+func NewEnvMap(img *HDRImage, scale float32) *EnvMap {
+	w, h := img.Width, img.Height
+	f := make([]float32, w*h)
+	for y := 0; y < h; y++ {
+		// rows near the poles cover a smaller solid angle
+		sin_theta := float32(math.Sin(math.Pi * (float64(y) + 0.5) / float64(h)))
+		for x := 0; x < w; x++ {
+			f[y*w+x] = luminance(img.At(x, y)) * sin_theta
+		}
+	}
+	return &EnvMap{img, scale, NewDistribution2D(f, w, h)}
+}
+
+// LoadEnvMap reads an equirectangular .hdr file.
+func LoadEnvMap(path string, scale float32) (*EnvMap, error) {
+	img, err := LoadHDR(path)
+	if err != nil {
+		return nil, err
+	}
+	return NewEnvMap(img, scale), nil
+}
+
+func dirToEquirect(dir Vec3) (u, v float32) {
+	d := dir.UnitVec()
+	phi := math.Atan2(float64(d.z), float64(d.x))
+	if phi < 0 {
+		phi += 2 * math.Pi
+	}
+	theta := math.Acos(math.Max(-1, math.Min(1, float64(d.y))))
+	return float32(phi / (2 * math.Pi)), float32(theta / math.Pi)
+}
+
+// also returns sin(theta) for the pdf conversion
+func equirectToDir(u, v float32) (Vec3, float32) {
+	phi := 2 * math.Pi * float64(u)
+	theta := math.Pi * float64(v)
+	sin_theta := math.Sin(theta)
+	return NewVec3(float32(sin_theta*math.Cos(phi)), float32(math.Cos(theta)), float32(sin_theta*math.Sin(phi))), float32(sin_theta)
+}
+
+// Nearest pixel lookup, the sampling distribution is piecewise constant
+// per pixel too.
+func (e *EnvMap) lookup(u, v float32) Vec3 {
+	x := clampIndex(int(u*float32(e.Image.Width)), e.Image.Width)
+	y := clampIndex(int(v*float32(e.Image.Height)), e.Image.Height)
+	return e.Image.At(x, y).MultF(e.Scale)
+}
+
+func (e *EnvMap) Radiance(dir Vec3) Vec3 {
+	return e.lookup(dirToEquirect(dir))
+}
+
+func (e *EnvMap) Sample(p Vec3, rng *rand.Rand) (LightSample, bool) {
+	u, v, pdf_uv := e.dist.Sample(randFloat(rng), randFloat(rng))
+	if pdf_uv == 0 {
+		return LightSample{}, false
+	}
+	wi, sin_theta := equirectToDir(u, v)
+	if sin_theta == 0 {
+		return LightSample{}, false
+	}
+	// (u, v) to solid angle: dw = 2 Pi^2 sin(theta) du dv
+	pdf := pdf_uv / (2 * math.Pi * math.Pi * sin_theta)
+	return LightSample{wi, float32(math.Inf(1)), e.lookup(u, v), pdf}, true
+}
+
+func (e *EnvMap) Pdf(p, wi Vec3) float32 {
+	u, v := dirToEquirect(wi)
+	_, sin_theta := equirectToDir(u, v)
+	if sin_theta == 0 {
+		return 0
+	}
+	return e.dist.Pdf(u, v) / (2 * math.Pi * math.Pi * sin_theta)
+}
+
+func (e *EnvMap) IsDelta() bool { return false }
@@ -0,0 +1,135 @@
+package raytrace
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"sort"
+)
+
+// EXRChannel is one channel of an OpenEXR image, Data holds width*height
+// values row by row from the top. Multi-layer files name channels
+// "layer.channel", ie. "normal.X".
+type EXRChannel struct {
+	Name string
+	Data []float32
+}
+
+// Channels of a HDRImage, named prefix+"R", "G" and "B"
+func hdrChannels(img *HDRImage, prefix string) []EXRChannel {
+	names := [3]string{"R", "G", "B"}
+	channels := make([]EXRChannel, 3)
+	for c := range channels {
+		channels[c] = EXRChannel{prefix + names[c], make([]float32, len(img.Pix))}
+		for i, p := range img.Pix {
+			channels[c].Data[i] = p.At(c)
+		}
+	}
+	return channels
+}
+
+// SaveEXR writes img as an RGB OpenEXR file.
+func SaveEXR(path string, img *HDRImage) error {
+	return saveFile(path, func(w io.Writer) error {
+		return WriteEXR(w, img.Width, img.Height, hdrChannels(img, ""), nil)
+	})
+}
+
+var errEXRChannel = errors.New("exr: channel size does not match the image")
+
+// WriteEXR writes an uncompressed scanline OpenEXR file with 32 bit float
+// channels. attributes are stored as extra string attributes in the header.
+func WriteEXR(w io.Writer, width, height int, channels []EXRChannel, attributes map[string]string) error {
+	// the format requires channels in alphabetical order
+	sorted := append([]EXRChannel(nil), channels...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+	for _, c := range sorted {
+		if len(c.Data) != width*height {
+			return errEXRChannel
+		}
+	}
+
+	var header bytes.Buffer
+	le := binary.LittleEndian
+	put := func(v interface{}) { binary.Write(&header, le, v) }
+	attribute := func(name, kind string, value []byte) {
+		header.WriteString(name + "\x00" + kind + "\x00")
+		put(int32(len(value)))
+		header.Write(value)
+	}
+
+	header.Write([]byte{0x76, 0x2f, 0x31, 0x01}) // magic
+	version := int32(2)
+	for _, c := range sorted {
+		if len(c.Name) > 31 {
+			version |= 0x400 // long names
+		}
+	}
+	for name := range attributes {
+		if len(name) > 31 {
+			version |= 0x400
+		}
+	}
+	put(version)
+
+	var chlist bytes.Buffer
+	for _, c := range sorted {
+		chlist.WriteString(c.Name + "\x00")
+		// FLOAT, pLinear and reserved, x and y sampling
+		binary.Write(&chlist, le, []int32{2, 0, 1, 1})
+	}
+	chlist.WriteByte(0)
+	attribute("channels", "chlist", chlist.Bytes())
+	attribute("compression", "compression", []byte{0}) // none
+	window := new(bytes.Buffer)
+	binary.Write(window, le, []int32{0, 0, int32(width - 1), int32(height - 1)})
+	attribute("dataWindow", "box2i", window.Bytes())
+	attribute("displayWindow", "box2i", window.Bytes())
+	attribute("lineOrder", "lineOrder", []byte{0}) // increasing y
+	one := make([]byte, 4)
+	le.PutUint32(one, math.Float32bits(1))
+	attribute("pixelAspectRatio", "float", one)
+	attribute("screenWindowCenter", "v2f", make([]byte, 8))
+	attribute("screenWindowWidth", "float", one)
+	names := make([]string, 0, len(attributes))
+	for name := range attributes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		attribute(name, "string", []byte(attributes[name]))
+	}
+	header.WriteByte(0)
+
+	// offsets of the chunks, one scanline each
+	line_size := 4 * width * len(sorted)
+	offset := uint64(header.Len() + 8*height)
+	for y := 0; y < height; y++ {
+		put(offset)
+		offset += uint64(8 + line_size)
+	}
+
+	bw := bufio.NewWriter(w)
+	if _, err := bw.Write(header.Bytes()); err != nil {
+		return err
+	}
+	line := make([]byte, 8+line_size)
+	for y := 0; y < height; y++ {
+		le.PutUint32(line[0:], uint32(y))
+		le.PutUint32(line[4:], uint32(line_size))
+		pos := 8
+		for _, c := range sorted {
+			for _, v := range c.Data[y*width : (y+1)*width] {
+				le.PutUint32(line[pos:], math.Float32bits(v))
+				pos += 4
+			}
+		}
+		if _, err := bw.Write(line); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
@@ -0,0 +1,416 @@
+package raytrace
+
+import (
+	"image"
+	"io"
+	"math"
+	"os"
+)
+
+// AOV is an arbitrary output variable, a pass recorded by the Film next to
+// the beauty image for compositing.
+type AOV int
+
+const (
+	AOVDepth       AOV = iota // distance along the view axis, +Inf where nothing was hit
+	AOVNormal                 // world space shading normal, facing the camera
+	AOVAlbedo                 // base color of the material, 0 for the background
+	AOVPosition               // world space position
+	AOVObjectId               // ObjectId of the first sample, -1 for the background
+	AOVInstanceId             // InstanceId of the first sample
+	AOVSampleCount            // number of samples taken
+	AOVNoise                  // estimated relative error, see Film.Error
+)
+
+var aovNames = [...]string{"depth", "normal", "albedo", "position", "objectid", "instanceid", "samples", "noise"}
+
+func (a AOV) String() string {
+	if a < 0 || int(a) >= len(aovNames) {
+		return "unknown"
+	}
+	return aovNames[a]
+}
+
+// channel names within the layer of the AOV
+func (a AOV) channels() []string {
+	switch a {
+	case AOVDepth:
+		return []string{"Z"}
+	case AOVNormal, AOVPosition:
+		return []string{"X", "Y", "Z"}
+	case AOVAlbedo:
+		return []string{"R", "G", "B"}
+	case AOVSampleCount:
+		return []string{"count"}
+	case AOVNoise:
+		return []string{"Y"}
+	}
+	return []string{"id"}
+}
+
+// AOVSample is what the AOVs record for a single camera ray.
+type AOVSample struct {
+	Hit                  bool
+	Depth                float32
+	Normal, Albedo, P    Vec3
+	ObjectId, InstanceId int
+}
+
+// primaryAOVs traces the camera ray to the first surface.
+func primaryAOVs(cam Camera, ray *Ray, scene *Scene) AOVSample {
+	s := AOVSample{Depth: float32(math.Inf(1)), ObjectId: -1, InstanceId: -1}
+	rec := NewHitRecord()
+	if !scene.World.Hit(ray, 0, float32(math.Inf(1)), &rec) {
+		return s
+	}
+	s.Hit = true
+	s.Depth = rec.T * ray.Direction().Dot(cam.forward())
+	s.Normal = rec.Normal
+	s.Albedo = albedoOf(rec.Mat, &rec)
+	s.P = rec.P
+	s.ObjectId = rec.ObjectId
+	s.InstanceId = rec.InstanceId
+	return s
+}
+
+// Film accumulates samples of an image, row 0 at the top, together with
+// the AOVs it was created with. The color of each pixel is kept as a
+// running mean and variance (Welford's algorithm). Depth, normal and position are averaged
+// over the samples which hit something, albedo over all samples and the
+// IDs come from the first sample of each pixel.
+//
+// Pixels may be written concurrently as long as each pixel is written by
+// a single goroutine.
+type Film struct {
+	Width, Height int
+	aovs          []AOV
+	mean          []Vec3 // running mean and
+	m2            []Vec3 // sum of squared differences from it (Welford)
+	samples       []int
+	hits          []int
+	layers        map[AOV][]Vec3
+
+	// Optional ID mattes recorded from the ObjectId of every sample
+	Cryptomatte *Cryptomatte
+	// Optional post-process applied by Image(), works best with the albedo,
+	// normal and depth AOVs recorded
+	Denoiser *Denoiser
+}
+
+func NewFilm(width, height int, aovs ...AOV) *Film {
+	f := &Film{
+		Width:   width,
+		Height:  height,
+		aovs:    aovs,
+		mean:    make([]Vec3, width*height),
+		m2:      make([]Vec3, width*height),
+		samples: make([]int, width*height),
+		layers:  make(map[AOV][]Vec3),
+	}
+	for _, a := range aovs {
+		switch a {
+		case AOVSampleCount, AOVNoise: // from the samples
+		case AOVDepth, AOVNormal, AOVPosition:
+			if f.hits == nil {
+				f.hits = make([]int, width*height)
+			}
+			fallthrough
+		default:
+			f.layers[a] = make([]Vec3, width*height)
+		}
+	}
+	return f
+}
+
+// AOVs returns the recorded AOVs.
+func (f *Film) AOVs() []AOV {
+	return f.aovs
+}
+
+// Whether AddSample needs an AOVSample
+func (f *Film) needsAOVs() bool {
+	return len(f.layers) > 0 || f.Cryptomatte != nil
+}
+
+// AddSample adds a sample of color to pixel x, y. aov may be nil when the
+// film records no AOVs apart from the sample count.
+func (f *Film) AddSample(x, y int, color Vec3, aov *AOVSample) {
+	i := y*f.Width + x
+	first := f.samples[i] == 0
+	f.samples[i]++
+	delta := color.Subtr(f.mean[i])
+	f.mean[i] = f.mean[i].Add(delta.DivF(float32(f.samples[i])))
+	f.m2[i] = f.m2[i].Add(delta.Mult(color.Subtr(f.mean[i])))
+	if aov == nil {
+		return
+	}
+	if f.Cryptomatte != nil {
+		f.Cryptomatte.Add(x, y, aov.InstanceId, aov.ObjectId)
+	}
+	if aov.Hit && f.hits != nil {
+		f.hits[i]++
+	}
+	for a, layer := range f.layers {
+		switch a {
+		case AOVDepth:
+			if aov.Hit {
+				layer[i].x += aov.Depth
+			}
+		case AOVNormal:
+			if aov.Hit {
+				layer[i] = layer[i].Add(aov.Normal)
+			}
+		case AOVPosition:
+			if aov.Hit {
+				layer[i] = layer[i].Add(aov.P)
+			}
+		case AOVAlbedo:
+			if aov.Hit {
+				layer[i] = layer[i].Add(aov.Albedo)
+			}
+		case AOVObjectId:
+			if first {
+				layer[i].x = float32(aov.ObjectId)
+			}
+		case AOVInstanceId:
+			if first {
+				layer[i].x = float32(aov.InstanceId)
+			}
+		}
+	}
+}
+
+// Samples returns the number of samples taken in pixel x, y.
+func (f *Film) Samples(x, y int) int {
+	return f.samples[y*f.Width+x]
+}
+
+// Merge adds the samples of tile, a film of the pixels from origin on
+// recording the same AOVs, to f. The means and variances are combined
+// like Welford's algorithm does for a single sample (Chan et al.), the
+// IDs of pixels which had no samples come from tile.
+func (f *Film) Merge(tile *Film, origin image.Point) {
+	for ty := 0; ty < tile.Height; ty++ {
+		for tx := 0; tx < tile.Width; tx++ {
+			x, y := origin.X+tx, origin.Y+ty
+			if x < 0 || y < 0 || x >= f.Width || y >= f.Height {
+				continue
+			}
+			i, k := y*f.Width+x, ty*tile.Width+tx
+			na, nb := f.samples[i], tile.samples[k]
+			if nb == 0 {
+				continue
+			}
+			n := float32(na + nb)
+			delta := tile.mean[k].Subtr(f.mean[i])
+			f.mean[i] = f.mean[i].Add(delta.MultF(float32(nb) / n))
+			f.m2[i] = f.m2[i].Add(tile.m2[k]).Add(delta.Mult(delta).MultF(float32(na) * float32(nb) / n))
+			f.samples[i] += nb
+			if f.hits != nil && tile.hits != nil {
+				f.hits[i] += tile.hits[k]
+			}
+			for a, layer := range f.layers {
+				other, ok := tile.layers[a]
+				if !ok {
+					continue
+				}
+				switch a {
+				case AOVObjectId, AOVInstanceId:
+					if na == 0 {
+						layer[i] = other[k]
+					}
+				default:
+					layer[i] = layer[i].Add(other[k])
+				}
+			}
+			if c, o := f.Cryptomatte, tile.Cryptomatte; c != nil && o != nil {
+				c.total[i] += o.total[k]
+			merge:
+				for _, e := range o.pixels[k] {
+					for m := range c.pixels[i] {
+						if c.pixels[i][m].instance == e.instance && c.pixels[i][m].id == e.id {
+							c.pixels[i][m].weight += e.weight
+							continue merge
+						}
+					}
+					c.pixels[i] = append(c.pixels[i], e)
+				}
+			}
+		}
+	}
+}
+
+// samples taken in all pixels
+func (f *Film) totalSamples() int {
+	total := 0
+	for _, n := range f.samples {
+		total += n
+	}
+	return total
+}
+
+// Pixel returns the mean color of pixel x, y.
+func (f *Film) Pixel(x, y int) Vec3 {
+	return f.mean[y*f.Width+x]
+}
+
+// Variance returns the estimated variance of the mean color of pixel x, y.
+// It is unknown, and reported as +Inf, with less than two samples.
+func (f *Film) Variance(x, y int) Vec3 {
+	i := y*f.Width + x
+	n := float32(f.samples[i])
+	if n < 2 {
+		inf := float32(math.Inf(1))
+		return NewVec3(inf, inf, inf)
+	}
+	return f.m2[i].DivF((n - 1) * n)
+}
+
+// Luminance below which Error measures the absolute error, so that dark
+// pixels do not take all the samples
+const errorFloor = 0.1
+
+// Error returns the standard error of the mean luminance of pixel x, y
+// relative to the luminance, +Inf with less than two samples.
+func (f *Film) Error(x, y int) float32 {
+	variance := luminance(f.Variance(x, y))
+	lum := float32(math.Max(float64(luminance(f.Pixel(x, y))), errorFloor))
+	return float32(math.Sqrt(float64(variance))) / lum
+}
+
+// Beauty returns the mean color of every pixel.
+func (f *Film) Beauty() *HDRImage {
+	img := NewHDRImage(f.Width, f.Height)
+	for y := 0; y < f.Height; y++ {
+		for x := 0; x < f.Width; x++ {
+			img.Set(x, y, f.Pixel(x, y))
+		}
+	}
+	return img
+}
+
+// AOV returns the resolved pass, nil when it was not recorded. Single
+// channel passes have the value in all three components.
+func (f *Film) AOV(a AOV) *HDRImage {
+	layer, ok := f.layers[a]
+	if !ok && a != AOVSampleCount && a != AOVNoise {
+		return nil
+	}
+	img := NewHDRImage(f.Width, f.Height)
+	for i := range img.Pix {
+		var v Vec3
+		switch a {
+		case AOVSampleCount:
+			v.x = float32(f.samples[i])
+		case AOVNoise:
+			v.x = f.Error(i%f.Width, i/f.Width)
+		case AOVDepth, AOVNormal, AOVPosition:
+			if f.hits[i] > 0 {
+				v = layer[i].DivF(float32(f.hits[i]))
+			} else if a == AOVDepth {
+				v.x = float32(math.Inf(1))
+			}
+		case AOVAlbedo:
+			if f.samples[i] > 0 {
+				v = layer[i].DivF(float32(f.samples[i]))
+			}
+		default:
+			v = layer[i]
+			if f.samples[i] == 0 {
+				v.x = -1
+			}
+		}
+		if len(a.channels()) == 1 {
+			v = NewVec3(v.x, v.x, v.x)
+		}
+		img.Pix[i] = v
+	}
+	return img
+}
+
+// Image returns the beauty pass like Write_color(), pixels without samples
+// are left transparent. It is denoised when the film has a Denoiser.
+func (f *Film) Image() *image.RGBA {
+	if f.Denoiser != nil {
+		return ToRGBA(f.Denoiser.Denoise(f))
+	}
+	img := image.NewRGBA(image.Rect(0, 0, f.Width, f.Height))
+	for y := 0; y < f.Height; y++ {
+		for x := 0; x < f.Width; x++ {
+			if n := f.Samples(x, y); n > 0 {
+				img.SetRGBA(x, y, Write_color(f.Pixel(x, y), 1))
+			}
+		}
+	}
+	return img
+}
+
+// EXR channels of an AOV as layer "name"
+func (f *Film) aovChannels(a AOV) []EXRChannel {
+	img := f.AOV(a)
+	names := a.channels()
+	channels := make([]EXRChannel, len(names))
+	for c, name := range names {
+		channels[c] = EXRChannel{a.String() + "." + name, make([]float32, len(img.Pix))}
+		for i, p := range img.Pix {
+			channels[c].Data[i] = p.At(c)
+		}
+	}
+	return channels
+}
+
+// WriteEXR writes a multi-layer OpenEXR file with the beauty pass as R, G
+// and B, every AOV as a layer named after it, ie. "normal.X", and the
+// Cryptomatte layers.
+func (f *Film) WriteEXR(w io.Writer) error {
+	channels := hdrChannels(f.Beauty(), "")
+	for _, a := range f.aovs {
+		channels = append(channels, f.aovChannels(a)...)
+	}
+	var attributes map[string]string
+	if f.Cryptomatte != nil {
+		channels = append(channels, f.Cryptomatte.Channels()...)
+		attributes = f.Cryptomatte.Attributes()
+	}
+	return WriteEXR(w, f.Width, f.Height, channels, attributes)
+}
+
+func (f *Film) SaveEXR(path string) error {
+	return saveFile(path, f.WriteEXR)
+}
+
+// SaveAOVs writes the beauty pass and every AOV into separate OpenEXR
+// files, prefix.exr and prefix.<aov>.exr. The Cryptomatte goes to
+// prefix.<layer>.exr.
+func (f *Film) SaveAOVs(prefix string) error {
+	if err := SaveEXR(prefix+".exr", f.Beauty()); err != nil {
+		return err
+	}
+	for _, a := range f.aovs {
+		channels := f.aovChannels(a)
+		err := saveFile(prefix+"."+a.String()+".exr", func(w io.Writer) error {
+			return WriteEXR(w, f.Width, f.Height, channels, nil)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if c := f.Cryptomatte; c != nil {
+		return saveFile(prefix+"."+c.Layer+".exr", func(w io.Writer) error {
+			return WriteEXR(w, f.Width, f.Height, c.Channels(), c.Attributes())
+		})
+	}
+	return nil
+}
+
+func saveFile(path string, write func(w io.Writer) error) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := write(file); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,200 @@
+package raytrace
+
+import "math"
+
+// Grid is a uniform grid accelerator. Objects are binned into every cell
+// their bounding box overlaps and rays walk the cells front to back with a
+// 3D-DDA (Amanatides & Woo). Works best for many objects of similar size,
+// ie. a field of small spheres.
+type Grid struct {
+	objects  []Hittable
+	box      AABB
+	res      [3]int
+	cellSize Vec3
+	cells    [][]int32 // object indices per cell
+}
+
+// Upper bound for the number of cells along one axis
+const maxGridRes = 128
+
+// NewGrid bins objects into a grid with about density cells per object
+// (0 picks a default). ObjectId reported by Hit() is the index in objects.
+func NewGrid(objects []Hittable, density float32) *Grid {
+	if density <= 0 {
+		density = 4
+	}
+	g := &Grid{objects: objects}
+	if len(objects) == 0 {
+		return g
+	}
+
+	boxes := make([]AABB, len(objects))
+	for i, object := range objects {
+		boxes[i] = NewAABBUninit()
+		object.BBox(&boxes[i])
+		if i == 0 {
+			g.box = boxes[i]
+		} else {
+			g.box = Surrounding_box(g.box, boxes[i])
+		}
+	}
+
+	// Wald et al: cells along each axis proportional to its extent so that
+	// the total is density * N
+	extent := g.box.Max().Subtr(g.box.Min())
+	max_extent := float32(math.Max(float64(extent.x), math.Max(float64(extent.y), float64(extent.z))))
+	volume := float64(extent.x) * float64(extent.y) * float64(extent.z)
+	var cells_per_unit float64
+	if volume > 0 {
+		cells_per_unit = math.Cbrt(float64(density) * float64(len(objects)) / volume)
+	} else {
+		cells_per_unit = math.Cbrt(float64(density)*float64(len(objects))) / float64(max_extent)
+	}
+	for a := 0; a < 3; a++ {
+		n := int(float64(extent.At(a)) * cells_per_unit)
+		if n < 1 {
+			n = 1
+		}
+		if n > maxGridRes {
+			n = maxGridRes
+		}
+		g.res[a] = n
+	}
+	g.cellSize = extent.Div(NewVec3(float32(g.res[0]), float32(g.res[1]), float32(g.res[2])))
+
+	g.cells = make([][]int32, g.res[0]*g.res[1]*g.res[2])
+	for i, box := range boxes {
+		lo := g.cellOf(box.Min())
+		hi := g.cellOf(box.Max())
+		for z := lo[2]; z <= hi[2]; z++ {
+			for y := lo[1]; y <= hi[1]; y++ {
+				for x := lo[0]; x <= hi[0]; x++ {
+					index := g.index(x, y, z)
+					g.cells[index] = append(g.cells[index], int32(i))
+				}
+			}
+		}
+	}
+	return g
+}
+
+// Resolution returns number of cells along each axis.
+func (g *Grid) Resolution() [3]int {
+	return g.res
+}
+
+func (g *Grid) index(x, y, z int) int {
+	return (z*g.res[1]+y)*g.res[0] + x
+}
+
+func (g *Grid) cellOf(p Vec3) [3]int {
+	var cell [3]int
+	for a := 0; a < 3; a++ {
+		c := 0
+		if g.cellSize.At(a) > 0 {
+			c = int((p.At(a) - g.box.Min().At(a)) / g.cellSize.At(a))
+		}
+		if c < 0 {
+			c = 0
+		}
+		if c >= g.res[a] {
+			c = g.res[a] - 1
+		}
+		cell[a] = c
+	}
+	return cell
+}
+
+func (g *Grid) Hit(r *Ray, t_min, t_max float32, rec *HitRecord) bool {
+	return g.traverse(r, t_min, t_max, rec, false)
+}
+
+func (g *Grid) Occluded(r *Ray, t_min, t_max float32) bool {
+	return g.traverse(r, t_min, t_max, nil, true)
+}
+
+// 3D-DDA walk, with any_hit set it stops at the first occluder
+func (g *Grid) traverse(r *Ray, t_min, t_max float32, rec *HitRecord, any_hit bool) bool {
+	if len(g.objects) == 0 {
+		return false
+	}
+	t_enter, t_exit, ok := g.box.clip(r, t_min, t_max)
+	if !ok {
+		return false
+	}
+
+	cell := g.cellOf(r.At(t_enter))
+	var step, out [3]int
+	var t_next, t_delta [3]float32
+	inf := float32(math.Inf(1))
+	for a := 0; a < 3; a++ {
+		d := r.Direction().At(a)
+		o := r.Origin().At(a)
+		lo := g.box.Min().At(a) + float32(cell[a])*g.cellSize.At(a)
+		switch {
+		case d > 0:
+			t_next[a] = (lo + g.cellSize.At(a) - o) / d
+			t_delta[a] = g.cellSize.At(a) / d
+			step[a], out[a] = 1, g.res[a]
+		case d < 0:
+			t_next[a] = (lo - o) / d
+			t_delta[a] = -g.cellSize.At(a) / d
+			step[a], out[a] = -1, -1
+		default:
+			t_next[a], t_delta[a] = inf, inf
+			step[a], out[a] = 0, -1
+		}
+	}
+
+	var temp_rec HitRecord
+	hit_anything := false
+	closest_so_far := t_max
+	for {
+		for _, i := range g.cells[g.index(cell[0], cell[1], cell[2])] {
+			object := g.objects[i]
+			if any_hit {
+				if object.Occluded(r, t_min, t_max) {
+					return true
+				}
+				continue
+			}
+			temp_rec = NewHitRecord()
+			if object.Hit(r, t_min, closest_so_far, &temp_rec) {
+				closest_so_far = temp_rec.T
+				hit_anything = true
+				setObjectId(&temp_rec, object, int(i))
+				*rec = temp_rec
+			}
+		}
+
+		a := 0
+		if t_next[1] < t_next[a] {
+			a = 1
+		}
+		if t_next[2] < t_next[a] {
+			a = 2
+		}
+		// objects span several cells, a hit is final only if it lies
+		// within the current cell
+		if hit_anything && closest_so_far <= t_next[a] {
+			break
+		}
+		if t_next[a] > t_exit {
+			break
+		}
+		cell[a] += step[a]
+		if cell[a] == out[a] {
+			break
+		}
+		t_next[a] += t_delta[a]
+	}
+	return hit_anything
+}
+
+func (g *Grid) BBox(output_box *AABB) bool {
+	if len(g.objects) == 0 {
+		return false
+	}
+	*output_box = g.box
+	return true
+}
@@ -0,0 +1,157 @@
+package raytrace
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+)
+
+// HDRImage is a floating point RGB image, row 0 at the top.
+type HDRImage struct {
+	Width, Height int
+	Pix           []Vec3
+}
+
+func NewHDRImage(width, height int) *HDRImage {
+	return &HDRImage{width, height, make([]Vec3, width*height)}
+}
+
+func (img *HDRImage) At(x, y int) Vec3 {
+	return img.Pix[y*img.Width+x]
+}
+
+func (img *HDRImage) Set(x, y int, c Vec3) {
+	img.Pix[y*img.Width+x] = c
+}
+
+// LoadHDR reads a Radiance .hdr (RGBE) file.
+func LoadHDR(path string) (*HDRImage, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return DecodeHDR(f)
+}
+
+var errHDRFormat = errors.New("hdr: invalid format")
+
+// Largest image accepted by DecodeHDR, a 16384x8192 environment map is
+// 1.5GB of floats
+const maxHDRPixels = 1 << 27
+
+// DecodeHDR reads the Radiance RGBE format: a text header, a resolution
+// line and scanlines which are either flat or new style run length encoded.
+// Only the standard "-Y height +X width" orientation is supported.
+func DecodeHDR(r io.Reader) (*HDRImage, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(magic, "#?") {
+		return nil, errHDRFormat
+	}
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimSpace(line)
+		if line == "" { // end of header
+			break
+		}
+		if strings.HasPrefix(line, "FORMAT=") && line != "FORMAT=32-bit_rle_rgbe" {
+			return nil, fmt.Errorf("hdr: unsupported %s", line)
+		}
+	}
+	res, err := br.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	var width, height int
+	if _, err := fmt.Sscanf(res, "-Y %d +X %d", &height, &width); err != nil {
+		return nil, fmt.Errorf("hdr: unsupported resolution %q", strings.TrimSpace(res))
+	}
+	if width <= 0 || height <= 0 || int64(width)*int64(height) > maxHDRPixels {
+		return nil, errHDRFormat
+	}
+
+	img := NewHDRImage(width, height)
+	scanline := make([]byte, 4*width)
+	for y := 0; y < height; y++ {
+		if err := readHDRScanline(br, scanline, width); err != nil {
+			return nil, err
+		}
+		for x := 0; x < width; x++ {
+			img.Set(x, y, rgbeToVec3(scanline[4*x:4*x+4]))
+		}
+	}
+	return img, nil
+}
+
+// Fills scanline with width RGBE pixels
+func readHDRScanline(br *bufio.Reader, scanline []byte, width int) error {
+	header, err := br.Peek(4)
+	if err != nil {
+		return err
+	}
+	// new RLE scanlines start with 2, 2 and the width
+	if width < 8 || width > 0x7fff || header[0] != 2 || header[1] != 2 || header[2]&0x80 != 0 {
+		_, err := io.ReadFull(br, scanline)
+		return err
+	}
+	if int(header[2])<<8|int(header[3]) != width {
+		return errHDRFormat
+	}
+	br.Discard(4)
+	// each channel is encoded separately
+	for c := 0; c < 4; c++ {
+		for x := 0; x < width; {
+			count, err := br.ReadByte()
+			if err != nil {
+				return err
+			}
+			if count > 128 { // run
+				n := int(count) - 128
+				value, err := br.ReadByte()
+				if err != nil {
+					return err
+				}
+				if x+n > width {
+					return errHDRFormat
+				}
+				for ; n > 0; n-- {
+					scanline[4*x+c] = value
+					x++
+				}
+			} else { // literal
+				n := int(count)
+				if n == 0 || x+n > width {
+					return errHDRFormat
+				}
+				for ; n > 0; n-- {
+					value, err := br.ReadByte()
+					if err != nil {
+						return err
+					}
+					scanline[4*x+c] = value
+					x++
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func rgbeToVec3(rgbe []byte) Vec3 {
+	if rgbe[3] == 0 {
+		return NewVec3(0, 0, 0)
+	}
+	scale := float32(math.Ldexp(1, int(rgbe[3])-(128+8)))
+	return NewVec3(float32(rgbe[0])*scale, float32(rgbe[1])*scale, float32(rgbe[2])*scale)
+}
@@ -24,87 +24,92 @@ func(aabb AABB) Min() Vec3 {
 func(aabb AABB) Max() Vec3 {
 	return aabb.max
 }
-func (aabb AABB) Hit(r *Ray, t_min, t_max float64) bool{
-	for a:=0; a < 3; a++{
-		var t0, t1 float64
-		ray_dir := float64(r.Direction().At(a))
-
-		// Handling division by 0
-		t0_min := float64(aabb.min.At(a) - r.Origin().At(a))
-		t0_max := float64(aabb.max.At(a) - r.Origin().At(a))
-		if ray_dir == 0.0 {
-			if t0_min < 0 {
-				t0_min = math.Inf(-1)
-			} else {
-				t0_min = math.Inf(1)
-			}
-			if t0_max < 0 {
-				t0_max = math.Inf(-1)
-			} else {
-				t0_max = math.Inf(1)
-			}
-			t0 = math.Min( t0_min, t0_max)
-			t1 = math.Max( t0_min, t0_max)
-		} else {
-			t0 = math.Min( t0_min / ray_dir, t0_max / ray_dir)
-			t1 = math.Max( t0_min / ray_dir, t0_max / ray_dir)
-		}
 
-		t_min = math.Max(t0, t_min)
-		t_max = math.Min(t1, t_max)
-		if (t_max <= t_min){
-			return false
-		}
+// Surface area of the box, used by the SAH cost
+func(aabb AABB) Area() float32 {
+	d := aabb.max.Subtr(aabb.min)
+	return 2 * (d.x*d.y + d.y*d.z + d.z*d.x)
+}
+// Rounding of the slab test (3 operations per bound) is covered by growing
+// t_max by 1 + 2*gamma(3), see "Robust BVH Ray Traversal" by Thiago Ize.
+const slabRobustness = 1 + 2*(3*0x1p-24)/(1-3*0x1p-24)
+
+// HitSlab is the ray-box test used by BVH traversal. It uses the inverse
+// direction and sign bits cached by NewRay() so it needs no divisions and
+// no special cases:
+// - zero direction components give +-Inf slabs which never clip the interval
+// - a ray lying in the plane of a face gives 0*Inf = NaN, NaN fails both
+//   comparisons below and leaves the interval untouched
+// Boxes are closed, rays grazing a face or an edge count as hits.
+func (aabb AABB) HitSlab(r *Ray, t_min, t_max float32) bool {
+	bounds := [2]Vec3{aabb.min, aabb.max}
+
+	tx0 := (bounds[r.Sign[0]].x - r.Orig.x) * r.InvDir.x
+	tx1 := (bounds[1-r.Sign[0]].x - r.Orig.x) * r.InvDir.x
+	ty0 := (bounds[r.Sign[1]].y - r.Orig.y) * r.InvDir.y
+	ty1 := (bounds[1-r.Sign[1]].y - r.Orig.y) * r.InvDir.y
+	tz0 := (bounds[r.Sign[2]].z - r.Orig.z) * r.InvDir.z
+	tz1 := (bounds[1-r.Sign[2]].z - r.Orig.z) * r.InvDir.z
+
+	// written so that a NaN operand loses the comparison
+	if tx0 > t_min {
+		t_min = tx0
 	}
-	return true
+	if ty0 > t_min {
+		t_min = ty0
+	}
+	if tz0 > t_min {
+		t_min = tz0
+	}
+	if tx1 < t_max {
+		t_max = tx1
+	}
+	if ty1 < t_max {
+		t_max = ty1
+	}
+	if tz1 < t_max {
+		t_max = tz1
+	}
+	// t_min is +Inf when the origin lies outside a slab of a zero component
+	return t_min <= t_max*slabRobustness && t_min <= math.MaxFloat32
 }
 
+func (aabb AABB) Hit(r *Ray, t_min, t_max float64) bool{
+	return aabb.HitSlab(r, float32(t_min), float32(t_max))
+}
+
+// Kept for compatibility, same as Hit()
 func (aabb AABB) HitOptimized(r Ray, t_min, t_max float64) bool{
-	for a:=0; a < 3; a++{
-		var t0, t1, invD float64
-		ray_dir := float64(r.Direction().At(a))
-
-		// Handling division by 0
-		t0_min := float64(aabb.min.At(a) - r.Origin().At(a))
-		t0_max := float64(aabb.max.At(a) - r.Origin().At(a))
-		if ray_dir == 0.0 {
-			if t0_min < 0 {
-				t0_min = math.Inf(-1)
-			} else {
-				t0_min = math.Inf(1)
-			}
-			if t0_max < 0 {
-				t0_max = math.Inf(-1)
-			} else {
-				t0_max = math.Inf(1)
-			}
-			t0 = math.Min( t0_min, t0_max)
-			t1 = math.Max( t0_min, t0_max)
-		} else {
-			invD = 1.0 / ray_dir
-			t0 = math.Min( t0_min / ray_dir, t0_max / ray_dir) * invD
-			t1 = math.Max( t0_min / ray_dir, t0_max / ray_dir) * invD
-		}
-		if invD < 0.0 {
-			t0,t1 = t1,t0
-		}
+	return aabb.HitSlab(&r, float32(t_min), float32(t_max))
+}
 
+// clip returns the parametric interval of the ray inside the box,
+// used by the grid and k-d tree to start their traversal.
+func (aabb AABB) clip(r *Ray, t_min, t_max float32) (float32, float32, bool) {
+	bounds := [2]Vec3{aabb.min, aabb.max}
+	for a := 0; a < 3; a++ {
+		o := r.Orig.At(a)
+		t0 := (bounds[r.Sign[a]].At(a) - o) * r.InvDir.At(a)
+		t1 := (bounds[1-r.Sign[a]].At(a) - o) * r.InvDir.At(a)
 		if t0 > t_min {
 			t_min = t0
 		}
 		if t1 < t_max {
 			t_max = t1
 		}
-		if (t_max <= t_min){
-			return false
-		}
 	}
-	return true
+	if t_min > t_max*slabRobustness || t_min > math.MaxFloat32 {
+		return 0, 0, false
+	}
+	return t_min, t_max, true
 }
 
 type Hittable interface {
 	Hit(r *Ray, t_min, t_max float32, rec *HitRecord) bool
 	BBox(aabb *AABB) bool
+	// Any hit in [t_min, t_max] - used by shadow and occlusion rays.
+	// Returns as soon as something is found and does not fill a HitRecord.
+	Occluded(r *Ray, t_min, t_max float32) bool
 }
 
 func (rec *HitRecord) set_face_normal(r *Ray, outward_normal * Vec3) {
@@ -117,21 +122,50 @@ func (rec *HitRecord) set_face_normal(r *Ray, outward_normal * Vec3) {
 	}
 }
 
+// set_shading_normal replaces Normal with a perturbed one (normal or bump
+// mapping). The new normal is kept on the side of the geometric one so
+// that Normal still faces the viewer and FrontFace stays valid.
+func (rec *HitRecord) set_shading_normal(n Vec3) {
+	n = n.UnitVec()
+	if n.Dot(rec.Normal) < 0 {
+		n = n.MultF(-1)
+	}
+	rec.Normal = n
+}
+
+// TangentFrame returns an orthonormal basis around Normal with U along
+// Tangent and V on the side of Bitangent. Shapes without UV derivatives
+// get an arbitrary frame.
+func (rec *HitRecord) TangentFrame() ONB {
+	n := rec.Normal
+	t := rec.Tangent.Subtr(n.MultF(n.Dot(rec.Tangent)))
+	if t.LengthSquared() < 1e-12 {
+		return NewONB(n)
+	}
+	t = t.UnitVec()
+	b := t.Cross(n) // n x t
+	if b.Dot(rec.Bitangent) < 0 {
+		b = b.MultF(-1)
+	}
+	return ONB{t, b, n}
+}
+
 
 type HittableList struct {
 	Objects []Hittable
 }
 
 func (hl HittableList) 	Hit(r *Ray, t_min, t_max float32, rec *HitRecord) bool {
-	temp_rec := HitRecord{NewVec3(0,0,0), NewVec3(0,0,0), 1.0, true, -1}
+	var temp_rec HitRecord
 	hit_anything:= false;
-	closest_so_far := float32(math.Inf(1.0))
+	closest_so_far := t_max
 
 	for obj_id, object := range hl.Objects {
-		if object.Hit(r, 0.0, float32(closest_so_far), &temp_rec) {
+		temp_rec = NewHitRecord()
+		if object.Hit(r, t_min, closest_so_far, &temp_rec) {
 			closest_so_far = temp_rec.T
 			hit_anything = true
-			temp_rec.ObjectId = obj_id
+			setObjectId(&temp_rec, object, obj_id)
 			*rec = temp_rec
 		}
 	}
@@ -140,6 +174,15 @@ func (hl HittableList) 	Hit(r *Ray, t_min, t_max float32, rec *HitRecord) bool {
 }
 
 
+func (hl HittableList) Occluded(r *Ray, t_min, t_max float32) bool {
+	for _, object := range hl.Objects {
+		if object.Occluded(r, t_min, t_max) {
+			return true
+		}
+	}
+	return false
+}
+
 func(hl HittableList) BBox(output_box *AABB) bool {
 	// TODO output_box = &NewAABB(NewVec3(r.X0, r.X1, r.K-0.0001), NewVec3(r.Y0,Y1,r,K+0.0001))
 
@@ -155,6 +198,7 @@ func(hl HittableList) BBox(output_box *AABB) bool {
 		}
 		if first_box {
 			*output_box = temp_box
+			first_box = false
 		} else {
 			*output_box = Surrounding_box(*output_box, temp_box)
 		}
@@ -266,25 +310,40 @@ func box_z_compare (a, b Hittable) bool {
 }
                      
 func (bvh BVH_node) Hit(r *Ray, t_min, t_max float32, rec *HitRecord) bool {
-	if !bvh.Box.Hit(r, float64(t_min), float64(t_max)){
+	if !bvh.Box.HitSlab(r, t_min, t_max){
 		return false
 	}
 	// this is still unclear to me, why do we need to dereference the Left or otherwise we get an error:
 	// bvh.Left.Hit undefined (type *Hittable is pointer to interface, not interface)
 	//
 	// I think this is because bvh.Left is still a pointer 
-	hit_left := (bvh.Left).Hit(r, t_min, t_max, rec) 
+
+	// each side gets a fresh record, bare shapes fill in only a part of it
+	temp_rec := NewHitRecord()
+	hit_left := (bvh.Left).Hit(r, t_min, t_max, &temp_rec)
 
 	var tt float32
 	if hit_left{
+		*rec = temp_rec
 		tt = rec.T
 	} else{
 		tt = t_max
 	}
-	hit_right := (bvh.Right).Hit(r, t_min, tt, rec)
+	temp_rec = NewHitRecord()
+	hit_right := (bvh.Right).Hit(r, t_min, tt, &temp_rec)
+	if hit_right {
+		*rec = temp_rec
+	}
 	return hit_left || hit_right
 }
 
+func (bvh BVH_node) Occluded(r *Ray, t_min, t_max float32) bool {
+	if !bvh.Box.HitSlab(r, t_min, t_max){
+		return false
+	}
+	return bvh.Left.Occluded(r, t_min, t_max) || bvh.Right.Occluded(r, t_min, t_max)
+}
+
 func (bvh BVH_node) BBox(output_box *AABB) bool{
 	*output_box = bvh.Box
 	return true
@@ -301,8 +360,38 @@ func (hl *HittableList) Add(object Hittable) {
 type HitRecord struct {
 	P, Normal Vec3 // point and normal
 	T float32
+	U, V float32 // surface coordinates for texturing, in [0,1] for most shapes
+	Tangent, Bitangent Vec3 // dP/du and dP/dv, not normalised (see TangentFrame)
 	FrontFace bool
 	ObjectId int // default -1 : helper to determine which object was hit by a ray
+	InstanceId int // default -1 : set when the hit went through an *Instance
+	Mat Material // nil unless the object is wrapped in a Surface
+	Light Light // set when an area light was hit, used for MIS
+}
+
+func NewHitRecord() HitRecord {
+	return HitRecord{P: NewVec3(0,0,0), Normal: NewVec3(0,0,0), T: 1.0, FrontFace: true, ObjectId: -1, InstanceId: -1}
+}
+
+// Implemented by objects which fill in ObjectId themselves (ie. *Instance
+// reports the primitive within its shared BVH). Containers leave ObjectId
+// of such objects alone instead of overwriting it with their own index.
+type idReporter interface {
+	reportsObjectId() bool
+}
+
+func reportsObjectId(object Hittable) bool {
+	reporter, ok := object.(idReporter)
+	return ok && reporter.reportsObjectId()
+}
+
+// helper for containers: ObjectId of the object stored at index id.
+// Containers test every object with a fresh NewHitRecord(), objects fill
+// in only a part of it (bare shapes leave Mat, Light and InstanceId alone).
+func setObjectId(rec *HitRecord, object Hittable, id int) {
+	if !reportsObjectId(object) {
+		rec.ObjectId = id
+	}
 }
 
 type Sphere struct {
@@ -319,13 +408,53 @@ type Sphere struct {
 // t**2 b dot b + 2t b dot (A-C) + (A-C) dot(A-C) - r**2 = 0
 //      --a---       -----b-----   ------c--------
 func (s Sphere) Hit(r *Ray, t_min, t_max float32, rec *HitRecord) bool {
+	root, ok := s.intersect(r, t_min, t_max)
+	if !ok {
+		return false
+	}
+    rec.T = root;
+    rec.P = r.At(rec.T); // hit point at sphere
+    outward_normal := (rec.P.Subtr(s.Center)).DivF(s.Radius)
+    rec.set_face_normal(r, &outward_normal)
+	rec.U, rec.V = sphereUV(outward_normal)
+	rec.Tangent, rec.Bitangent = sphereTangents(outward_normal, s.Radius)
+	return true;
+}
+
+// dP/du and dP/dv of the parameterisation in sphereUV(), n is the unit
+// outward normal. Degenerate (zero) at the poles.
+func sphereTangents(n Vec3, radius float32) (dpdu, dpdv Vec3) {
+	dpdu = NewVec3(n.z, 0, -n.x).MultF(2 * math.Pi * radius)
+	sin_theta := float32(math.Sqrt(float64(n.x*n.x + n.z*n.z)))
+	if sin_theta == 0 {
+		return dpdu, NewVec3(0, 0, 0)
+	}
+	dpdv = NewVec3(-n.x*n.y/sin_theta, sin_theta, -n.y*n.z/sin_theta).MultF(math.Pi * radius)
+	return dpdu, dpdv
+}
+
+// Texture coordinates of a point on the unit sphere: u goes around the Y
+// axis starting at -X, v from the bottom (-Y) to the top.
+func sphereUV(p Vec3) (u, v float32) {
+	theta := math.Acos(math.Max(-1, math.Min(1, float64(-p.y))))
+	phi := math.Atan2(float64(-p.z), float64(p.x)) + math.Pi
+	return float32(phi / (2 * math.Pi)), float32(theta / math.Pi)
+}
+
+func (s Sphere) Occluded(r *Ray, t_min, t_max float32) bool {
+	_, ok := s.intersect(r, t_min, t_max)
+	return ok
+}
+
+// nearest root of the quadratic equation in [t_min, t_max]
+func (s Sphere) intersect(r *Ray, t_min, t_max float32) (float32, bool) {
 	oc := r.Origin().Subtr(s.Center)
 	a := r.Direction().Dot(r.Direction())  // square of length of the vector
 	half_b := oc.Dot(r.Direction())
 	c := oc.Dot(oc) - (s.Radius * s.Radius)
 	discriminant := float64(half_b * half_b - a*c) // finding roots
 	if discriminant < 0{
-		return false
+		return 0, false
 	}
     // Find the nearest root that lies in the acceptable range.
 	sqrtd := float32(math.Sqrt(discriminant))
@@ -333,14 +462,10 @@ func (s Sphere) Hit(r *Ray, t_min, t_max float32, rec *HitRecord) bool {
 	if (root < t_min || t_max < root) {
         root = (-half_b + sqrtd) / a
         if (root < t_min || t_max < root) {
-            return false
+            return 0, false
 		}
     }
-    rec.T = root;
-    rec.P = r.At(rec.T); // hit point at sphere
-    outward_normal := (rec.P.Subtr(s.Center)).DivF(s.Radius)
-    rec.set_face_normal(r, &outward_normal)
-	return true;
+	return root, true
 }
 
 func (s Sphere) BBox(out_aabb *AABB) bool  {
@@ -357,47 +482,64 @@ type Cylinder struct {
 	Height float32
 }
 
+// Hit tests the open tube aligned with the Y axis, there are no caps.
 func (cyl Cylinder) Hit(r *Ray, t_min, t_max float32, rec *HitRecord) bool {
-
-	cylinder_pos := cyl.Center // NewVec3(0,0,-1)
-	cylinder_rot := NewVec3(0,1,0)
-	ray := Ray{Orig: r.Orig}
-	ray.Dir = r.Direction().Cross(cylinder_rot)
-	co := ray.Orig.Subtr(cylinder_pos)
-	a := ray.Dir.Dot(ray.Dir)
-	b := 2 * ray.Dir.Dot( co.Cross(cylinder_rot) )
-	c := co.Cross(cylinder_rot).Dot( co.Cross(cylinder_rot) ) - cyl.Radius * cyl.Radius
-	d := b * b - 4 * c * a
-	if d < 0{
+	t, ok := cyl.intersect(r, t_min, t_max)
+	if !ok {
 		return false
 	}
+	rec.T = t
+	rec.P = r.At(t)
+	outward_normal := NewVec3(rec.P.x-cyl.Center.x, 0, rec.P.z-cyl.Center.z).DivF(cyl.Radius)
+	rec.set_face_normal(r, &outward_normal)
+	// u around the axis like on a sphere, v along the height
+	rec.U, _ = sphereUV(outward_normal)
+	rec.V = (rec.P.y - (cyl.Center.y - cyl.Height/2)) / cyl.Height
+	rec.Tangent, _ = sphereTangents(outward_normal, cyl.Radius)
+	rec.Bitangent = NewVec3(0, cyl.Height, 0)
+	return true
+}
 
-	t1 := ( float64(-b) - math.Sqrt(float64(d)) /  (2*float64(a))) 
-	t2 := ( float64(-b) + math.Sqrt(float64(d)) /  (2*float64(a))) 
-
-	if t2 < 0{
-		return false
+// nearest root of the infinite cylinder in [t_min, t_max] within the height
+func (cyl Cylinder) intersect(r *Ray, t_min, t_max float32) (float32, bool) {
+	ox := float64(r.Origin().x - cyl.Center.x)
+	oz := float64(r.Origin().z - cyl.Center.z)
+	dx := float64(r.Direction().x)
+	dz := float64(r.Direction().z)
+	a := dx*dx + dz*dz
+	if a == 0 { // parallel to the axis
+		return 0, false
 	}
-
-	var t float64
-	if t1 > 0 {
-		t = t1
-	} else {
-		t = t2
+	half_b := ox*dx + oz*dz
+	c := ox*ox + oz*oz - float64(cyl.Radius*cyl.Radius)
+	discriminant := half_b*half_b - a*c
+	if discriminant < 0 {
+		return 0, false
 	}
-
-	// at this point we have infinite height - need to cut at hight
-	v := r.Origin().At(1) + float32(t) * r.Direction().At(1)
-	if ((v > cylinder_pos.At(1) - cyl.Height/2.0) && v <= cylinder_pos.At(1) + cyl.Height/2.0){
-		return true
-	} else {
-		return false
+	sqrtd := math.Sqrt(discriminant)
+	for _, root := range [2]float64{(-half_b - sqrtd) / a, (-half_b + sqrtd) / a} {
+		t := float32(root)
+		if t < t_min || t > t_max {
+			continue
+		}
+		y := r.Origin().y + t*r.Direction().y - cyl.Center.y
+		if y >= -cyl.Height/2 && y <= cyl.Height/2 {
+			return t, true
+		}
 	}
-	
+	return 0, false
+}
+
+func (cyl Cylinder) Occluded(r *Ray, t_min, t_max float32) bool {
+	_, ok := cyl.intersect(r, t_min, t_max)
+	return ok
 }
 
 func (c Cylinder) BBox(out_aabb *AABB) bool {
-	return true // TODO: for now always return true
+	// the cylinder is aligned with the Y axis (see cylinder_rot in Hit())
+	half := NewVec3(c.Radius, c.Height/2.0, c.Radius)
+	*out_aabb = NewAABB(c.Center.Subtr(half), c.Center.Add(half))
+	return true
 }
 
 type XYRect struct{
@@ -410,3 +552,235 @@ func(r XYRect) BBox(output_box *AABB) bool {
 }
 
 
+
+type Triangle struct {
+	A, B, C Vec3
+}
+
+func (tri Triangle) Hit(r *Ray, t_min, t_max float32, rec *HitRecord) bool {
+	t, b1, b2, ok := tri.intersect(r, t_min, t_max)
+	if !ok {
+		return false
+	}
+	tri.fill(r, t, rec)
+	// barycentric coordinates, same as UVs (0,0), (1,0), (0,1) at A, B, C
+	rec.U, rec.V = b1, b2
+	rec.Tangent, rec.Bitangent = tri.B.Subtr(tri.A), tri.C.Subtr(tri.A)
+	return true
+}
+
+func (tri Triangle) fill(r *Ray, t float32, rec *HitRecord) {
+	rec.T = t
+	rec.P = r.At(t)
+	e1 := tri.B.Subtr(tri.A)
+	e2 := tri.C.Subtr(tri.A)
+	outward_normal := e2.Cross(e1).UnitVec() // e1 x e2, counter-clockwise winding faces the viewer
+	rec.set_face_normal(r, &outward_normal)
+}
+
+func (tri Triangle) Occluded(r *Ray, t_min, t_max float32) bool {
+	_, _, _, ok := tri.intersect(r, t_min, t_max)
+	return ok
+}
+
+// Moller-Trumbore intersection, also returns the barycentric coordinates
+// of the hit along B-A and C-A.
+// NOTE: a.Cross(b) returns b x a (see Vec3.Cross)
+func (tri Triangle) intersect(r *Ray, t_min, t_max float32) (t, b1, b2 float32, ok bool) {
+	e1 := tri.B.Subtr(tri.A)
+	e2 := tri.C.Subtr(tri.A)
+	pvec := e2.Cross(r.Direction()) // dir x e2
+	det := e1.Dot(pvec)
+	if det == 0 { // ray parallel to the triangle
+		return 0, 0, 0, false
+	}
+	inv_det := 1 / det
+	tvec := r.Origin().Subtr(tri.A)
+	u := tvec.Dot(pvec) * inv_det
+	if u < 0 || u > 1 {
+		return 0, 0, 0, false
+	}
+	qvec := e1.Cross(tvec) // tvec x e1
+	v := r.Direction().Dot(qvec) * inv_det
+	if v < 0 || u+v > 1 {
+		return 0, 0, 0, false
+	}
+	t = e2.Dot(qvec) * inv_det
+	if t < t_min || t > t_max {
+		return 0, 0, 0, false
+	}
+	return t, u, v, true
+}
+
+func (tri Triangle) BBox(out_aabb *AABB) bool {
+	box := Surrounding_box(NewAABB(tri.A, tri.A), NewAABB(tri.B, tri.B))
+	box = Surrounding_box(box, NewAABB(tri.C, tri.C))
+	// pad flat boxes, otherwise axis aligned triangles could be culled
+	pad := NewVec3(0, 0, 0)
+	for a := 0; a < 3; a++ {
+		if box.Max().At(a)-box.Min().At(a) < 0.0001 {
+			pad = withAxis(pad, a, 0.0001)
+		}
+	}
+	*out_aabb = NewAABB(box.Min().Subtr(pad), box.Max().Add(pad))
+	return true
+}
+
+// copy of v with one component replaced
+func withAxis(v Vec3, axis int, value float32) Vec3 {
+	switch axis {
+	case 0:
+		v.x = value
+	case 1:
+		v.y = value
+	default:
+		v.z = value
+	}
+	return v
+}
+
+// NewMesh creates triangles from a vertex list and triplets of indices.
+// The returned slice is typically turned into a shared BLAS with
+// NewDynamicBVH(), in which case ObjectId reports the triangle index.
+func NewMesh(vertices []Vec3, indices []int) []Hittable {
+	triangles := make([]Hittable, 0, len(indices)/3)
+	for i := 0; i+2 < len(indices); i += 3 {
+		triangles = append(triangles,
+			Triangle{vertices[indices[i]], vertices[indices[i+1]], vertices[indices[i+2]]})
+	}
+	return triangles
+}
+
+// UVTriangle is a Triangle with texture coordinates at its vertices.
+type UVTriangle struct {
+	Triangle
+	UV [3][2]float32 // (u, v) at A, B, C
+}
+
+func (tri UVTriangle) Hit(r *Ray, t_min, t_max float32, rec *HitRecord) bool {
+	t, b1, b2, ok := tri.intersect(r, t_min, t_max)
+	if !ok {
+		return false
+	}
+	tri.fill(r, t, rec)
+	b0 := 1 - b1 - b2
+	rec.U = b0*tri.UV[0][0] + b1*tri.UV[1][0] + b2*tri.UV[2][0]
+	rec.V = b0*tri.UV[0][1] + b1*tri.UV[1][1] + b2*tri.UV[2][1]
+	rec.Tangent, rec.Bitangent = tri.tangents()
+	return true
+}
+
+// dP/du and dP/dv from the edges and their UV deltas (constant over the
+// triangle). Degenerate UVs fall back to the edges.
+func (tri UVTriangle) tangents() (dpdu, dpdv Vec3) {
+	e1 := tri.B.Subtr(tri.A)
+	e2 := tri.C.Subtr(tri.A)
+	du1, dv1 := tri.UV[1][0]-tri.UV[0][0], tri.UV[1][1]-tri.UV[0][1]
+	du2, dv2 := tri.UV[2][0]-tri.UV[0][0], tri.UV[2][1]-tri.UV[0][1]
+	det := du1*dv2 - dv1*du2
+	if det == 0 {
+		return e1, e2
+	}
+	inv_det := 1 / det
+	dpdu = e1.MultF(dv2).Subtr(e2.MultF(dv1)).MultF(inv_det)
+	dpdv = e2.MultF(du1).Subtr(e1.MultF(du2)).MultF(inv_det)
+	return dpdu, dpdv
+}
+
+// NewMeshUV is NewMesh with per vertex texture coordinates, uvs is indexed
+// like vertices.
+func NewMeshUV(vertices []Vec3, uvs [][2]float32, indices []int) []Hittable {
+	triangles := make([]Hittable, 0, len(indices)/3)
+	for i := 0; i+2 < len(indices); i += 3 {
+		a, b, c := indices[i], indices[i+1], indices[i+2]
+		triangles = append(triangles, UVTriangle{
+			Triangle{vertices[a], vertices[b], vertices[c]},
+			[3][2]float32{uvs[a], uvs[b], uvs[c]}})
+	}
+	return triangles
+}
+
+// Quad is a parallelogram spanned by two edges from a corner. The normal
+// Edge1 x Edge2 is the front side.
+type Quad struct {
+	Corner, Edge1, Edge2 Vec3
+}
+
+func (q Quad) normal() Vec3 {
+	return q.Edge2.Cross(q.Edge1) // Edge1 x Edge2
+}
+
+func (q Quad) Area() float32 {
+	return q.normal().Length()
+}
+
+// intersection with the plane, alpha/beta are the coordinates along the edges
+func (q Quad) intersect(r *Ray, t_min, t_max float32) (t, alpha, beta float32, ok bool) {
+	n := q.normal()
+	denom := n.Dot(r.Direction())
+	if denom == 0 {
+		return 0, 0, 0, false
+	}
+	t = n.Dot(q.Corner.Subtr(r.Origin())) / denom
+	if t < t_min || t > t_max {
+		return 0, 0, 0, false
+	}
+	// w = n / (n.n) gives the planar coordinates with two dot products
+	w := n.DivF(n.Dot(n))
+	p := r.At(t).Subtr(q.Corner)
+	alpha = w.Dot(q.Edge2.Cross(p)) // p x Edge2
+	beta = w.Dot(p.Cross(q.Edge1))  // Edge1 x p
+	if alpha < 0 || alpha > 1 || beta < 0 || beta > 1 {
+		return 0, 0, 0, false
+	}
+	return t, alpha, beta, true
+}
+
+func (q Quad) Hit(r *Ray, t_min, t_max float32, rec *HitRecord) bool {
+	t, alpha, beta, ok := q.intersect(r, t_min, t_max)
+	if !ok {
+		return false
+	}
+	rec.T = t
+	rec.P = r.At(t)
+	outward_normal := q.normal().UnitVec()
+	rec.set_face_normal(r, &outward_normal)
+	rec.U, rec.V = alpha, beta
+	rec.Tangent, rec.Bitangent = q.Edge1, q.Edge2
+	return true
+}
+
+func (q Quad) Occluded(r *Ray, t_min, t_max float32) bool {
+	_, _, _, ok := q.intersect(r, t_min, t_max)
+	return ok
+}
+
+func (q Quad) BBox(out_aabb *AABB) bool {
+	far := q.Corner.Add(q.Edge1).Add(q.Edge2)
+	box := Surrounding_box(NewAABB(q.Corner, q.Corner), NewAABB(far, far))
+	for _, p := range []Vec3{q.Corner.Add(q.Edge1), q.Corner.Add(q.Edge2)} {
+		box = Surrounding_box(box, NewAABB(p, p))
+	}
+	pad := NewVec3(0, 0, 0)
+	for a := 0; a < 3; a++ {
+		if box.Max().At(a)-box.Min().At(a) < 0.0001 {
+			pad = withAxis(pad, a, 0.0001)
+		}
+	}
+	*out_aabb = NewAABB(box.Min().Subtr(pad), box.Max().Add(pad))
+	return true
+}
+
+// NewBox returns the six quads of an axis aligned box, normals facing out.
+func NewBox(min, max Vec3) []Hittable {
+	d := max.Subtr(min)
+	dx, dy, dz := NewVec3(d.x, 0, 0), NewVec3(0, d.y, 0), NewVec3(0, 0, d.z)
+	return []Hittable{
+		Quad{NewVec3(min.x, min.y, max.z), dx, dy},           // front  +z
+		Quad{NewVec3(max.x, min.y, min.z), dx.MultF(-1), dy}, // back   -z
+		Quad{NewVec3(max.x, min.y, max.z), dz.MultF(-1), dy}, // right  +x
+		Quad{NewVec3(min.x, min.y, min.z), dz, dy},           // left   -x
+		Quad{NewVec3(min.x, max.y, max.z), dx, dz.MultF(-1)}, // top    +y
+		Quad{NewVec3(min.x, min.y, min.z), dx, dz},           // bottom -y
+	}
+}
@@ -0,0 +1,66 @@
+package raytrace
+
+// Two-level acceleration structure.
+//
+// A bottom-level structure (BLAS) is any Hittable built in object space,
+// usually a DynamicBVH over the triangles of a mesh. An Instance places a
+// BLAS in the world with a Transform, so the same triangles can be shared by
+// many instances. The top-level structure (TLAS) is a BVH over instances.
+//
+// A hit through an instance reports the primitive within the BLAS in
+// HitRecord.ObjectId and the instance in HitRecord.InstanceId.
+
+type Instance struct {
+	Blas  Hittable
+	Xform Transform // object to world
+	Id    int
+}
+
+func NewInstance(blas Hittable, xform Transform, id int) *Instance {
+	return &Instance{blas, xform, id}
+}
+
+func (inst *Instance) Hit(r *Ray, t_min, t_max float32, rec *HitRecord) bool {
+	// the direction is not normalised so t is the same in both spaces
+	local := inst.Xform.Inverse().Ray(r)
+	if !inst.Blas.Hit(&local, t_min, t_max, rec) {
+		return false
+	}
+	rec.P = r.At(rec.T)
+	// inverse transpose preserves the sign of dot(normal, direction)
+	// so FrontFace computed in object space is still valid
+	rec.Normal = inst.Xform.Normal(rec.Normal).UnitVec()
+	rec.Tangent = inst.Xform.Vector(rec.Tangent)
+	rec.Bitangent = inst.Xform.Vector(rec.Bitangent)
+	rec.InstanceId = inst.Id
+	rec.Light = nil // lights are sampled in world space, not through instances
+	return true
+}
+
+func (inst *Instance) Occluded(r *Ray, t_min, t_max float32) bool {
+	local := inst.Xform.Inverse().Ray(r)
+	return inst.Blas.Occluded(&local, t_min, t_max)
+}
+
+func (inst *Instance) BBox(output_box *AABB) bool {
+	box := NewAABBUninit()
+	if !inst.Blas.BBox(&box) {
+		return false
+	}
+	*output_box = inst.Xform.BBox(box)
+	return true
+}
+
+// ObjectId comes from the BLAS, containers should not overwrite it.
+func (inst *Instance) reportsObjectId() bool { return true }
+
+// NewTLAS builds the top-level BVH over instances. Instances can be moved
+// later by changing Xform and calling Update() with the instance's handle
+// (its index in the slice).
+func NewTLAS(instances []*Instance) *DynamicBVH {
+	objects := make([]Hittable, len(instances))
+	for i, inst := range instances {
+		objects[i] = inst
+	}
+	return NewDynamicBVH(objects)
+}
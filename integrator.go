@@ -0,0 +1,220 @@
+package raytrace
+
+import (
+	"math"
+	"math/rand"
+)
+
+// Offset for secondary rays, avoids self intersections ("shadow acne")
+const rayEpsilon = 0.001
+
+// RayColorAO renders ambient occlusion: the fraction of cosine weighted
+// directions above the hit point which are not blocked within distance.
+// Uses Occluded() so no HitRecord is filled for the occlusion rays.
+func RayColorAO(r *Ray, world Hittable, samples int, distance float32, rng *rand.Rand) Vec3 {
+	rec := NewHitRecord()
+	if !world.Hit(r, 0, float32(math.Inf(1.0)), &rec) {
+		return NewVec3(1, 1, 1)
+	}
+	onb := NewONB(rec.Normal)
+	visible := 0
+	for s := 0; s < samples; s++ {
+		dir := onb.Local(RandomCosineDirection(randFloat(rng), randFloat(rng)))
+		ao_ray := NewRay(rec.P, dir)
+		if !world.Occluded(&ao_ray, rayEpsilon, distance) {
+			visible++
+		}
+	}
+	ao := float32(visible) / float32(samples)
+	return NewVec3(ao, ao, ao)
+}
+
+// RayColorPath is a path tracer. Emission is picked up when a path hits an
+// emissive surface, so area lights are found by chance only. Delta lights
+// (point, spot, directional) can never be hit and are sampled directly at
+// every bounce.
+func RayColorPath(r *Ray, scene *Scene, rng *rand.Rand) Vec3 {
+	radiance := NewVec3(0, 0, 0)
+	throughput := NewVec3(1, 1, 1)
+	ray := *r
+	for depth := 0; depth < scene.maxDepth(); depth++ {
+		rec := NewHitRecord()
+		if !scene.intersect(&ray, &rec, rng) {
+			radiance = radiance.Add(throughput.Mult(scene.background(ray.Direction())))
+			break
+		}
+		mat := rec.Mat
+		if mat == nil {
+			mat = defaultMaterial
+		}
+		wo := ray.Direction().UnitVec().MultF(-1)
+		radiance = radiance.Add(throughput.Mult(mat.Emitted(&rec, wo)))
+
+		for _, light := range scene.Lights {
+			if light.IsDelta() {
+				radiance = radiance.Add(throughput.Mult(directLight(scene, light, &rec, mat, wo, rng)))
+			}
+		}
+
+		bs, ok := mat.Sample(&rec, wo, rng)
+		if !ok || bs.Pdf == 0 {
+			break
+		}
+		throughput = throughput.Mult(bs.F.DivF(bs.Pdf))
+		ray = NewRay(rec.P, bs.Wi)
+
+		if depth >= 3 && russianRoulette(&throughput, rng) {
+			break
+		}
+	}
+	return radiance
+}
+
+// unshadowed contribution of one light sample, f * Li / pdf
+func directLight(scene *Scene, light Light, rec *HitRecord, mat Material, wo Vec3, rng *rand.Rand) Vec3 {
+	ls, ok := light.Sample(rec.P, rng)
+	if !ok || ls.Pdf == 0 {
+		return NewVec3(0, 0, 0)
+	}
+	f := mat.Eval(rec, wo, ls.Wi)
+	if f.LengthSquared() == 0 {
+		return NewVec3(0, 0, 0)
+	}
+	shadow := NewRay(rec.P, ls.Wi)
+	if scene.World.Occluded(&shadow, rayEpsilon, ls.Dist*(1-rayEpsilon)) {
+		return NewVec3(0, 0, 0)
+	}
+	return f.Mult(ls.Li).MultF(scene.transmittance(ls.Dist) / ls.Pdf)
+}
+
+// Terminates low contribution paths, reweighting the survivors.
+// Returns true when the path should stop.
+func russianRoulette(throughput *Vec3, rng *rand.Rand) bool {
+	q := throughput.At(0)
+	if throughput.At(1) > q {
+		q = throughput.At(1)
+	}
+	if throughput.At(2) > q {
+		q = throughput.At(2)
+	}
+	if q > 0.95 {
+		q = 0.95
+	}
+	if randFloat(rng) >= q {
+		return true
+	}
+	*throughput = throughput.DivF(q)
+	return false
+}
+
+// RayColorNEE is a path tracer with next-event estimation: at every bounce
+// one light is picked and sampled directly, and paths which hit an area
+// light by BSDF sampling are also kept. Both estimates are combined with
+// multiple importance sampling (power heuristic), so small lights converge
+// quickly and large lights seen through glossy reflections don't get
+// fireflies.
+func RayColorNEE(r *Ray, scene *Scene, rng *rand.Rand) Vec3 {
+	radiance := NewVec3(0, 0, 0)
+	throughput := NewVec3(1, 1, 1)
+	ray := *r
+	specular_bounce := true // camera rays see emission directly
+	var bsdf_pdf float32
+	var prev_p Vec3
+	n_lights := float32(len(scene.Lights))
+	env_light := scene.backgroundLight()
+
+	for depth := 0; depth < scene.maxDepth(); depth++ {
+		rec := NewHitRecord()
+		if !scene.intersect(&ray, &rec, rng) {
+			dir := ray.Direction().UnitVec()
+			env := scene.background(dir)
+			if env_light != nil && !specular_bounce {
+				w := powerHeuristic(bsdf_pdf, env_light.Pdf(prev_p, dir)/n_lights)
+				env = env.MultF(w)
+			}
+			radiance = radiance.Add(throughput.Mult(env))
+			break
+		}
+		mat := rec.Mat
+		if mat == nil {
+			mat = defaultMaterial
+		}
+		wo := ray.Direction().UnitVec().MultF(-1)
+
+		// emission found by BSDF sampling, weighted only when light
+		// sampling could have found it too
+		emitted := mat.Emitted(&rec, wo)
+		if emitted.LengthSquared() > 0 {
+			if specular_bounce || rec.Light == nil || !scene.hasLight(rec.Light) {
+				radiance = radiance.Add(throughput.Mult(emitted))
+			} else {
+				light_pdf := rec.Light.Pdf(prev_p, ray.Direction().UnitVec()) / n_lights
+				w := powerHeuristic(bsdf_pdf, light_pdf)
+				radiance = radiance.Add(throughput.Mult(emitted).MultF(w))
+			}
+		}
+
+		// emission found by light sampling, skipped at the last vertex so
+		// paths are as long as in RayColorPath
+		if n_lights > 0 && depth < scene.maxDepth()-1 {
+			pick := int(randFloat(rng) * n_lights)
+			if pick == len(scene.Lights) {
+				pick--
+			}
+			light := scene.Lights[pick]
+			radiance = radiance.Add(throughput.Mult(sampleLightMIS(scene, light, &rec, mat, wo, rng)).MultF(n_lights))
+		}
+
+		bs, ok := mat.Sample(&rec, wo, rng)
+		if !ok || bs.Pdf == 0 {
+			break
+		}
+		throughput = throughput.Mult(bs.F.DivF(bs.Pdf))
+		specular_bounce = bs.Specular
+		bsdf_pdf = bs.Pdf
+		prev_p = rec.P
+		ray = NewRay(rec.P, bs.Wi)
+
+		if depth >= 3 && russianRoulette(&throughput, rng) {
+			break
+		}
+	}
+	return radiance
+}
+
+// Light sample weighted against the BSDF strategy. The caller multiplies by
+// the number of lights, so the light pdf used for the weight includes the
+// probability of picking this light.
+func sampleLightMIS(scene *Scene, light Light, rec *HitRecord, mat Material, wo Vec3, rng *rand.Rand) Vec3 {
+	if light.IsDelta() {
+		return directLight(scene, light, rec, mat, wo, rng)
+	}
+	ls, ok := light.Sample(rec.P, rng)
+	if !ok || ls.Pdf == 0 {
+		return NewVec3(0, 0, 0)
+	}
+	f := mat.Eval(rec, wo, ls.Wi)
+	if f.LengthSquared() == 0 {
+		return NewVec3(0, 0, 0)
+	}
+	shadow := NewRay(rec.P, ls.Wi)
+	if scene.World.Occluded(&shadow, rayEpsilon, ls.Dist*(1-rayEpsilon)) {
+		return NewVec3(0, 0, 0)
+	}
+	n_lights := float32(len(scene.Lights))
+	w := powerHeuristic(ls.Pdf/n_lights, mat.Pdf(rec, wo, ls.Wi))
+	return f.Mult(ls.Li).MultF(w * scene.transmittance(ls.Dist) / ls.Pdf)
+}
+
+// Veach's power heuristic with beta = 2, weight of the strategy with pdf a
+func powerHeuristic(a, b float32) float32 {
+	a2 := a * a
+	b2 := b * b
+	if a2+b2 == 0 {
+		return 0
+	}
+	if math.IsInf(float64(a2), 1) {
+		return 1
+	}
+	return a2 / (a2 + b2)
+}
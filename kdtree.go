@@ -0,0 +1,250 @@
+package raytrace
+
+import (
+	"math"
+	"sort"
+)
+
+// KdTree is a k-d tree built with the surface area heuristic, following the
+// layout described in PBRT: nodes live in a flat slice, the first child of an
+// interior node is the next node and only the second child is stored.
+type KdTree struct {
+	objects []Hittable
+	boxes   []AABB
+	box     AABB
+	nodes   []kdNode
+	indices []int32 // object indices referenced by leaves
+}
+
+// SAH parameters for the k-d tree build
+const (
+	kdTraversalCost    = 1.0
+	kdIntersectionCost = 80.0
+	kdEmptyBonus       = 0.5
+	kdMaxPrims         = 2
+)
+
+type kdNode struct {
+	Axis         int // 0,1,2 for interior nodes, 3 for leaves
+	Split        float32
+	Above        int // second child of interior nodes
+	Start, Count int // range in indices for leaves
+}
+
+func (n *kdNode) isLeaf() bool {
+	return n.Axis == 3
+}
+
+type kdEdge struct {
+	T     float32
+	Prim  int32
+	Start bool
+}
+
+// NewKdTree builds the tree over objects. ObjectId reported by Hit() is the
+// index in objects.
+func NewKdTree(objects []Hittable) *KdTree {
+	kd := &KdTree{objects: objects}
+	if len(objects) == 0 {
+		return kd
+	}
+	kd.boxes = make([]AABB, len(objects))
+	prims := make([]int32, len(objects))
+	for i, object := range objects {
+		kd.boxes[i] = NewAABBUninit()
+		object.BBox(&kd.boxes[i])
+		if i == 0 {
+			kd.box = kd.boxes[i]
+		} else {
+			kd.box = Surrounding_box(kd.box, kd.boxes[i])
+		}
+		prims[i] = int32(i)
+	}
+	max_depth := int(8 + 1.3*math.Log2(float64(len(objects))))
+	kd.build(kd.box, prims, max_depth, 0)
+	return kd
+}
+
+func (kd *KdTree) makeLeaf(prims []int32) {
+	kd.nodes = append(kd.nodes, kdNode{Axis: 3, Start: len(kd.indices), Count: len(prims)})
+	kd.indices = append(kd.indices, prims...)
+}
+
+func (kd *KdTree) build(box AABB, prims []int32, depth, bad_refines int) {
+	if len(prims) <= kdMaxPrims || depth == 0 || box.Area() <= 0 {
+		kd.makeLeaf(prims)
+		return
+	}
+
+	// find the cheapest split along any axis
+	best_axis, best_split := -1, float32(0)
+	best_cost := math.Inf(1)
+	leaf_cost := kdIntersectionCost * float64(len(prims))
+	total_area := float64(box.Area())
+	extent := box.Max().Subtr(box.Min())
+	edges := make([]kdEdge, 0, 2*len(prims))
+	for axis := 0; axis < 3; axis++ {
+		edges = edges[:0]
+		for _, p := range prims {
+			edges = append(edges,
+				kdEdge{kd.boxes[p].Min().At(axis), p, true},
+				kdEdge{kd.boxes[p].Max().At(axis), p, false})
+		}
+		sort.Slice(edges, func(i, j int) bool {
+			if edges[i].T == edges[j].T {
+				return edges[i].Start && !edges[j].Start
+			}
+			return edges[i].T < edges[j].T
+		})
+
+		n_below, n_above := 0, len(prims)
+		o1, o2 := (axis+1)%3, (axis+2)%3
+		for _, e := range edges {
+			if !e.Start {
+				n_above--
+			}
+			if e.T > box.Min().At(axis) && e.T < box.Max().At(axis) {
+				below := extent.At(axis) - (box.Max().At(axis) - e.T)
+				above := box.Max().At(axis) - e.T
+				// areas of the two child boxes
+				area_below := 2 * float64(extent.At(o1)*extent.At(o2)+below*(extent.At(o1)+extent.At(o2)))
+				area_above := 2 * float64(extent.At(o1)*extent.At(o2)+above*(extent.At(o1)+extent.At(o2)))
+				p_below := area_below / total_area
+				p_above := area_above / total_area
+				bonus := 0.0
+				if n_below == 0 || n_above == 0 {
+					bonus = kdEmptyBonus
+				}
+				cost := kdTraversalCost + kdIntersectionCost*(1-bonus)*(p_below*float64(n_below)+p_above*float64(n_above))
+				if cost < best_cost {
+					best_cost, best_axis, best_split = cost, axis, e.T
+				}
+			}
+			if e.Start {
+				n_below++
+			}
+		}
+	}
+
+	if best_cost > leaf_cost {
+		bad_refines++
+	}
+	if best_axis == -1 || (best_cost > 4*leaf_cost && len(prims) < 16) || bad_refines == 3 {
+		kd.makeLeaf(prims)
+		return
+	}
+
+	var below, above []int32
+	for _, p := range prims {
+		// objects flat at the split plane go below
+		if kd.boxes[p].Min().At(best_axis) < best_split || kd.boxes[p].Max().At(best_axis) <= best_split {
+			below = append(below, p)
+		}
+		if kd.boxes[p].Max().At(best_axis) > best_split {
+			above = append(above, p)
+		}
+	}
+
+	node := len(kd.nodes)
+	kd.nodes = append(kd.nodes, kdNode{Axis: best_axis, Split: best_split})
+	box_below := NewAABB(box.Min(), withAxis(box.Max(), best_axis, best_split))
+	box_above := NewAABB(withAxis(box.Min(), best_axis, best_split), box.Max())
+	kd.build(box_below, below, depth-1, bad_refines)
+	kd.nodes[node].Above = len(kd.nodes)
+	kd.build(box_above, above, depth-1, bad_refines)
+}
+
+type kdTodo struct {
+	node         int
+	t_min, t_max float32
+}
+
+func (kd *KdTree) Hit(r *Ray, t_min, t_max float32, rec *HitRecord) bool {
+	return kd.traverse(r, t_min, t_max, rec, false)
+}
+
+func (kd *KdTree) Occluded(r *Ray, t_min, t_max float32) bool {
+	return kd.traverse(r, t_min, t_max, nil, true)
+}
+
+// front to back traversal, with any_hit set it stops at the first occluder
+func (kd *KdTree) traverse(r *Ray, t_min, t_max float32, rec *HitRecord, any_hit bool) bool {
+	if len(kd.nodes) == 0 {
+		return false
+	}
+	t_near, t_far, ok := kd.box.clip(r, t_min, t_max)
+	if !ok {
+		return false
+	}
+
+	var temp_rec HitRecord
+	hit_anything := false
+	closest_so_far := t_max
+
+	var buf [64]kdTodo
+	todo := buf[:0]
+	node := 0
+	for {
+		// a closer hit was already found in front of this node
+		if closest_so_far < t_near {
+			break
+		}
+		n := &kd.nodes[node]
+		if n.isLeaf() {
+			for _, i := range kd.indices[n.Start : n.Start+n.Count] {
+				object := kd.objects[i]
+				if any_hit {
+					if object.Occluded(r, t_min, t_max) {
+						return true
+					}
+					continue
+				}
+				temp_rec = NewHitRecord()
+				if object.Hit(r, t_min, closest_so_far, &temp_rec) {
+					closest_so_far = temp_rec.T
+					hit_anything = true
+					setObjectId(&temp_rec, object, int(i))
+					*rec = temp_rec
+				}
+			}
+			if len(todo) == 0 {
+				break
+			}
+			next := todo[len(todo)-1]
+			todo = todo[:len(todo)-1]
+			node, t_near, t_far = next.node, next.t_min, next.t_max
+			continue
+		}
+
+		o := r.Origin().At(n.Axis)
+		d := r.Direction().At(n.Axis)
+		below_first := o < n.Split || (o == n.Split && d <= 0)
+		first, second := node+1, n.Above
+		if !below_first {
+			first, second = second, first
+		}
+		if d == 0 {
+			node = first
+			continue
+		}
+		t_plane := (n.Split - o) / d
+		if t_plane > t_far || t_plane <= 0 {
+			node = first
+		} else if t_plane < t_near {
+			node = second
+		} else {
+			todo = append(todo, kdTodo{second, t_plane, t_far})
+			node = first
+			t_far = t_plane
+		}
+	}
+	return hit_anything
+}
+
+func (kd *KdTree) BBox(output_box *AABB) bool {
+	if len(kd.objects) == 0 {
+		return false
+	}
+	*output_box = kd.box
+	return true
+}
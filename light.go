@@ -0,0 +1,227 @@
+package raytrace
+
+import (
+	"math"
+	"math/rand"
+)
+
+// Light is a source of illumination which can be sampled directly from a
+// shading point p.
+//
+// Point, spot and directional lights are delta lights: they can't be hit by
+// a ray and have to be sampled. Area lights (RectLight, SphereLight) are
+// also Hittable with an emissive material - add them to the scene's World
+// as well as to its Lights.
+type Light interface {
+	// Sample picks a point on the light as seen from p.
+	Sample(p Vec3, rng *rand.Rand) (ls LightSample, ok bool)
+	// Pdf of Sample() returning direction wi from p, with respect to solid
+	// angle. Zero for delta lights and directions which miss the light.
+	Pdf(p, wi Vec3) float32
+	IsDelta() bool
+}
+
+type LightSample struct {
+	Wi   Vec3    // unit direction from p towards the light
+	Dist float32 // distance to the sampled point, +Inf for directional lights
+	Li   Vec3    // incoming radiance (irradiance for delta lights)
+	Pdf  float32 // solid angle pdf, 1 for delta lights
+}
+
+// PointLight radiates Intensity uniformly in all directions.
+type PointLight struct {
+	Position  Vec3
+	Intensity Vec3
+}
+
+func (l PointLight) Sample(p Vec3, rng *rand.Rand) (LightSample, bool) {
+	d := l.Position.Subtr(p)
+	dist2 := d.LengthSquared()
+	if dist2 == 0 {
+		return LightSample{}, false
+	}
+	dist := float32(math.Sqrt(float64(dist2)))
+	return LightSample{d.DivF(dist), dist, l.Intensity.DivF(dist2), 1}, true
+}
+
+func (l PointLight) Pdf(p, wi Vec3) float32 { return 0 }
+func (l PointLight) IsDelta() bool          { return true }
+
+// SpotLight is a point light restricted to a cone. The intensity is full
+// within Angle-Falloff degrees of Direction and fades smoothly to zero at
+// Angle.
+type SpotLight struct {
+	Position  Vec3
+	Direction Vec3
+	Intensity Vec3
+	Angle     float64 // half angle of the cone in degrees
+	Falloff   float64 // width of the soft edge in degrees
+}
+
+func (l SpotLight) falloff(w Vec3) float32 {
+	cos_theta := float64(w.Dot(l.Direction.UnitVec()))
+	cos_total := math.Cos(Deg_to_Rad(l.Angle))
+	cos_start := math.Cos(Deg_to_Rad(math.Max(0, l.Angle-l.Falloff)))
+	if cos_theta < cos_total {
+		return 0
+	}
+	if cos_theta >= cos_start {
+		return 1
+	}
+	// smoothstep between the outer and inner cone
+	t := (cos_theta - cos_total) / (cos_start - cos_total)
+	return float32(t * t * (3 - 2*t))
+}
+
+func (l SpotLight) Sample(p Vec3, rng *rand.Rand) (LightSample, bool) {
+	d := l.Position.Subtr(p)
+	dist2 := d.LengthSquared()
+	if dist2 == 0 {
+		return LightSample{}, false
+	}
+	dist := float32(math.Sqrt(float64(dist2)))
+	wi := d.DivF(dist)
+	falloff := l.falloff(wi.MultF(-1))
+	if falloff == 0 {
+		return LightSample{}, false
+	}
+	return LightSample{wi, dist, l.Intensity.MultF(falloff / dist2), 1}, true
+}
+
+func (l SpotLight) Pdf(p, wi Vec3) float32 { return 0 }
+func (l SpotLight) IsDelta() bool          { return true }
+
+// DirectionalLight (sun) illuminates everything from one direction.
+// Direction is where the light travels to, ie. (0,-1,0) for a sun at zenith.
+type DirectionalLight struct {
+	Direction  Vec3
+	Irradiance Vec3
+}
+
+func (l DirectionalLight) Sample(p Vec3, rng *rand.Rand) (LightSample, bool) {
+	return LightSample{l.Direction.UnitVec().MultF(-1), float32(math.Inf(1)), l.Irradiance, 1}, true
+}
+
+func (l DirectionalLight) Pdf(p, wi Vec3) float32 { return 0 }
+func (l DirectionalLight) IsDelta() bool          { return true }
+
+// RectLight is an emissive parallelogram, lit on the front side
+// (Edge1 x Edge2).
+type RectLight struct {
+	Quad
+	Emit Vec3
+}
+
+func (l RectLight) Hit(r *Ray, t_min, t_max float32, rec *HitRecord) bool {
+	if !l.Quad.Hit(r, t_min, t_max, rec) {
+		return false
+	}
+	rec.Mat = DiffuseLight{Emit: l.Emit}
+	rec.Light = l
+	return true
+}
+
+func (l RectLight) Sample(p Vec3, rng *rand.Rand) (LightSample, bool) {
+	point := l.Corner.Add(l.Edge1.MultF(randFloat(rng))).Add(l.Edge2.MultF(randFloat(rng)))
+	d := point.Subtr(p)
+	dist2 := d.LengthSquared()
+	dist := float32(math.Sqrt(float64(dist2)))
+	wi := d.DivF(dist)
+	normal := l.normal().UnitVec()
+	cos_light := -normal.Dot(wi)
+	if cos_light <= 0 || dist2 == 0 { // back side is dark
+		return LightSample{}, false
+	}
+	pdf := dist2 / (cos_light * l.Area()) // area to solid angle
+	return LightSample{wi, dist, l.Emit, pdf}, true
+}
+
+func (l RectLight) Pdf(p, wi Vec3) float32 {
+	r := NewRay(p, wi)
+	t, _, _, ok := l.intersect(&r, rayEpsilon, float32(math.Inf(1)))
+	if !ok {
+		return 0
+	}
+	cos_light := -l.normal().UnitVec().Dot(wi)
+	if cos_light <= 0 {
+		return 0
+	}
+	return t * t / (cos_light * l.Area())
+}
+
+func (l RectLight) IsDelta() bool { return false }
+
+// SphereLight is an emissive sphere. It is sampled by the cone of
+// directions it subtends, which is much less noisy than sampling its area.
+type SphereLight struct {
+	Center Vec3
+	Radius float32
+	Emit   Vec3
+}
+
+func (l SphereLight) sphere() Sphere {
+	return Sphere{l.Center, l.Radius}
+}
+
+func (l SphereLight) Hit(r *Ray, t_min, t_max float32, rec *HitRecord) bool {
+	if !l.sphere().Hit(r, t_min, t_max, rec) {
+		return false
+	}
+	rec.Mat = DiffuseLight{Emit: l.Emit}
+	rec.Light = l
+	return true
+}
+
+func (l SphereLight) Occluded(r *Ray, t_min, t_max float32) bool {
+	return l.sphere().Occluded(r, t_min, t_max)
+}
+
+func (l SphereLight) BBox(out_aabb *AABB) bool {
+	return l.sphere().BBox(out_aabb)
+}
+
+// cosine of the half angle of the cone subtended by the sphere
+func (l SphereLight) cosMax(p Vec3) (float64, bool) {
+	dist2 := float64(l.Center.Subtr(p).LengthSquared())
+	r2 := float64(l.Radius * l.Radius)
+	if dist2 <= r2 { // inside the light
+		return 0, false
+	}
+	return math.Sqrt(1 - r2/dist2), true
+}
+
+func (l SphereLight) Sample(p Vec3, rng *rand.Rand) (LightSample, bool) {
+	cos_max, ok := l.cosMax(p)
+	if !ok {
+		return LightSample{}, false
+	}
+	// uniform direction in the cone
+	u1, u2 := float64(randFloat(rng)), float64(randFloat(rng))
+	cos_theta := 1 - u1*(1-cos_max)
+	sin_theta := math.Sqrt(math.Max(0, 1-cos_theta*cos_theta))
+	phi := 2 * math.Pi * u2
+	onb := NewONB(l.Center.Subtr(p))
+	wi := onb.Local(NewVec3(float32(sin_theta*math.Cos(phi)), float32(sin_theta*math.Sin(phi)), float32(cos_theta)))
+
+	r := NewRay(p, wi)
+	t, hit := l.sphere().intersect(&r, 0, float32(math.Inf(1)))
+	if !hit { // grazing the silhouette, rounding
+		t = l.Center.Subtr(p).Length()
+	}
+	pdf := float32(1 / (2 * math.Pi * (1 - cos_max)))
+	return LightSample{wi, t, l.Emit, pdf}, true
+}
+
+func (l SphereLight) Pdf(p, wi Vec3) float32 {
+	cos_max, ok := l.cosMax(p)
+	if !ok {
+		return 0
+	}
+	r := NewRay(p, wi)
+	if !l.sphere().Occluded(&r, 0, float32(math.Inf(1))) {
+		return 0
+	}
+	return float32(1 / (2 * math.Pi * (1 - cos_max)))
+}
+
+func (l SphereLight) IsDelta() bool { return false }
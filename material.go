@@ -0,0 +1,144 @@
+package raytrace
+
+import (
+	"math"
+	"math/rand"
+)
+
+// Material describes how light scatters at a surface hit.
+//
+// All directions are in world space and point away from the surface:
+// wo towards the viewer (minus the ray direction), wi towards the light.
+// rec.Normal always faces wo (see set_face_normal).
+type Material interface {
+	// Radiance emitted towards wo, zero for non emissive materials.
+	Emitted(rec *HitRecord, wo Vec3) Vec3
+	// Sample picks wi proportionally to the BSDF. ok is false when the
+	// material absorbs the path (ie. lights).
+	Sample(rec *HitRecord, wo Vec3, rng *rand.Rand) (bs BSDFSample, ok bool)
+	// Eval returns f(wo, wi) * |cos(theta_i)|. Zero for specular materials.
+	Eval(rec *HitRecord, wo, wi Vec3) Vec3
+	// Pdf of Sample() returning wi, with respect to solid angle.
+	Pdf(rec *HitRecord, wo, wi Vec3) float32
+}
+
+type BSDFSample struct {
+	Wi       Vec3
+	F        Vec3 // f(wo, wi) * |cos(theta_i)|, throughput is F / Pdf
+	Pdf      float32
+	Specular bool // delta lobe, Eval() and Pdf() cannot reproduce it
+}
+
+// Surface attaches a material to any shape (a Sphere, a mesh BVH, an
+// Instance...) and reports it in HitRecord.Mat.
+type Surface struct {
+	Shape Hittable
+	Mat   Material
+}
+
+func (s Surface) Hit(r *Ray, t_min, t_max float32, rec *HitRecord) bool {
+	if !s.Shape.Hit(r, t_min, t_max, rec) {
+		return false
+	}
+	rec.Mat = s.Mat
+	rec.Light = nil
+	return true
+}
+
+func (s Surface) Occluded(r *Ray, t_min, t_max float32) bool {
+	return s.Shape.Occluded(r, t_min, t_max)
+}
+
+func (s Surface) BBox(output_box *AABB) bool {
+	return s.Shape.BBox(output_box)
+}
+
+func (s Surface) reportsObjectId() bool {
+	return reportsObjectId(s.Shape)
+}
+
+// Used for objects without a Surface
+var defaultMaterial Material = Lambertian{SolidColor{NewVec3(0.5, 0.5, 0.5)}}
+
+// Implemented by materials with a base color, reported by the albedo AOV.
+type albedoMaterial interface {
+	albedo(rec *HitRecord) Vec3
+}
+
+// albedoOf is the base color of the material at a hit, white for
+// materials without one.
+func albedoOf(mat Material, rec *HitRecord) Vec3 {
+	if mat == nil {
+		mat = defaultMaterial
+	}
+	if m, ok := mat.(albedoMaterial); ok {
+		return m.albedo(rec)
+	}
+	return NewVec3(1, 1, 1)
+}
+
+// Lambertian is an ideal diffuse reflector.
+type Lambertian struct {
+	Albedo Texture
+}
+
+func (m Lambertian) albedo(rec *HitRecord) Vec3 {
+	return m.Albedo.Value(rec.U, rec.V, rec.P)
+}
+
+func (m Lambertian) Emitted(rec *HitRecord, wo Vec3) Vec3 {
+	return NewVec3(0, 0, 0)
+}
+
+func (m Lambertian) Sample(rec *HitRecord, wo Vec3, rng *rand.Rand) (BSDFSample, bool) {
+	onb := NewONB(rec.Normal)
+	local := RandomCosineDirection(randFloat(rng), randFloat(rng))
+	wi := onb.Local(local)
+	cos := local.z
+	if cos <= 0 {
+		return BSDFSample{}, false
+	}
+	return BSDFSample{Wi: wi, F: m.albedo(rec).MultF(cos / math.Pi), Pdf: cos / math.Pi}, true
+}
+
+func (m Lambertian) Eval(rec *HitRecord, wo, wi Vec3) Vec3 {
+	cos := rec.Normal.Dot(wi)
+	if cos <= 0 {
+		return NewVec3(0, 0, 0)
+	}
+	return m.albedo(rec).MultF(cos / math.Pi)
+}
+
+func (m Lambertian) Pdf(rec *HitRecord, wo, wi Vec3) float32 {
+	cos := rec.Normal.Dot(wi)
+	if cos <= 0 {
+		return 0
+	}
+	return cos / math.Pi
+}
+
+// DiffuseLight is an emissive material radiating Emit from the front side
+// of a surface. It does not reflect any light.
+type DiffuseLight struct {
+	Emit     Vec3
+	TwoSided bool
+}
+
+func (m DiffuseLight) Emitted(rec *HitRecord, wo Vec3) Vec3 {
+	if !rec.FrontFace && !m.TwoSided {
+		return NewVec3(0, 0, 0)
+	}
+	return m.Emit
+}
+
+func (m DiffuseLight) Sample(rec *HitRecord, wo Vec3, rng *rand.Rand) (BSDFSample, bool) {
+	return BSDFSample{}, false
+}
+
+func (m DiffuseLight) Eval(rec *HitRecord, wo, wi Vec3) Vec3 {
+	return NewVec3(0, 0, 0)
+}
+
+func (m DiffuseLight) Pdf(rec *HitRecord, wo, wi Vec3) float32 {
+	return 0
+}
@@ -0,0 +1,240 @@
+package raytrace
+
+import (
+	"math"
+	"math/rand"
+)
+
+// PhaseFunction describes how light scatters inside a participating
+// medium. Like for materials wo points towards the viewer and wi towards
+// the light; light travelling straight through has wi = -wo.
+type PhaseFunction interface {
+	// P is the phase function value, it integrates to one over the sphere.
+	P(wo, wi Vec3) float32
+	// Sample picks wi proportionally to P and returns it with its pdf.
+	Sample(wo Vec3, u1, u2 float32) (wi Vec3, pdf float32)
+}
+
+// Isotropic scatters uniformly in all directions.
+type Isotropic struct{}
+
+func (Isotropic) P(wo, wi Vec3) float32 {
+	return 1 / (4 * math.Pi)
+}
+
+func (Isotropic) Sample(wo Vec3, u1, u2 float32) (Vec3, float32) {
+	return UniformSampleSphere(u1, u2), 1 / (4 * math.Pi)
+}
+
+// HenyeyGreenstein is the classic one parameter phase function: G in
+// (-1,1) is the mean cosine of the scattering angle, positive values
+// scatter forward (fog, clouds), negative backwards and 0 is isotropic.
+type HenyeyGreenstein struct {
+	G float32
+}
+
+// cos_theta is the cosine between the propagation before and after
+// scattering
+func henyeyGreenstein(cos_theta, g float64) float64 {
+	denom := 1 + g*g - 2*g*cos_theta
+	return (1 - g*g) / (4 * math.Pi * denom * math.Sqrt(denom))
+}
+
+func (hg HenyeyGreenstein) P(wo, wi Vec3) float32 {
+	return float32(henyeyGreenstein(float64(wo.MultF(-1).Dot(wi)), float64(hg.G)))
+}
+
+func (hg HenyeyGreenstein) Sample(wo Vec3, u1, u2 float32) (Vec3, float32) {
+	g := float64(hg.G)
+	var cos_theta float64
+	if math.Abs(g) < 1e-3 {
+		cos_theta = 1 - 2*float64(u1)
+	} else {
+		sq := (1 - g*g) / (1 - g + 2*g*float64(u1))
+		cos_theta = (1 + g*g - sq*sq) / (2 * g)
+	}
+	cos_theta = math.Max(-1, math.Min(1, cos_theta))
+	sin_theta := math.Sqrt(math.Max(0, 1-cos_theta*cos_theta))
+	phi := 2 * math.Pi * float64(u2)
+	// around the direction of propagation
+	frame := NewONB(wo.MultF(-1))
+	wi := frame.Local(NewVec3(float32(sin_theta*math.Cos(phi)), float32(sin_theta*math.Sin(phi)), float32(cos_theta)))
+	return wi, float32(henyeyGreenstein(cos_theta, g))
+}
+
+// phaseMaterial lets the integrators shade a scattering event inside a
+// medium like a surface hit. Albedo is the single scattering albedo
+// (sigma_s / sigma_t).
+type phaseMaterial struct {
+	Phase  PhaseFunction
+	Albedo Vec3
+}
+
+func (m phaseMaterial) albedo(rec *HitRecord) Vec3 {
+	return m.Albedo
+}
+
+func (m phaseMaterial) Emitted(rec *HitRecord, wo Vec3) Vec3 {
+	return NewVec3(0, 0, 0)
+}
+
+func (m phaseMaterial) Sample(rec *HitRecord, wo Vec3, rng *rand.Rand) (BSDFSample, bool) {
+	wi, pdf := m.Phase.Sample(wo, randFloat(rng), randFloat(rng))
+	if pdf == 0 {
+		return BSDFSample{}, false
+	}
+	return BSDFSample{Wi: wi, F: m.Albedo.MultF(pdf), Pdf: pdf}, true
+}
+
+func (m phaseMaterial) Eval(rec *HitRecord, wo, wi Vec3) Vec3 {
+	return m.Albedo.MultF(m.Phase.P(wo, wi))
+}
+
+func (m phaseMaterial) Pdf(rec *HitRecord, wo, wi Vec3) float32 {
+	return m.Phase.P(wo, wi)
+}
+
+// scatter event at distance t along r
+func mediumRecord(r *Ray, t float32, mat Material, rec *HitRecord) {
+	rec.T = t
+	rec.P = r.At(t)
+	rec.Normal = r.Direction().UnitVec().MultF(-1) // arbitrary, faces the viewer
+	rec.FrontFace = true
+	rec.U, rec.V = 0, 0
+	rec.Tangent, rec.Bitangent = Vec3{}, Vec3{}
+	rec.Mat = mat
+	rec.Light = nil
+}
+
+// rayRNG is a splitmix64 stream seeded by hashing the ray. Hit() has no
+// random generator, deriving the numbers from the ray keeps media thread
+// safe and renders repeatable for a given seed. Each medium passes its own
+// salt (see mediumSalt), otherwise every medium along a ray would draw the
+// same numbers and their free flights would be correlated.
+type rayRNG uint64
+
+func newRayRNG(r *Ray, salt uint64) rayRNG {
+	return rayRNG(hashFloats(splitmix(0x9e3779b97f4a7c15^salt), r.Orig.x, r.Orig.y, r.Orig.z, r.Dir.x, r.Dir.y, r.Dir.z))
+}
+
+// mediumSalt tells media apart by their bounds and density
+func mediumSalt(box AABB, density float32) uint64 {
+	return hashFloats(0, box.min.x, box.min.y, box.min.z, box.max.x, box.max.y, box.max.z, density)
+}
+
+func hashFloats(h uint64, values ...float32) uint64 {
+	for _, v := range values {
+		h = splitmix(h ^ uint64(math.Float32bits(v)))
+	}
+	return h
+}
+
+// splitmix64 finalizer
+func splitmix(z uint64) uint64 {
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	return z ^ (z >> 31)
+}
+
+// next uniform number in [0,1)
+func (s *rayRNG) next() float32 {
+	*s += 0x9e3779b97f4a7c15
+	return float32(splitmix(uint64(*s))>>40) / (1 << 24)
+}
+
+// ConstantMedium fills a closed, convex Boundary with a homogeneous medium
+// (smoke, fog) of the given Density (extinction per unit length). A hit is
+// a scattering event at a free-flight distance sampled with the density,
+// the boundary surface itself is invisible. Phase nil is isotropic.
+type ConstantMedium struct {
+	Boundary Hittable
+	Density  float32
+	Albedo   Vec3
+	Phase    PhaseFunction
+}
+
+// material of the scattering events, a nil phase function is isotropic
+func mediumMaterial(phase PhaseFunction, albedo Vec3) Material {
+	if phase == nil {
+		phase = Isotropic{}
+	}
+	return phaseMaterial{phase, albedo}
+}
+
+// free-flight distance sampled along r, false when the ray leaves the
+// medium (or reaches t_max) first
+func (m ConstantMedium) sample(r *Ray, t_min, t_max float32) (float32, bool) {
+	inf := float32(math.Inf(1))
+	rec1 := NewHitRecord()
+	if !m.Boundary.Hit(r, -inf, inf, &rec1) {
+		return 0, false
+	}
+	rec2 := NewHitRecord()
+	if !m.Boundary.Hit(r, rec1.T+rayEpsilon, inf, &rec2) { // grazing
+		return 0, false
+	}
+	t_enter := float32(math.Max(float64(rec1.T), float64(t_min)))
+	t_exit := float32(math.Min(float64(rec2.T), float64(t_max)))
+	if t_enter >= t_exit {
+		return 0, false
+	}
+	var box AABB
+	m.Boundary.BBox(&box)
+	rng := newRayRNG(r, mediumSalt(box, m.Density))
+	length := r.Direction().Length()
+	distance := -float32(math.Log(float64(1-rng.next()))) / m.Density
+	t := t_enter + distance/length
+	if t > t_exit {
+		return 0, false
+	}
+	return t, true
+}
+
+func (m ConstantMedium) Hit(r *Ray, t_min, t_max float32, rec *HitRecord) bool {
+	t, ok := m.sample(r, t_min, t_max)
+	if !ok {
+		return false
+	}
+	mediumRecord(r, t, mediumMaterial(m.Phase, m.Albedo), rec)
+	return true
+}
+
+// Occluded answers whether the ray scatters before t_max, a stochastic but
+// unbiased estimate of the transmittance for shadow rays.
+func (m ConstantMedium) Occluded(r *Ray, t_min, t_max float32) bool {
+	_, ok := m.sample(r, t_min, t_max)
+	return ok
+}
+
+func (m ConstantMedium) BBox(output_box *AABB) bool {
+	return m.Boundary.BBox(output_box)
+}
+
+// Fog is a homogeneous medium filling the whole scene, see Scene.Fog.
+// Unlike ConstantMedium, shadow rays through fog are attenuated
+// analytically. Being infinite it hides the background and directional
+// lights, use a ConstantMedium for a fog bank under an open sky.
+type Fog struct {
+	Density float32 // extinction per unit length
+	Albedo  Vec3
+	Phase   PhaseFunction // nil is isotropic
+}
+
+// Samples a scattering event in front of the surface at t_hit (+Inf when
+// the ray escapes, escaping rays always scatter).
+func (f *Fog) sample(r *Ray, t_hit float32, rng *rand.Rand) (float32, bool) {
+	if f.Density <= 0 {
+		return 0, false
+	}
+	distance := -float32(math.Log(float64(1-randFloat(rng)))) / f.Density
+	t := distance / r.Direction().Length()
+	return t, t < t_hit
+}
+
+// Transmittance over distance
+func (f *Fog) Transmittance(distance float32) float32 {
+	if f.Density <= 0 {
+		return 1
+	}
+	return float32(math.Exp(-float64(f.Density) * float64(distance)))
+}
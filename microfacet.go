@@ -0,0 +1,329 @@
+package raytrace
+
+import (
+	"math"
+	"math/rand"
+)
+
+// Microfacet BSDFs.
+//
+// All lobes are evaluated in the local shading frame (Z is the normal,
+// which faces wo, see set_face_normal) with the GGX / Trowbridge-Reitz
+// distribution and the height correlated Smith shadowing term. Directions
+// are sampled from the distribution of visible normals (Heitz 2018), so
+// the throughput F / Pdf of a reflection is simply Fresnel * G / G1.
+
+// Below this alpha a surface is treated as perfectly smooth
+const minAlpha = 1e-3
+
+// ggx is an isotropic GGX distribution, alpha = roughness^2.
+type ggx struct {
+	alpha float32
+}
+
+func roughnessToAlpha(roughness float32) float32 {
+	r := Clamp(roughness, 0, 1)
+	return r * r
+}
+
+func (m ggx) smooth() bool {
+	return m.alpha < minAlpha
+}
+
+// D(h), distribution of normals with respect to the projected area
+func (m ggx) d(h Vec3) float32 {
+	if h.z <= 0 {
+		return 0
+	}
+	a2 := m.alpha * m.alpha
+	t := h.z*h.z*(a2-1) + 1
+	return a2 / (math.Pi * t * t)
+}
+
+func (m ggx) lambda(w Vec3) float32 {
+	cos2 := w.z * w.z
+	if cos2 == 0 {
+		return float32(math.Inf(1))
+	}
+	tan2 := (1 - cos2) / cos2
+	return (float32(math.Sqrt(float64(1+m.alpha*m.alpha*tan2))) - 1) / 2
+}
+
+func (m ggx) g1(w Vec3) float32 {
+	return 1 / (1 + m.lambda(w))
+}
+
+func (m ggx) g(wo, wi Vec3) float32 {
+	return 1 / (1 + m.lambda(wo) + m.lambda(wi))
+}
+
+// pdf of sampleVisible() returning h
+func (m ggx) pdfVisible(wo, h Vec3) float32 {
+	cos := wo.Dot(h)
+	if cos <= 0 || wo.z <= 0 {
+		return 0
+	}
+	return m.g1(wo) * cos * m.d(h) / wo.z
+}
+
+// Heitz, "Sampling the GGX Distribution of Visible Normals" (JCGT 2018)
+func (m ggx) sampleVisible(wo Vec3, u1, u2 float32) Vec3 {
+	vh := NewVec3(m.alpha*wo.x, m.alpha*wo.y, wo.z).UnitVec()
+	lensq := vh.x*vh.x + vh.y*vh.y
+	t1 := NewVec3(1, 0, 0)
+	if lensq > 0 {
+		t1 = NewVec3(-vh.y, vh.x, 0).DivF(float32(math.Sqrt(float64(lensq))))
+	}
+	t2 := t1.Cross(vh) // vh x t1
+	r := math.Sqrt(float64(u1))
+	phi := 2 * math.Pi * float64(u2)
+	p1 := float32(r * math.Cos(phi))
+	p2 := float32(r * math.Sin(phi))
+	s := 0.5 * (1 + vh.z)
+	p2 = (1-s)*float32(math.Sqrt(math.Max(0, float64(1-p1*p1)))) + s*p2
+	p3 := float32(math.Sqrt(math.Max(0, float64(1-p1*p1-p2*p2))))
+	nh := t1.MultF(p1).Add(t2.MultF(p2)).Add(vh.MultF(p3))
+	return NewVec3(m.alpha*nh.x, m.alpha*nh.y, float32(math.Max(0, float64(nh.z)))).UnitVec()
+}
+
+// mirror direction of w around n
+func reflect(w, n Vec3) Vec3 {
+	return n.MultF(2 * w.Dot(n)).Subtr(w)
+}
+
+// refract w (pointing away from the surface, on the side of n) with
+// relative index eta = eta_t / eta_i, false on total internal reflection
+func refract(w, n Vec3, eta float32) (Vec3, bool) {
+	cos_i := w.Dot(n)
+	sin2_t := (1 - cos_i*cos_i) / (eta * eta)
+	if sin2_t >= 1 {
+		return Vec3{}, false
+	}
+	cos_t := float32(math.Sqrt(float64(1 - sin2_t)))
+	return w.MultF(-1 / eta).Add(n.MultF(cos_i/eta - cos_t)), true
+}
+
+// Unpolarised Fresnel reflectance of a dielectric interface
+func fresnelDielectric(cos_i, eta float32) float32 {
+	cos_i = Clamp(cos_i, 0, 1)
+	sin2_t := (1 - cos_i*cos_i) / (eta * eta)
+	if sin2_t >= 1 {
+		return 1
+	}
+	cos_t := float32(math.Sqrt(float64(1 - sin2_t)))
+	r_parl := (eta*cos_i - cos_t) / (eta*cos_i + cos_t)
+	r_perp := (cos_i - eta*cos_t) / (cos_i + eta*cos_t)
+	return (r_parl*r_parl + r_perp*r_perp) / 2
+}
+
+func fresnelSchlick(f0 Vec3, cos float32) Vec3 {
+	c := 1 - Clamp(cos, 0, 1)
+	c5 := c * c * c * c * c
+	return f0.Add(NewVec3(1, 1, 1).Subtr(f0).MultF(c5))
+}
+
+// GGX reflection with Schlick Fresnel, returns f * cos(theta_i) and pdf.
+func (m ggx) evalReflection(wo, wi Vec3, f0 Vec3) (Vec3, float32) {
+	if wo.z <= 0 || wi.z <= 0 {
+		return Vec3{}, 0
+	}
+	h := wo.Add(wi)
+	if h.LengthSquared() == 0 {
+		return Vec3{}, 0
+	}
+	h = h.UnitVec()
+	f := fresnelSchlick(f0, wo.Dot(h)).MultF(m.d(h) * m.g(wo, wi) / (4 * wo.z))
+	pdf := m.pdfVisible(wo, h) / (4 * wo.Dot(h))
+	return f, pdf
+}
+
+func (m ggx) sampleReflection(wo Vec3, f0 Vec3, u1, u2 float32) (BSDFSample, bool) {
+	if wo.z <= 0 {
+		return BSDFSample{}, false
+	}
+	if m.smooth() {
+		wi := NewVec3(-wo.x, -wo.y, wo.z)
+		return BSDFSample{Wi: wi, F: fresnelSchlick(f0, wo.z), Pdf: 1, Specular: true}, true
+	}
+	h := m.sampleVisible(wo, u1, u2)
+	wi := reflect(wo, h)
+	if wi.z <= 0 {
+		return BSDFSample{}, false
+	}
+	f, pdf := m.evalReflection(wo, wi, f0)
+	if pdf == 0 {
+		return BSDFSample{}, false
+	}
+	return BSDFSample{Wi: wi, F: f, Pdf: pdf}, true
+}
+
+// Rough dielectric (Walter et al. 2007), eta = eta_t / eta_i across the
+// surface from the side of wo. Returns f * |cos(theta_i)| and pdf. The
+// BTDF is not divided by eta^2, it conserves energy (throughput) rather
+// than radiance, which cancels out for closed objects anyway.
+func (m ggx) evalDielectric(wo, wi Vec3, eta float32) (float32, float32) {
+	if wo.z <= 0 || wi.z == 0 {
+		return 0, 0
+	}
+	if wi.z > 0 { // reflection
+		h := wo.Add(wi).UnitVec()
+		fr := fresnelDielectric(wo.Dot(h), eta)
+		f := fr * m.d(h) * m.g(wo, wi) / (4 * wo.z)
+		pdf := fr * m.pdfVisible(wo, h) / (4 * wo.Dot(h))
+		return f, pdf
+	}
+	// generalized half vector of the refraction
+	h := wo.Add(wi.MultF(eta))
+	if h.LengthSquared() == 0 {
+		return 0, 0
+	}
+	h = h.UnitVec()
+	if h.z < 0 {
+		h = h.MultF(-1)
+	}
+	cos_o := wo.Dot(h)
+	cos_i := wi.Dot(h)
+	if cos_o <= 0 || cos_i >= 0 { // back facing microfacet
+		return 0, 0
+	}
+	ft := 1 - fresnelDielectric(cos_o, eta)
+	denom := cos_o + eta*cos_i
+	denom *= denom
+	f := ft * m.d(h) * m.g(wo, wi) * eta * eta * -cos_i * cos_o / (wo.z * denom)
+	pdf := ft * m.pdfVisible(wo, h) * eta * eta * -cos_i / denom
+	return f, pdf
+}
+
+func (m ggx) sampleDielectric(wo Vec3, eta float32, u0, u1, u2 float32) (BSDFSample, bool) {
+	if wo.z <= 0 {
+		return BSDFSample{}, false
+	}
+	h := NewVec3(0, 0, 1)
+	if !m.smooth() {
+		h = m.sampleVisible(wo, u1, u2)
+	}
+	fr := fresnelDielectric(wo.Dot(h), eta)
+	var wi Vec3
+	if u0 < fr {
+		wi = reflect(wo, h)
+		if wi.z <= 0 {
+			return BSDFSample{}, false
+		}
+	} else {
+		var ok bool
+		wi, ok = refract(wo, h, eta)
+		if !ok || wi.z >= 0 {
+			return BSDFSample{}, false
+		}
+	}
+	if m.smooth() {
+		// the probability of the branch cancels the Fresnel term
+		p := fr
+		if wi.z < 0 {
+			p = 1 - fr
+		}
+		return BSDFSample{Wi: wi, F: NewVec3(p, p, p), Pdf: p, Specular: true}, true
+	}
+	f, pdf := m.evalDielectric(wo, wi, eta)
+	if pdf == 0 {
+		return BSDFSample{}, false
+	}
+	return BSDFSample{Wi: wi, F: NewVec3(f, f, f), Pdf: pdf}, true
+}
+
+// local shading frame of a hit
+func shadingFrame(rec *HitRecord) ONB {
+	return NewONB(rec.Normal)
+}
+
+// Conductor is a GGX metal with Color as its reflectance at normal
+// incidence (Schlick Fresnel). Roughness 0 is a perfect mirror.
+type Conductor struct {
+	Color     Texture
+	Roughness float32
+}
+
+func (m Conductor) albedo(rec *HitRecord) Vec3 {
+	return m.Color.Value(rec.U, rec.V, rec.P)
+}
+
+func (m Conductor) Emitted(rec *HitRecord, wo Vec3) Vec3 {
+	return NewVec3(0, 0, 0)
+}
+
+func (m Conductor) Sample(rec *HitRecord, wo Vec3, rng *rand.Rand) (BSDFSample, bool) {
+	frame := shadingFrame(rec)
+	dist := ggx{roughnessToAlpha(m.Roughness)}
+	f0 := m.Color.Value(rec.U, rec.V, rec.P)
+	bs, ok := dist.sampleReflection(frame.ToLocal(wo), f0, randFloat(rng), randFloat(rng))
+	bs.Wi = frame.Local(bs.Wi)
+	return bs, ok
+}
+
+func (m Conductor) Eval(rec *HitRecord, wo, wi Vec3) Vec3 {
+	dist := ggx{roughnessToAlpha(m.Roughness)}
+	if dist.smooth() {
+		return NewVec3(0, 0, 0)
+	}
+	frame := shadingFrame(rec)
+	f, _ := dist.evalReflection(frame.ToLocal(wo), frame.ToLocal(wi), m.Color.Value(rec.U, rec.V, rec.P))
+	return f
+}
+
+func (m Conductor) Pdf(rec *HitRecord, wo, wi Vec3) float32 {
+	dist := ggx{roughnessToAlpha(m.Roughness)}
+	if dist.smooth() {
+		return 0
+	}
+	frame := shadingFrame(rec)
+	_, pdf := dist.evalReflection(frame.ToLocal(wo), frame.ToLocal(wi), NewVec3(1, 1, 1))
+	return pdf
+}
+
+// Dielectric is rough (or with Roughness 0 perfectly smooth) glass with
+// index of refraction IOR, reflecting and refracting by the Fresnel
+// equations.
+type Dielectric struct {
+	IOR       float32
+	Roughness float32
+}
+
+// relative index across the surface as seen from wo
+func (m Dielectric) eta(rec *HitRecord) float32 {
+	if rec.FrontFace {
+		return m.IOR
+	}
+	return 1 / m.IOR
+}
+
+func (m Dielectric) Emitted(rec *HitRecord, wo Vec3) Vec3 {
+	return NewVec3(0, 0, 0)
+}
+
+func (m Dielectric) Sample(rec *HitRecord, wo Vec3, rng *rand.Rand) (BSDFSample, bool) {
+	frame := shadingFrame(rec)
+	dist := ggx{roughnessToAlpha(m.Roughness)}
+	bs, ok := dist.sampleDielectric(frame.ToLocal(wo), m.eta(rec), randFloat(rng), randFloat(rng), randFloat(rng))
+	bs.Wi = frame.Local(bs.Wi)
+	return bs, ok
+}
+
+func (m Dielectric) Eval(rec *HitRecord, wo, wi Vec3) Vec3 {
+	dist := ggx{roughnessToAlpha(m.Roughness)}
+	if dist.smooth() {
+		return NewVec3(0, 0, 0)
+	}
+	frame := shadingFrame(rec)
+	f, _ := dist.evalDielectric(frame.ToLocal(wo), frame.ToLocal(wi), m.eta(rec))
+	return NewVec3(f, f, f)
+}
+
+func (m Dielectric) Pdf(rec *HitRecord, wo, wi Vec3) float32 {
+	dist := ggx{roughnessToAlpha(m.Roughness)}
+	if dist.smooth() {
+		return 0
+	}
+	frame := shadingFrame(rec)
+	_, pdf := dist.evalDielectric(frame.ToLocal(wo), frame.ToLocal(wi), m.eta(rec))
+	return pdf
+}
@@ -0,0 +1,198 @@
+package raytrace
+
+import "math"
+
+// Packet traversal.
+//
+// Primary rays of a small screen tile are coherent - they start at the same
+// point and point in almost the same direction - so they visit nearly the
+// same BVH nodes. Tracing them together as a RayPacket amortises the node
+// fetches and, using the "first active ray" trick, most rays skip the box
+// test entirely: a node is entered as soon as one ray hits its box.
+//
+// Incoherent packets (rays with different direction signs) fall back to
+// the scalar Hittable.Hit() path.
+//
+// Only the traversal is shared: the slab tests and the primitive tests
+// are still done lane by lane with scalar code, there is no SIMD
+// intersection. In BenchmarkPrimaryPacket it is on par with the scalar
+// traversal of BenchmarkPrimaryScalar, not faster.
+
+// Number of rays traced together
+const PacketSize = 8
+
+// Vec3x8 stores PacketSize vectors as structure of arrays.
+type Vec3x8 struct {
+	X, Y, Z [PacketSize]float32
+}
+
+func (v *Vec3x8) Set(i int, p Vec3) {
+	v.X[i], v.Y[i], v.Z[i] = p.x, p.y, p.z
+}
+
+func (v *Vec3x8) At(i int) Vec3 {
+	return NewVec3(v.X[i], v.Y[i], v.Z[i])
+}
+
+type RayPacket struct {
+	Orig, Dir, InvDir Vec3x8
+	N                 int    // number of rays in use, at most PacketSize
+	Sign              [3]int // direction signs shared by all rays, valid when Coherent
+	Coherent          bool
+}
+
+// NewRayPacket packs up to PacketSize rays.
+func NewRayPacket(rays []Ray) RayPacket {
+	var p RayPacket
+	p.N = len(rays)
+	if p.N > PacketSize {
+		p.N = PacketSize
+	}
+	p.Coherent = true
+	for i := 0; i < p.N; i++ {
+		r := &rays[i]
+		p.Orig.Set(i, r.Orig)
+		p.Dir.Set(i, r.Dir)
+		p.InvDir.Set(i, r.InvDir)
+		if i == 0 {
+			p.Sign = r.Sign
+		} else if r.Sign != p.Sign {
+			p.Coherent = false
+		}
+	}
+	return p
+}
+
+func (p *RayPacket) Ray(i int) Ray {
+	return NewRay(p.Orig.At(i), p.Dir.At(i))
+}
+
+// PacketHittable is implemented by accelerators with a packet path.
+// HitPacket fills recs[i] and hits[i] for each ray of the packet, recs[i]
+// of a ray which misses is a fresh NewHitRecord() as with the scalar path.
+type PacketHittable interface {
+	HitPacket(p *RayPacket, t_min, t_max float32, recs *[PacketSize]HitRecord, hits *[PacketSize]bool)
+}
+
+// hitLane is the slab test for a single ray of a packet.
+func (aabb AABB) hitLane(p *RayPacket, i int, t_min, t_max float32) bool {
+	bounds := [2]Vec3{aabb.min, aabb.max}
+	tx0 := (bounds[p.Sign[0]].x - p.Orig.X[i]) * p.InvDir.X[i]
+	tx1 := (bounds[1-p.Sign[0]].x - p.Orig.X[i]) * p.InvDir.X[i]
+	ty0 := (bounds[p.Sign[1]].y - p.Orig.Y[i]) * p.InvDir.Y[i]
+	ty1 := (bounds[1-p.Sign[1]].y - p.Orig.Y[i]) * p.InvDir.Y[i]
+	tz0 := (bounds[p.Sign[2]].z - p.Orig.Z[i]) * p.InvDir.Z[i]
+	tz1 := (bounds[1-p.Sign[2]].z - p.Orig.Z[i]) * p.InvDir.Z[i]
+	if tx0 > t_min {
+		t_min = tx0
+	}
+	if ty0 > t_min {
+		t_min = ty0
+	}
+	if tz0 > t_min {
+		t_min = tz0
+	}
+	if tx1 < t_max {
+		t_max = tx1
+	}
+	if ty1 < t_max {
+		t_max = ty1
+	}
+	if tz1 < t_max {
+		t_max = tz1
+	}
+	return t_min <= t_max*slabRobustness && t_min <= math.MaxFloat32
+}
+
+type packetTodo struct {
+	node, first int
+}
+
+// HitPacket walks the tree once for the whole packet, each lane still
+// calls the scalar Object.Hit() of the leaves it reaches.
+func (bvh *DynamicBVH) HitPacket(p *RayPacket, t_min, t_max float32, recs *[PacketSize]HitRecord, hits *[PacketSize]bool) {
+	if !p.Coherent {
+		hitPacketScalar(bvh, p, t_min, t_max, recs, hits)
+		return
+	}
+	var closest [PacketSize]float32
+	for i := 0; i < p.N; i++ {
+		closest[i] = t_max
+		hits[i] = false
+		recs[i] = NewHitRecord()
+	}
+	if bvh.root == nullNode {
+		return
+	}
+
+	var buf [64]packetTodo
+	stack := append(buf[:0], packetTodo{bvh.root, 0})
+	rays := [PacketSize]Ray{}
+	ray_ready := [PacketSize]bool{}
+	var temp_rec HitRecord
+	for len(stack) > 0 {
+		todo := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		n := &bvh.nodes[todo.node]
+
+		// first ray which hits the box, rays before it missed a parent
+		first := todo.first
+		for first < p.N && !n.Box.hitLane(p, first, t_min, closest[first]) {
+			first++
+		}
+		if first == p.N {
+			continue
+		}
+		if !n.isLeaf() {
+			stack = append(stack, packetTodo{n.Left, first}, packetTodo{n.Right, first})
+			continue
+		}
+		for i := first; i < p.N; i++ {
+			if i > first && !n.Box.hitLane(p, i, t_min, closest[i]) {
+				continue
+			}
+			if !ray_ready[i] {
+				rays[i] = p.Ray(i)
+				ray_ready[i] = true
+			}
+			temp_rec = NewHitRecord()
+			if n.Object.Hit(&rays[i], t_min, closest[i], &temp_rec) {
+				closest[i] = temp_rec.T
+				hits[i] = true
+				setObjectId(&temp_rec, n.Object, n.Id)
+				recs[i] = temp_rec
+			}
+		}
+	}
+}
+
+func hitPacketScalar(world Hittable, p *RayPacket, t_min, t_max float32, recs *[PacketSize]HitRecord, hits *[PacketSize]bool) {
+	for i := 0; i < p.N; i++ {
+		r := p.Ray(i)
+		recs[i] = NewHitRecord()
+		hits[i] = world.Hit(&r, t_min, t_max, &recs[i])
+	}
+}
+
+// TraceRays finds the closest hit for every ray. Rays are grouped into
+// packets of PacketSize (keep coherent rays next to each other, ie. a
+// screen tile) and traced with HitPacket() when the world supports it.
+func TraceRays(world Hittable, rays []Ray, t_min, t_max float32, recs []HitRecord, hits []bool) {
+	packet_world, has_packets := world.(PacketHittable)
+	var packet_recs [PacketSize]HitRecord
+	var packet_hits [PacketSize]bool
+	for start := 0; start < len(rays); start += PacketSize {
+		end := start + PacketSize
+		if end > len(rays) {
+			end = len(rays)
+		}
+		p := NewRayPacket(rays[start:end])
+		if has_packets {
+			packet_world.HitPacket(&p, t_min, t_max, &packet_recs, &packet_hits)
+		} else {
+			hitPacketScalar(world, &p, t_min, t_max, &packet_recs, &packet_hits)
+		}
+		copy(recs[start:end], packet_recs[:p.N])
+		copy(hits[start:end], packet_hits[:p.N])
+	}
+}
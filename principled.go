@@ -0,0 +1,188 @@
+package raytrace
+
+import (
+	"math"
+	"math/rand"
+)
+
+// Principled is a Disney style uber material mixing a diffuse base, GGX
+// specular reflection, rough glass transmission and a clearcoat layer from
+// a handful of artist friendly parameters in [0,1].
+//
+// IOR is used by the transmission lobe, 0 means 1.5. Roughness is clamped
+// so that every lobe stays non specular and can be evaluated for MIS.
+type Principled struct {
+	BaseColor      Texture
+	Metallic       float32 // blends from a dielectric to a conductor tinted by BaseColor
+	Roughness      float32 // of the specular and transmission lobes
+	Specular       float32 // dielectric reflectance at normal incidence, 0.5 is 4%
+	Clearcoat      float32 // strength of a second, white specular layer
+	ClearcoatGloss float32 // from a satin (0) to a glossy (1) clearcoat
+	Transmission   float32 // blends the dielectric base from diffuse to glass
+	IOR            float32
+}
+
+// Lowest alpha used by Principled, just above the smooth limit
+const principledMinAlpha = 2 * minAlpha
+
+// lobe weights and parameters at a hit
+type principledLobes struct {
+	base      Vec3
+	f0        Vec3 // specular reflectance at normal incidence
+	spec      ggx
+	coat      ggx
+	eta       float32
+	diffuse   float32 // (1 - metallic) * (1 - transmission)
+	specular  float32
+	transmit  float32
+	clearcoat float32
+	// probabilities of sampling each lobe, in the order above
+	pick [4]float32
+}
+
+func (m Principled) lobes(rec *HitRecord, wo Vec3) principledLobes {
+	var l principledLobes
+	l.base = m.BaseColor.Value(rec.U, rec.V, rec.P)
+	metallic := Clamp(m.Metallic, 0, 1)
+	transmission := Clamp(m.Transmission, 0, 1)
+	dielectric_f0 := 0.08 * Clamp(m.Specular, 0, 1)
+	l.f0 = NewVec3(dielectric_f0, dielectric_f0, dielectric_f0).MultF(1 - metallic).Add(l.base.MultF(metallic))
+
+	alpha := roughnessToAlpha(m.Roughness)
+	if alpha < principledMinAlpha {
+		alpha = principledMinAlpha
+	}
+	l.spec = ggx{alpha}
+	gloss := Clamp(m.ClearcoatGloss, 0, 1)
+	l.coat = ggx{float32(math.Max(principledMinAlpha, float64(0.1*(1-gloss)+0.001*gloss)))}
+	ior := m.IOR
+	if ior == 0 {
+		ior = 1.5
+	}
+	l.eta = ior
+	if !rec.FrontFace {
+		l.eta = 1 / ior
+	}
+
+	l.diffuse = (1 - metallic) * (1 - transmission)
+	l.transmit = (1 - metallic) * transmission
+	l.specular = 1 - l.transmit // glass reflects through its own lobe
+	l.clearcoat = 0.25 * Clamp(m.Clearcoat, 0, 1)
+
+	cos_o := Clamp(wo.z, 0, 1)
+	fs := maxComponent(fresnelSchlick(l.f0, cos_o))
+	l.pick[0] = l.diffuse * luminance(l.base) * (1 - fs)
+	l.pick[1] = l.specular * fs
+	l.pick[2] = l.transmit
+	l.pick[3] = l.clearcoat * fresnelSchlick(NewVec3(0.04, 0.04, 0.04), cos_o).x
+	total := l.pick[0] + l.pick[1] + l.pick[2] + l.pick[3]
+	if total == 0 {
+		l.pick = [4]float32{1, 0, 0, 0}
+	} else {
+		for i := range l.pick {
+			l.pick[i] /= total
+		}
+	}
+	return l
+}
+
+func maxComponent(v Vec3) float32 {
+	return float32(math.Max(float64(v.x), math.Max(float64(v.y), float64(v.z))))
+}
+
+// f * |cos(theta_i)| and the pdf of sampling wi, in the local frame
+func (l *principledLobes) eval(wo, wi Vec3) (Vec3, float32) {
+	var f Vec3
+	var pdf float32
+	if wi.z > 0 {
+		if l.diffuse > 0 {
+			// the diffuse base is reached through the specular interface
+			fo := maxComponent(fresnelSchlick(l.f0, wo.z))
+			fi := maxComponent(fresnelSchlick(l.f0, wi.z))
+			f = f.Add(l.base.MultF(l.diffuse * (1 - fo) * (1 - fi) * wi.z / math.Pi))
+			pdf += l.pick[0] * wi.z / math.Pi
+		}
+		if l.specular > 0 {
+			fs, p := l.spec.evalReflection(wo, wi, l.f0)
+			f = f.Add(fs.MultF(l.specular))
+			pdf += l.pick[1] * p
+		}
+	}
+	if l.transmit > 0 {
+		ft, p := l.spec.evalDielectric(wo, wi, l.eta)
+		tint := NewVec3(1, 1, 1)
+		if wi.z < 0 {
+			tint = l.base
+		}
+		f = f.Add(tint.MultF(ft * l.transmit))
+		pdf += l.pick[2] * p
+	}
+	if l.clearcoat > 0 {
+		// layers below the clearcoat only get the light it transmits
+		f = f.MultF(1 - l.clearcoat*fresnelSchlick(NewVec3(0.04, 0.04, 0.04), wo.z).x)
+		if wi.z > 0 {
+			fc, p := l.coat.evalReflection(wo, wi, NewVec3(0.04, 0.04, 0.04))
+			f = f.Add(fc.MultF(l.clearcoat))
+			pdf += l.pick[3] * p
+		}
+	}
+	return f, pdf
+}
+
+func (m Principled) albedo(rec *HitRecord) Vec3 {
+	return m.BaseColor.Value(rec.U, rec.V, rec.P)
+}
+
+func (m Principled) Emitted(rec *HitRecord, wo Vec3) Vec3 {
+	return NewVec3(0, 0, 0)
+}
+
+func (m Principled) Sample(rec *HitRecord, wo Vec3, rng *rand.Rand) (BSDFSample, bool) {
+	frame := shadingFrame(rec)
+	wo_local := frame.ToLocal(wo)
+	if wo_local.z <= 0 {
+		return BSDFSample{}, false
+	}
+	l := m.lobes(rec, wo_local)
+
+	var wi Vec3
+	u := randFloat(rng)
+	switch {
+	case u < l.pick[0]:
+		wi = RandomCosineDirection(randFloat(rng), randFloat(rng))
+	case u < l.pick[0]+l.pick[1]:
+		wi = reflect(wo_local, l.spec.sampleVisible(wo_local, randFloat(rng), randFloat(rng)))
+	case u < l.pick[0]+l.pick[1]+l.pick[2]:
+		bs, ok := l.spec.sampleDielectric(wo_local, l.eta, randFloat(rng), randFloat(rng), randFloat(rng))
+		if !ok {
+			return BSDFSample{}, false
+		}
+		wi = bs.Wi
+	default:
+		wi = reflect(wo_local, l.coat.sampleVisible(wo_local, randFloat(rng), randFloat(rng)))
+	}
+	if wi.z == 0 {
+		return BSDFSample{}, false
+	}
+	f, pdf := l.eval(wo_local, wi)
+	if pdf == 0 {
+		return BSDFSample{}, false
+	}
+	return BSDFSample{Wi: frame.Local(wi), F: f, Pdf: pdf}, true
+}
+
+func (m Principled) Eval(rec *HitRecord, wo, wi Vec3) Vec3 {
+	frame := shadingFrame(rec)
+	wo_local := frame.ToLocal(wo)
+	l := m.lobes(rec, wo_local)
+	f, _ := l.eval(wo_local, frame.ToLocal(wi))
+	return f
+}
+
+func (m Principled) Pdf(rec *HitRecord, wo, wi Vec3) float32 {
+	frame := shadingFrame(rec)
+	wo_local := frame.ToLocal(wo)
+	l := m.lobes(rec, wo_local)
+	_, pdf := l.eval(wo_local, frame.ToLocal(wi))
+	return pdf
+}
@@ -0,0 +1,201 @@
+package raytrace
+
+import (
+	"context"
+	"image"
+	"image/png"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Integrator computes the light arriving along a camera ray, ie. RayColorNEE.
+type Integrator func(r *Ray, scene *Scene, rng *rand.Rand) Vec3
+
+// Snapshot is the state of a progressive render after a pass. It is a
+// copy owned by the receiver, the renderer never touches it again.
+type Snapshot struct {
+	Pass    int // passes completed, counting from 1
+	Samples int // samples per pixel so far
+	Elapsed time.Duration
+	Final   bool // the last snapshot, also sent when interrupted
+	Image   *HDRImage
+}
+
+// RGBA converts the snapshot like Film.Image() does.
+func (s *Snapshot) RGBA() *image.RGBA {
+	return ToRGBA(s.Image)
+}
+
+// Progressive sets up RenderProgressive.
+type Progressive struct {
+	Passes         int
+	SamplesPerPass int        // 0 is 1
+	Integrator     Integrator // nil is RayColorNEE
+	Seed           int64      // renders with the same seed take the same samples
+
+	// OnSnapshot is called after every pass, in order and from a single
+	// goroutine. Rendering goes on meanwhile but waits when the callback
+	// falls more than a pass behind.
+	OnSnapshot func(s *Snapshot)
+
+	// Snapshots are written to Path as PNG when set, at most once per
+	// WriteInterval apart from the final one. A failed write stops the
+	// render, its error is in RenderResult.Err.
+	Path          string
+	WriteInterval time.Duration
+
+	// The film is saved to Checkpoint when set, at most once per
+	// CheckpointInterval and always when the render stops, see
+	// ResumeProgressive. A failed save stops the render, its error is in
+	// RenderResult.Err.
+	Checkpoint         string
+	CheckpointInterval time.Duration
+}
+
+func (p Progressive) samplesPerPass() int {
+	if p.SamplesPerPass <= 0 {
+		return 1
+	}
+	return p.SamplesPerPass
+}
+
+// RenderProgressive renders passes of SamplesPerPass samples into film,
+// emitting a Snapshot after each of them. Use an empty film when saving
+// checkpoints.
+func RenderProgressive(ctx context.Context, cam Camera, scene *Scene, film *Film, p Progressive) RenderResult {
+	return p.render(ctx, cam, scene, film, 0, false)
+}
+
+// ResumeProgressive continues the render saved in checkpoint with the
+// same camera resolution, Seed and SamplesPerPass. The result is the same
+// as the one of a render which was never interrupted.
+func ResumeProgressive(ctx context.Context, cam Camera, scene *Scene, checkpoint *Checkpoint, p Progressive) RenderResult {
+	film := checkpoint.Film
+	if film.Width != cam.Width || film.Height != cam.Height ||
+		checkpoint.Seed != p.Seed || checkpoint.SamplesPerPass != p.samplesPerPass() {
+		return RenderResult{film, 0, errCheckpointMismatch}
+	}
+	return p.render(ctx, cam, scene, film, checkpoint.Pass, true)
+}
+
+// render continues after the given number of passes, resuming one which
+// may have been interrupted in the middle of the next pass
+func (p Progressive) render(ctx context.Context, cam Camera, scene *Scene, film *Film, passes_done int, resume bool) RenderResult {
+	integrator := p.Integrator
+	if integrator == nil {
+		integrator = RayColorNEE
+	}
+	spp := p.samplesPerPass()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	snapshots := make(chan *Snapshot, 1)
+	delivered := make(chan struct{})
+	var write_err error
+	go func() {
+		defer close(delivered)
+		write_err = p.deliver(snapshots, cancel)
+	}()
+
+	before := film.totalSamples()
+	planned := (p.Passes - passes_done) * spp * cam.Width * cam.Height
+	start := time.Now()
+	var last_checkpoint time.Time
+	var err error
+	pass := passes_done + 1
+	for ; pass <= p.Passes; pass++ {
+		samples := func(x, y int) int { return spp }
+		if resume && pass == passes_done+1 {
+			// rows of an interrupted pass are either done or untouched
+			samples = func(x, y int) int {
+				if film.Samples(x, y) >= pass*spp {
+					return 0
+				}
+				return spp
+			}
+		}
+		err = renderPass(ctx, cam, scene, film, image.Point{}, integrator, samples, passSeed(p.Seed, pass))
+		if err != nil { // with a part of the pass rendered
+			if p.Checkpoint != "" {
+				if save_err := p.checkpoint(film, pass-1); save_err != nil {
+					err = save_err
+				}
+			}
+			snapshots <- &Snapshot{pass - 1, (pass - 1) * spp, time.Since(start), true, film.Beauty()}
+			break
+		}
+		if p.Checkpoint != "" && (pass == p.Passes || time.Since(last_checkpoint) >= p.CheckpointInterval) {
+			err = p.checkpoint(film, pass)
+			last_checkpoint = time.Now()
+		}
+		snapshots <- &Snapshot{pass, pass * spp, time.Since(start), pass == p.Passes || err != nil, film.Beauty()}
+		if err != nil {
+			break
+		}
+	}
+	close(snapshots)
+	<-delivered
+	if write_err != nil && (err == nil || err == context.Canceled) {
+		err = write_err
+	}
+	return renderResult(film, before, planned, err)
+}
+
+func (p Progressive) checkpoint(film *Film, pass int) error {
+	c := &Checkpoint{Pass: pass, Seed: p.Seed, SamplesPerPass: p.samplesPerPass(), Film: film}
+	return SaveCheckpoint(p.Checkpoint, c)
+}
+
+// Seed of the random generators of a pass
+func passSeed(seed int64, pass int) int64 {
+	return int64(splitmix(uint64(seed) + uint64(pass)*0x9e3779b97f4a7c15))
+}
+
+// deliver hands the snapshots to OnSnapshot and writes them to Path. The
+// first failed write stops the render with stop and is returned, the
+// remaining snapshots are not written.
+func (p Progressive) deliver(snapshots <-chan *Snapshot, stop func()) error {
+	var last_write time.Time
+	var err error
+	for s := range snapshots {
+		if p.OnSnapshot != nil {
+			p.OnSnapshot(s)
+		}
+		if p.Path != "" && err == nil && (s.Final || time.Since(last_write) >= p.WriteInterval) {
+			if err = writePNG(p.Path, s.RGBA()); err != nil {
+				stop()
+			}
+			last_write = time.Now()
+		}
+	}
+	return err
+}
+
+// writePNG replaces path atomically, viewers never see a partial file.
+func writePNG(path string, img image.Image) error {
+	return replaceFile(path, func(w io.Writer) error {
+		return png.Encode(w, img)
+	})
+}
+
+// replaceFile writes a temporary file next to path and renames it to path
+// once complete.
+func replaceFile(path string, write func(w io.Writer) error) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	if err := write(f); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
@@ -8,14 +8,32 @@
 package raytrace
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
 	"fmt"
 	"testing"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
 	"math"
+	"math/rand"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
 )
 
 func TestRay1(t *testing.T) {
-	r := Ray{NewVec3(0, 0, 0), NewVec3(1, 2, 3)}
+	r := NewRay(NewVec3(0, 0, 0), NewVec3(1, 2, 3))
 	want := float32(2.0)
 	if r.Dir.At(1) != want {
 		t.Errorf(" %v != %v", r.Dir.At(2), want)
@@ -136,35 +154,35 @@ func TestVecOther(t *testing.T) {
 
 
 func TestAABB(t *testing.T) {
-	r := Ray{NewVec3(0, 0, -2), NewVec3(0,0,1)}
+	r := NewRay(NewVec3(0, 0, -2), NewVec3(0,0,1))
 	aabb := NewAABB(NewVec3(-1,-1, -0.0001), NewVec3(1,1, 0.0001)) // a plane infinitly small in Z
 	want := true
 	result := aabb.HitOptimized(r, math.Inf(-1), math.Inf(1))
 	if  result != want {
 		t.Errorf(" %v != %v", result, want)
 	}
-	r = Ray{NewVec3(0, 2, -2), NewVec3(0,0,1)}
+	r = NewRay(NewVec3(0, 2, -2), NewVec3(0,0,1))
 	want = false
 	result = aabb.HitOptimized(r, math.Inf(-1), math.Inf(1))
 	if  result != want {
 		t.Errorf(" %v != %v", result, want)
 	}
 
-	r = Ray{NewVec3(0.9999, 0.9999, -2), NewVec3(0,0,1)}
+	r = NewRay(NewVec3(0.9999, 0.9999, -2), NewVec3(0,0,1))
 	want = true
 	result = aabb.HitOptimized(r, math.Inf(-1), math.Inf(1))
 	if  result != want {
 		t.Errorf(" %v != %v", result, want)
 	}
 
-	r = Ray{NewVec3(1.0, 1.0, -2), NewVec3(0,0,1)}
+	r = NewRay(NewVec3(1.0, 1.0, -2), NewVec3(0,0,1))
 	want = true
 	result = aabb.HitOptimized(r, math.Inf(-1), math.Inf(1))
 	if  result != want {
 		t.Errorf(" %v != %v", result, want)
 	}
 	
-	r = Ray{NewVec3(1.000001, 0.9999, -2), NewVec3(0,0,1)}
+	r = NewRay(NewVec3(1.000001, 0.9999, -2), NewVec3(0,0,1))
 	want = false
 	result = aabb.HitOptimized(r, math.Inf(-1), math.Inf(1))
 	if  result != want {
@@ -320,7 +338,7 @@ func TestBVHHit(t *testing.T) {
 		Sphere{NewVec3(0,0,3), 1.0})
 	bvh := NewBVHSplit(objects,0,len(objects))
 	ray := NewRay(NewVec3(0,0,-1), NewVec3(0,0,1))
-	rec := HitRecord{NewVec3(0,0,0), NewVec3(0,0,0), 1.0, true, -1}
+	rec := NewHitRecord()
 	bvh.Hit(&ray,0, float32(math.Inf(1.0)), &rec)
 	if rec.T != 1.0 {
 		t.Errorf("ray %v does not hit sphere %v", ray, objects[0])
@@ -345,3 +363,2472 @@ func TestBVHHit(t *testing.T) {
 	}
 
 }
+
+func TestDynamicBVH(t *testing.T) {
+	var objects []Hittable
+	for i := 0; i < 16; i++ {
+		objects = append(objects, Sphere{NewVec3(float32(i), 0, -5), 0.4})
+	}
+	bvh := NewDynamicBVH(objects)
+	if bvh.Quality() != 1 {
+		t.Errorf("fresh tree quality %v != 1", bvh.Quality())
+	}
+
+	ray := NewRay(NewVec3(3, 0, 0), NewVec3(0, 0, -1))
+	rec := NewHitRecord()
+	if !bvh.Hit(&ray, 0, float32(math.Inf(1.0)), &rec) || rec.ObjectId != 3 {
+		t.Errorf("expected to hit object 3, got %v", rec.ObjectId)
+	}
+
+	// move the sphere out of the way and refit
+	bvh.Update(3, Sphere{NewVec3(3, 10, -5), 0.4})
+	if bvh.Hit(&ray, 0, float32(math.Inf(1.0)), &rec) {
+		t.Errorf("moved sphere should not be hit, got %v", rec.ObjectId)
+	}
+	// a new sphere in its place gets a new handle
+	id := bvh.Insert(Sphere{NewVec3(3, 0, -2), 0.4})
+	if !bvh.Hit(&ray, 0, float32(math.Inf(1.0)), &rec) || rec.ObjectId != id {
+		t.Errorf("expected to hit inserted object %v, got %v", id, rec.ObjectId)
+	}
+	if !bvh.Remove(id) || bvh.Remove(id) {
+		t.Errorf("remove should succeed only once")
+	}
+	if bvh.Len() != 16 {
+		t.Errorf("%v != 16", bvh.Len())
+	}
+
+	// scatter objects far apart with updates - the tree degrades
+	for i := 0; i < 16; i++ {
+		bvh.Update(i, Sphere{NewVec3(float32(i%4)*10, float32((i*7)%16)*7, -5), 0.4})
+	}
+	if !bvh.NeedsRebuild(1.01) {
+		t.Errorf("expected degraded tree, quality %v", bvh.Quality())
+	}
+	bvh.Rebuild()
+	if bvh.Quality() != 1 {
+		t.Errorf("rebuilt tree quality %v != 1", bvh.Quality())
+	}
+
+	// the tree agrees with the flat list
+	world := HittableList{}
+	for i := 0; i < 16; i++ {
+		object, _ := bvh.Object(i)
+		world.Objects = append(world.Objects, object)
+	}
+	for i := 0; i < 16; i++ {
+		ray = NewRay(NewVec3(float32(i%4)*10, float32((i*7)%16)*7, 10), NewVec3(0, 0, -1))
+		rec_list := NewHitRecord()
+		hit_list := world.Hit(&ray, 0, float32(math.Inf(1.0)), &rec_list)
+		hit_bvh := bvh.Hit(&ray, 0, float32(math.Inf(1.0)), &rec)
+		if hit_list != hit_bvh || rec.ObjectId != rec_list.ObjectId {
+			t.Errorf("ray %v: list %v %v, bvh %v %v", i, hit_list, rec_list.ObjectId, hit_bvh, rec.ObjectId)
+		}
+	}
+}
+
+func TestTransform(t *testing.T) {
+	xform := NewScale(NewVec3(2, 2, 2)).Then(NewRotate(NewVec3(0, 1, 0), 90)).Then(NewTranslate(NewVec3(1, 0, 0)))
+	p := xform.Point(NewVec3(1, 0, 0)) // scale -> (2,0,0), rotate -> (0,0,-2), translate -> (1,0,-2)
+	want := NewVec3(1, 0, -2)
+	if p.Subtr(want).Length() > 1e-5 {
+		t.Errorf(" %v != %v", p, want)
+	}
+	back := xform.Inverse().Point(p)
+	if back.Subtr(NewVec3(1, 0, 0)).Length() > 1e-5 {
+		t.Errorf(" %v != %v", back, NewVec3(1, 0, 0))
+	}
+	m, ok := NewTransform(xform.Matrix())
+	if !ok || m.Inverse().Point(p).Subtr(back).Length() > 1e-5 {
+		t.Errorf("inverse of matrix does not match")
+	}
+}
+
+func TestInstances(t *testing.T) {
+	// unit quad in XY plane facing +Z, shared by all instances
+	quad := NewMesh(
+		[]Vec3{NewVec3(-0.5, -0.5, 0), NewVec3(0.5, -0.5, 0), NewVec3(0.5, 0.5, 0), NewVec3(-0.5, 0.5, 0)},
+		[]int{0, 1, 2, 0, 2, 3})
+	blas := NewDynamicBVH(quad)
+
+	var instances []*Instance
+	for i := 0; i < 5; i++ {
+		xform := NewTranslate(NewVec3(float32(i)*2, 0, -1))
+		instances = append(instances, NewInstance(blas, xform, 100+i))
+	}
+	// last one is scaled up and turned to face +X
+	instances[4].Xform = NewScale(NewVec3(4, 4, 4)).Then(NewRotate(NewVec3(0, 1, 0), 90)).Then(NewTranslate(NewVec3(0, 0, -10)))
+	tlas := NewTLAS(instances)
+
+	rec := NewHitRecord()
+	ray := NewRay(NewVec3(4.2, 0.3, 5), NewVec3(0, 0, -1))
+	if !tlas.Hit(&ray, 0, float32(math.Inf(1.0)), &rec) {
+		t.Fatalf("ray %v missed", ray)
+	}
+	if rec.InstanceId != 102 || rec.ObjectId != 1 || rec.T != 6 {
+		t.Errorf("instance %v object %v t %v, want 102 1 6", rec.InstanceId, rec.ObjectId, rec.T)
+	}
+	if !rec.FrontFace || rec.Normal.Subtr(NewVec3(0, 0, 1)).Length() > 1e-5 {
+		t.Errorf("normal %v front %v", rec.Normal, rec.FrontFace)
+	}
+
+	// rotated instance, hit from +X, spans -2..2 along Z around -10
+	ray = NewRay(NewVec3(5, 1.5, -11.5), NewVec3(-1, 0, 0))
+	rec = NewHitRecord()
+	if !tlas.Hit(&ray, 0, float32(math.Inf(1.0)), &rec) || rec.InstanceId != 104 {
+		t.Fatalf("expected to hit the rotated instance, got %v", rec.InstanceId)
+	}
+	if rec.Normal.Subtr(NewVec3(1, 0, 0)).Length() > 1e-5 || math.Abs(float64(rec.T-5)) > 1e-5 {
+		t.Errorf("normal %v t %v", rec.Normal, rec.T)
+	}
+
+	// plain objects in a list still get the list index
+	world := HittableList{}
+	world.Add(Sphere{NewVec3(0, 0, -50), 1})
+	world.Add(instances[2])
+	ray = NewRay(NewVec3(0, 0, 0), NewVec3(0, 0, -1))
+	rec = NewHitRecord()
+	if !world.Hit(&ray, 0, float32(math.Inf(1.0)), &rec) || rec.ObjectId != 0 || rec.InstanceId != -1 {
+		t.Errorf("object %v instance %v", rec.ObjectId, rec.InstanceId)
+	}
+
+	// an instance hit first, then a closer plain object, must not leave
+	// the InstanceId behind
+	objects := []Hittable{NewInstance(blas, NewTranslate(NewVec3(0, 0, -10)), 7), Sphere{NewVec3(0, 0, -3), 1}}
+	containers := map[string]Hittable{
+		"list":    &HittableList{objects},
+		"dynamic": NewDynamicBVH(objects),
+		"grid":    NewGrid(objects, 0),
+		"kdtree":  NewKdTree(objects),
+	}
+	for name, container := range containers {
+		rec = NewHitRecord()
+		if !container.Hit(&ray, 0, float32(math.Inf(1.0)), &rec) || rec.T != 2 || rec.ObjectId != 1 || rec.InstanceId != -1 {
+			t.Errorf("%s: t %v object %v instance %v, want 2 1 -1", name, rec.T, rec.ObjectId, rec.InstanceId)
+		}
+	}
+}
+
+func TestBareShapeAfterLight(t *testing.T) {
+	// the light is hit first, the bare sphere in front of it must not keep
+	// its material
+	light := RectLight{Quad{NewVec3(-1, -1, -5), NewVec3(2, 0, 0), NewVec3(0, 2, 0)}, NewVec3(10, 10, 10)}
+	objects := []Hittable{light, Surface{Sphere{NewVec3(0, 0, -4), 0.5}, Lambertian{SolidColor{NewVec3(1, 1, 1)}}}, Sphere{NewVec3(0, 0, -2), 0.5}}
+	copied := append([]Hittable{}, objects...)
+	containers := map[string]Hittable{
+		"list":     &HittableList{objects},
+		"bvh_node": NewBVHSplit(copied, 0, len(copied)),
+		"dynamic":  NewDynamicBVH(objects),
+		"grid":     NewGrid(objects, 0),
+		"kdtree":   NewKdTree(objects),
+	}
+	ray := NewRay(NewVec3(0, 0, 0), NewVec3(0, 0, -1))
+	for name, container := range containers {
+		// a record left over from an earlier hit
+		rec := NewHitRecord()
+		rec.Mat, rec.Light = DiffuseLight{Emit: NewVec3(1, 1, 1)}, light
+		if !container.Hit(&ray, 0, float32(math.Inf(1.0)), &rec) || rec.T != 1.5 || rec.Mat != nil || rec.Light != nil {
+			t.Errorf("%s: t %v material %v light %v", name, rec.T, rec.Mat, rec.Light)
+		}
+		scene := &Scene{World: container, Lights: []Light{light}}
+		if c := RayColorNEE(&ray, scene, rand.New(rand.NewSource(1))); c != NewVec3(0, 0, 0) {
+			t.Errorf("%s: bare sphere shaded %v", name, c)
+		}
+	}
+	rays := make([]Ray, PacketSize)
+	for i := range rays {
+		rays[i] = NewRay(NewVec3(0, 0, 0), NewVec3(float32(i)*0.01, 0, -1))
+	}
+	recs := make([]HitRecord, len(rays))
+	hits := make([]bool, len(rays))
+	TraceRays(NewDynamicBVH(objects), rays, 0, float32(math.Inf(1.0)), recs, hits)
+	for i := range rays {
+		if !hits[i] || recs[i].Mat != nil || recs[i].Light != nil {
+			t.Errorf("packet lane %d: hit %v material %v light %v", i, hits[i], recs[i].Mat, recs[i].Light)
+		}
+	}
+}
+
+// field of same sized spheres used by the accelerator tests and benchmarks
+func sphereField(n int) []Hittable {
+	var objects []Hittable
+	for i := 0; i < n; i++ {
+		for j := 0; j < n; j++ {
+			x := float32(i-n/2) * 0.5
+			z := -2 - float32(j)*0.5
+			y := float32((i*7+j*3)%5) * 0.1
+			objects = append(objects, Sphere{NewVec3(x, y, z), 0.2})
+		}
+	}
+	return objects
+}
+
+func TestAccelerators(t *testing.T) {
+	objects := sphereField(12)
+	world := HittableList{objects}
+	accels := map[string]Hittable{
+		"dynamic": NewDynamicBVH(objects),
+		"grid":    NewGrid(objects, 0),
+		"kdtree":  NewKdTree(objects),
+	}
+	cam := NewCamera(NewVec3(0, 2, 2), NewVec3(0, 0, -4), 48)
+	for name, accel := range accels {
+		for j := 0; j < cam.Height; j++ {
+			for i := 0; i < cam.Width; i++ {
+				ray := cam.GetRay(float32(i)/float32(cam.Width-1), float32(j)/float32(cam.Height-1))
+				want := NewHitRecord()
+				got := NewHitRecord()
+				hit_want := world.Hit(&ray, 0, float32(math.Inf(1.0)), &want)
+				hit_got := accel.Hit(&ray, 0, float32(math.Inf(1.0)), &got)
+				if hit_want != hit_got || want.ObjectId != got.ObjectId || want.T != got.T {
+					t.Fatalf("%v: pixel %v,%v list %v %v %v, got %v %v %v", name, i, j,
+						hit_want, want.ObjectId, want.T, hit_got, got.ObjectId, got.T)
+				}
+			}
+		}
+	}
+}
+
+// Renders the same scene through every accelerator and reports rays/s:
+// go test -run XXX -bench Accelerators
+func BenchmarkAccelerators(b *testing.B) {
+	objects := sphereField(24)
+	copied := append([]Hittable{}, objects...) // NewBVHSplit sorts in place
+	accels := []struct {
+		name  string
+		accel Hittable
+	}{
+		{"list", HittableList{objects}},
+		{"bvh_node", NewBVHSplit(copied, 0, len(copied))},
+		{"dynamic_bvh", NewDynamicBVH(objects)},
+		{"grid", NewGrid(objects, 0)},
+		{"kdtree", NewKdTree(objects)},
+	}
+	cam := NewCamera(NewVec3(0, 2, 2), NewVec3(0, 0, -4), 64)
+	for _, a := range accels {
+		b.Run(a.name, func(b *testing.B) {
+			rays := 0
+			start := time.Now()
+			for n := 0; n < b.N; n++ {
+				for j := 0; j < cam.Height; j++ {
+					for i := 0; i < cam.Width; i++ {
+						ray := cam.GetRay(float32(i)/float32(cam.Width-1), float32(j)/float32(cam.Height-1))
+						RayColor(&ray, a.accel)
+						rays++
+					}
+				}
+			}
+			b.ReportMetric(float64(rays)/time.Since(start).Seconds(), "rays/s")
+		})
+	}
+}
+
+// Brute force reference for the slab test, in float64 with explicit
+// handling of zero direction components.
+func slabReference(box AABB, r Ray, t_min, t_max float64) bool {
+	for a := 0; a < 3; a++ {
+		o := float64(r.Orig.At(a))
+		d := float64(r.Dir.At(a))
+		lo, hi := float64(box.Min().At(a)), float64(box.Max().At(a))
+		if d == 0 {
+			if o < lo || o > hi {
+				return false
+			}
+			continue
+		}
+		t0, t1 := (lo-o)/d, (hi-o)/d
+		if t0 > t1 {
+			t0, t1 = t1, t0
+		}
+		t_min = math.Max(t_min, t0)
+		t_max = math.Min(t_max, t1)
+	}
+	return t_min <= t_max
+}
+
+func TestSlabEdgeCases(t *testing.T) {
+	box := NewAABB(NewVec3(-1, -1, -1), NewVec3(1, 1, 1))
+	inf := float32(math.Inf(1))
+	cases := []struct {
+		orig, dir Vec3
+		want      bool
+	}{
+		{NewVec3(0, 0, -5), NewVec3(0, 0, 1), true},    // axis parallel through the middle
+		{NewVec3(1, 0, -5), NewVec3(0, 0, 1), true},    // in the plane of a face
+		{NewVec3(1, 1, -5), NewVec3(0, 0, 1), true},    // along an edge
+		{NewVec3(-1, -1, -5), NewVec3(0, 0, 1), true},  // along the opposite edge
+		{NewVec3(1.0001, 0, -5), NewVec3(0, 0, 1), false},
+		{NewVec3(-2, 0, 1), NewVec3(1, 0, 0), true},    // grazing the top face
+		{NewVec3(0, -2, 0), NewVec3(1, 1, 0), true},    // touching an edge only
+		{NewVec3(0, -2.001, 0), NewVec3(1, 1, 0), false},
+		{NewVec3(0, 0, 0), NewVec3(0, 0, 0), true},     // degenerate direction, origin inside
+		{NewVec3(0, 0, 5), NewVec3(0, 0, 1), false},    // box behind the ray
+		{NewVec3(0, 0, 5), NewVec3(0, 0, -0.0), false}, // negative zero
+		{NewVec3(0, 0, 0), NewVec3(0, -1, 0), true},    // origin inside
+	}
+	for i, c := range cases {
+		r := NewRay(c.orig, c.dir)
+		if got := box.HitSlab(&r, 0, inf); got != c.want {
+			t.Errorf("case %v: %v != %v", i, got, c.want)
+		}
+		if ref := slabReference(box, r, 0, math.Inf(1)); ref != c.want {
+			t.Errorf("case %v: reference %v != %v", i, ref, c.want)
+		}
+	}
+}
+
+// Property test: the slab test agrees with the reference. Values are drawn
+// from a small set so that axis parallel rays and origins exactly on faces
+// are common. The fast test is allowed to be conservative only for rays
+// which miss the box by a rounding error, checked with a slightly grown box.
+func TestSlabProperty(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	pick := func() float32 {
+		values := []float32{-2, -1, -0.5, 0, 0.5, 1, 2}
+		if rng.Intn(3) == 0 {
+			return rng.Float32()*6 - 3
+		}
+		return values[rng.Intn(len(values))]
+	}
+	vec := func() Vec3 { return NewVec3(pick(), pick(), pick()) }
+	grow := func(b AABB, eps float32) AABB {
+		return NewAABB(b.Min().SubtrF(eps), b.Max().AddF(eps))
+	}
+	for i := 0; i < 200000; i++ {
+		lo, hi := vec(), vec()
+		box := Surrounding_box(NewAABB(lo, lo), NewAABB(hi, hi))
+		r := NewRay(vec(), vec())
+		t_max := float32(math.Inf(1))
+		if rng.Intn(2) == 0 {
+			t_max = rng.Float32() * 4
+		}
+
+		got := box.HitSlab(&r, 0, t_max)
+		want := slabReference(box, r, 0, float64(t_max))
+		if got == want {
+			continue
+		}
+		if got && !want && slabReference(grow(box, 1e-5), r, 0, float64(t_max)*(1+1e-5)) {
+			continue // conservative near miss
+		}
+		t.Fatalf("box %v ray %v %v t_max %v: slab %v reference %v", box, r.Orig, r.Dir, t_max, got, want)
+	}
+}
+
+// primary rays ordered by 4x2 pixel tiles so each packet is coherent
+func tileRays(cam Camera) []Ray {
+	var rays []Ray
+	for ty := 0; ty < cam.Height; ty += 2 {
+		for tx := 0; tx < cam.Width; tx += 4 {
+			for j := ty; j < ty+2; j++ {
+				for i := tx; i < tx+4; i++ {
+					u := float32(i) / float32(cam.Width-1)
+					v := float32(j) / float32(cam.Height-1)
+					rays = append(rays, cam.GetRay(u, v))
+				}
+			}
+		}
+	}
+	return rays
+}
+
+func TestPacketTraversal(t *testing.T) {
+	objects := sphereField(12)
+	bvh := NewDynamicBVH(objects)
+	cam := NewCamera(NewVec3(0, 2, 2), NewVec3(0, 0, -4), 64)
+	rays := tileRays(cam)
+	// an incoherent packet at the end, falls back to scalar traversal
+	rays = append(rays, NewRay(NewVec3(0, 0, 0), NewVec3(0, 0, -1)), NewRay(NewVec3(0, 0, -10), NewVec3(0, 0, 1)))
+
+	recs := make([]HitRecord, len(rays))
+	hits := make([]bool, len(rays))
+	TraceRays(bvh, rays, 0, float32(math.Inf(1.0)), recs, hits)
+	for i := range rays {
+		rec := NewHitRecord()
+		hit := bvh.Hit(&rays[i], 0, float32(math.Inf(1.0)), &rec)
+		if hit != hits[i] || (hit && (rec.T != recs[i].T || rec.ObjectId != recs[i].ObjectId)) {
+			t.Fatalf("ray %v: scalar %v %v %v, packet %v %v %v", i, hit, rec.ObjectId, rec.T, hits[i], recs[i].ObjectId, recs[i].T)
+		}
+		// the record of a packet before must not leak into a lane which missed
+		if !hit && recs[i] != NewHitRecord() {
+			t.Fatalf("ray %v missed with record %+v", i, recs[i])
+		}
+	}
+}
+
+// go test -run XXX -bench Primary
+func BenchmarkPrimaryScalar(b *testing.B) {
+	bvh := NewDynamicBVH(sphereField(24))
+	rays := tileRays(NewCamera(NewVec3(0, 2, 2), NewVec3(0, 0, -4), 128))
+	rec := NewHitRecord()
+	for n := 0; n < b.N; n++ {
+		for i := range rays {
+			bvh.Hit(&rays[i], 0, float32(math.Inf(1.0)), &rec)
+		}
+	}
+}
+
+func BenchmarkPrimaryPacket(b *testing.B) {
+	bvh := NewDynamicBVH(sphereField(24))
+	rays := tileRays(NewCamera(NewVec3(0, 2, 2), NewVec3(0, 0, -4), 128))
+	recs := make([]HitRecord, len(rays))
+	hits := make([]bool, len(rays))
+	for n := 0; n < b.N; n++ {
+		TraceRays(bvh, rays, 0, float32(math.Inf(1.0)), recs, hits)
+	}
+}
+
+func TestOccluded(t *testing.T) {
+	objects := sphereField(8)
+	objects = append(objects, Triangle{NewVec3(-5, -0.3, 0), NewVec3(5, -0.3, 0), NewVec3(0, -0.3, -10)})
+	copied := append([]Hittable{}, objects...)
+	worlds := map[string]Hittable{
+		"list":     HittableList{objects},
+		"bvh_node": NewBVHSplit(copied, 0, len(copied)),
+		"dynamic":  NewDynamicBVH(objects),
+		"grid":     NewGrid(objects, 0),
+		"kdtree":   NewKdTree(objects),
+		"instance": NewInstance(NewDynamicBVH(objects), NewIdentity(), 0),
+	}
+	rng := rand.New(rand.NewSource(2))
+	for name, world := range worlds {
+		for i := 0; i < 2000; i++ {
+			orig := NewVec3(rng.Float32()*6-3, rng.Float32()*2-0.5, rng.Float32()*-6)
+			ray := NewRay(orig, UniformSampleSphere(rng.Float32(), rng.Float32()))
+			t_max := rng.Float32() * 3
+			rec := NewHitRecord()
+			want := world.Hit(&ray, rayEpsilon, t_max, &rec)
+			if got := world.Occluded(&ray, rayEpsilon, t_max); got != want {
+				t.Fatalf("%v: ray %v t_max %v: occluded %v hit %v", name, ray, t_max, got, want)
+			}
+		}
+	}
+}
+
+func TestAmbientOcclusion(t *testing.T) {
+	world := HittableList{[]Hittable{Sphere{NewVec3(0, 0, -5), 1}}}
+	rng := rand.New(rand.NewSource(3))
+
+	// isolated sphere seen from outside - nothing blocks
+	ray := NewRay(NewVec3(0, 0, 0), NewVec3(0, 0, -1))
+	if ao := RayColorAO(&ray, world, 64, 100, rng); ao.At(0) != 1 {
+		t.Errorf("ao %v != 1", ao.At(0))
+	}
+	// inside the sphere every direction is blocked
+	ray = NewRay(NewVec3(0, 0, -5), NewVec3(0, 0, -1))
+	if ao := RayColorAO(&ray, world, 64, 100, rng); ao.At(0) != 0 {
+		t.Errorf("ao %v != 0", ao.At(0))
+	}
+}
+
+func TestDeltaLights(t *testing.T) {
+	albedo := float32(0.8)
+	floor := Surface{Quad{NewVec3(-10, 0, 10), NewVec3(20, 0, 0), NewVec3(0, 0, -20)}, Lambertian{SolidColor{NewVec3(albedo, albedo, albedo)}}}
+	scene := &Scene{World: HittableList{[]Hittable{floor}}, MaxDepth: 1}
+	down := NewRay(NewVec3(0, 1, 0), NewVec3(0, -1, 0))
+	close := func(a, b float32) bool { return math.Abs(float64(a-b)) < 1e-4*math.Max(1, math.Abs(float64(b))) }
+
+	// point light 2 units above the floor: L = albedo/Pi * I/h^2
+	scene.Lights = []Light{PointLight{NewVec3(0, 2, 0), NewVec3(10, 10, 10)}}
+	want := albedo / math.Pi * 10 / 4
+	if got := RayColorPath(&down, scene, nil); !close(got.At(0), want) {
+		t.Errorf("point light %v != %v", got.At(0), want)
+	}
+
+	// spot pointing down, the shading point is on its axis
+	spot := SpotLight{NewVec3(0, 2, 0), NewVec3(0, -1, 0), NewVec3(10, 10, 10), 30, 5}
+	scene.Lights = []Light{spot}
+	if got := RayColorPath(&down, scene, nil); !close(got.At(0), want) {
+		t.Errorf("spot light %v != %v", got.At(0), want)
+	}
+	// turned away by 90 degrees - dark
+	spot.Direction = NewVec3(1, 0, 0)
+	scene.Lights = []Light{spot}
+	if got := RayColorPath(&down, scene, nil); got.At(0) != 0 {
+		t.Errorf("spot light outside of the cone %v != 0", got.At(0))
+	}
+
+	// sun at 60 degrees from zenith: L = albedo/Pi * E * cos
+	sun := DirectionalLight{NewVec3(float32(math.Sin(math.Pi/3)), -float32(math.Cos(math.Pi/3)), 0), NewVec3(3, 3, 3)}
+	scene.Lights = []Light{sun}
+	want = albedo / math.Pi * 3 * 0.5
+	if got := RayColorPath(&down, scene, nil); !close(got.At(0), want) {
+		t.Errorf("directional light %v != %v", got.At(0), want)
+	}
+
+	// a blocker casts a shadow
+	scene.World = HittableList{[]Hittable{floor, Sphere{NewVec3(-1, 0.5, 0), 0.2}}}
+	scene.Lights = []Light{PointLight{NewVec3(-2, 1, 0), NewVec3(10, 10, 10)}}
+	if got := RayColorPath(&down, scene, nil); got.At(0) != 0 {
+		t.Errorf("shadowed point %v != 0", got.At(0))
+	}
+}
+
+func TestAreaLightSampling(t *testing.T) {
+	rng := rand.New(rand.NewSource(4))
+	p := NewVec3(0, 0, 0)
+	normal := NewVec3(0, 1, 0)
+
+	// irradiance from a sphere of radiance L: E = Pi * L * (r/d)^2
+	sphere := SphereLight{NewVec3(0, 4, 0), 1, NewVec3(2, 2, 2)}
+	rect := RectLight{Quad{NewVec3(-0.5, 3, -0.5), NewVec3(1, 0, 0), NewVec3(0, 0, 1)}, NewVec3(2, 2, 2)} // facing down
+	for name, light := range map[string]Light{"sphere": sphere, "rect": rect} {
+		var irradiance float64
+		n := 20000
+		for i := 0; i < n; i++ {
+			ls, ok := light.Sample(p, rng)
+			if !ok {
+				continue
+			}
+			// the pdf of the sampled direction agrees with Pdf()
+			if pdf := light.Pdf(p, ls.Wi); math.Abs(float64(pdf-ls.Pdf)) > 1e-2*float64(ls.Pdf) {
+				t.Fatalf("%v: pdf %v != %v", name, pdf, ls.Pdf)
+			}
+			irradiance += float64(ls.Li.At(0)*normal.Dot(ls.Wi)/ls.Pdf) / float64(n)
+		}
+		if name == "sphere" {
+			want := math.Pi * 2 / 16
+			if math.Abs(irradiance-want) > 0.01*want {
+				t.Errorf("sphere irradiance %v != %v", irradiance, want)
+			}
+		} else {
+			// E = L * integral of h^2 / (h^2 + x^2 + z^2)^2 over the square
+			want := 0.0
+			for i := 0; i < 100; i++ {
+				for j := 0; j < 100; j++ {
+					x, z := (float64(i)+0.5)/100-0.5, (float64(j)+0.5)/100-0.5
+					d2 := 9 + x*x + z*z
+					want += 2 * 9 / (d2 * d2) / 10000
+				}
+			}
+			if math.Abs(irradiance-want) > 0.01*want {
+				t.Errorf("rect irradiance %v != %v", irradiance, want)
+			}
+		}
+	}
+	// back side of the rect light is dark
+	if _, ok := rect.Sample(NewVec3(0, 5, 0), rng); ok {
+		t.Errorf("rect light sampled from behind")
+	}
+}
+
+// small area light facing down from the ceiling of a closed box
+func smallLightBox() *Scene {
+	white := Lambertian{SolidColor{NewVec3(0.7, 0.7, 0.7)}}
+	world := HittableList{}
+	for _, wall := range NewBox(NewVec3(-1, 0, -1), NewVec3(1, 2, 1)) {
+		world.Objects = append(world.Objects, Surface{wall, white})
+	}
+	light := RectLight{Quad{NewVec3(-0.25, 1.99, -0.25), NewVec3(0.5, 0, 0), NewVec3(0, 0, 0.5)}, NewVec3(10, 10, 10)}
+	world.Objects = append(world.Objects, light)
+	return &Scene{World: NewDynamicBVH(world.Objects), Lights: []Light{light}, MaxDepth: 4}
+}
+
+func TestNextEventEstimation(t *testing.T) {
+	scene := smallLightBox()
+	// looking at the floor from the middle of the box
+	ray := NewRay(NewVec3(0, 1, 0.5), NewVec3(0.2, -1, -0.3))
+
+	estimate := func(integrator func(*Ray, *Scene, *rand.Rand) Vec3, seed int64) (mean, variance float64) {
+		rng := rand.New(rand.NewSource(seed))
+		n := 20000
+		var sum, sum2 float64
+		for i := 0; i < n; i++ {
+			v := float64(integrator(&ray, scene, rng).At(0))
+			sum += v
+			sum2 += v * v
+		}
+		mean = sum / float64(n)
+		return mean, sum2/float64(n) - mean*mean
+	}
+	mean_naive, var_naive := estimate(RayColorPath, 5)
+	mean_nee, var_nee := estimate(RayColorNEE, 6)
+	t.Logf("naive %v (var %v), nee %v (var %v)", mean_naive, var_naive, mean_nee, var_nee)
+
+	// same answer...
+	sigma := math.Sqrt(var_naive/20000 + var_nee/20000)
+	if math.Abs(mean_naive-mean_nee) > 4*sigma {
+		t.Errorf("estimates differ: naive %v nee %v (sigma %v)", mean_naive, mean_nee, sigma)
+	}
+	// ...with much less noise per sample
+	if var_nee*10 > var_naive {
+		t.Errorf("variance did not drop: naive %v nee %v", var_naive, var_nee)
+	}
+
+	// the area light is in the world but not sampled, found by BSDF
+	// sampling only it must count in full
+	for _, lights := range [][]Light{nil, {PointLight{NewVec3(0, 1.5, 0), NewVec3(0.1, 0.1, 0.1)}}} {
+		scene.Lights = lights
+		mean_naive, var_naive = estimate(RayColorPath, 7)
+		mean_nee, var_nee = estimate(RayColorNEE, 8)
+		sigma = math.Sqrt(var_naive/20000 + var_nee/20000)
+		if math.Abs(mean_naive-mean_nee) > 4*sigma {
+			t.Errorf("%d lights sampled: naive %v nee %v (sigma %v)", len(lights), mean_naive, mean_nee, sigma)
+		}
+	}
+}
+
+func TestDecodeHDR(t *testing.T) {
+	// 8x2 image, first scanline flat, second run length encoded
+	var data []byte
+	data = append(data, "#?RADIANCE\nFORMAT=32-bit_rle_rgbe\n\n-Y 2 +X 8\n"...)
+	for x := 0; x < 8; x++ {
+		data = append(data, byte(128), byte(64), 0, 129) // (1, 0.5, 0)
+	}
+	data = append(data, 2, 2, 0, 8)
+	data = append(data, 128+8, 128)                // red: run of 8
+	data = append(data, 128+8, 0)                  // green: run of 8
+	data = append(data, 4, 0, 0, 0, 128, 128+4, 0) // blue: 4 literals, run of 4
+	data = append(data, 128+8, 130)                // exponent: run of 8
+	img, err := DecodeHDR(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Width != 8 || img.Height != 2 {
+		t.Fatalf("size %dx%d", img.Width, img.Height)
+	}
+	if c := img.At(5, 0); !c.Equal(NewVec3(1, 0.5, 0)) {
+		t.Errorf("flat scanline: %v", c)
+	}
+	if c := img.At(3, 1); !c.Equal(NewVec3(2, 0, 2)) {
+		t.Errorf("rle scanline: %v", c)
+	}
+	if c := img.At(4, 1); !c.Equal(NewVec3(2, 0, 0)) {
+		t.Errorf("rle scanline: %v", c)
+	}
+	if _, err := DecodeHDR(bytes.NewReader([]byte("P6\n"))); err == nil {
+		t.Error("expected an error for a non hdr file")
+	}
+	// rejected from the resolution line, before allocating 48GB
+	if _, err := DecodeHDR(strings.NewReader("#?RADIANCE\n\n-Y 65536 +X 65536\n")); err != errHDRFormat {
+		t.Errorf("huge image: %v", err)
+	}
+}
+
+// dim environment with a bright patch above the horizon
+func testEnvMap() *EnvMap {
+	img := NewHDRImage(32, 16)
+	for y := 0; y < img.Height; y++ {
+		for x := 0; x < img.Width; x++ {
+			img.Set(x, y, NewVec3(0.1, 0.1, 0.2))
+		}
+	}
+	for y := 3; y < 5; y++ {
+		for x := 6; x < 8; x++ {
+			img.Set(x, y, NewVec3(50, 40, 30))
+		}
+	}
+	return NewEnvMap(img, 1)
+}
+
+func TestEnvMapSampling(t *testing.T) {
+	env := testEnvMap()
+	rng := rand.New(rand.NewSource(3))
+	p := NewVec3(0, 0, 0)
+
+	// samples agree with Pdf()
+	for i := 0; i < 1000; i++ {
+		ls, ok := env.Sample(p, rng)
+		if ok && math.Abs(float64(ls.Pdf-env.Pdf(p, ls.Wi))) > 1e-3*float64(ls.Pdf) {
+			t.Fatalf("sample pdf %v, Pdf() %v", ls.Pdf, env.Pdf(p, ls.Wi))
+		}
+	}
+	// the pdf integrates to one over the sphere (midpoint rule in theta, phi)
+	var integral float64
+	steps := 512
+	for i := 0; i < steps; i++ {
+		theta := math.Pi * (float64(i) + 0.5) / float64(steps)
+		for j := 0; j < 2*steps; j++ {
+			phi := math.Pi * (float64(j) + 0.5) / float64(steps)
+			w := NewVec3(float32(math.Sin(theta)*math.Cos(phi)), float32(math.Cos(theta)), float32(math.Sin(theta)*math.Sin(phi)))
+			integral += float64(env.Pdf(p, w)) * math.Sin(theta) * (math.Pi / float64(steps)) * (math.Pi / float64(steps))
+		}
+	}
+	if math.Abs(integral-1) > 0.01 {
+		t.Errorf("pdf integrates to %v", integral)
+	}
+
+	// irradiance on an upward facing point, cosine sampling vs light sampling
+	up := NewONB(NewVec3(0, 1, 0))
+	var e_cos, e_light float64
+	n := 200000
+	for i := 0; i < n; i++ {
+		w := up.Local(RandomCosineDirection(randFloat(rng), randFloat(rng)))
+		e_cos += math.Pi * float64(env.Radiance(w).At(0))
+		ls, ok := env.Sample(p, rng)
+		if ok && ls.Wi.At(1) > 0 {
+			e_light += float64(ls.Li.At(0) * ls.Wi.At(1) / ls.Pdf)
+		}
+	}
+	e_cos /= float64(n)
+	e_light /= float64(n)
+	if math.Abs(e_cos-e_light) > 0.03*e_cos {
+		t.Errorf("irradiance: cosine sampling %v, light sampling %v", e_cos, e_light)
+	}
+}
+
+func TestEnvMapLighting(t *testing.T) {
+	// a diffuse floor under the environment, NEE with MIS must agree with
+	// plain path tracing
+	env := testEnvMap()
+	floor := Surface{Quad{NewVec3(-50, 0, 50), NewVec3(100, 0, 0), NewVec3(0, 0, -100)}, Lambertian{SolidColor{NewVec3(0.5, 0.5, 0.5)}}}
+	scene := &Scene{World: &HittableList{[]Hittable{floor}}, Background: env, Lights: []Light{env}, MaxDepth: 2}
+	ray := NewRay(NewVec3(0, 1, 0), NewVec3(0, -1, 0.1))
+
+	estimate := func(integrator func(*Ray, *Scene, *rand.Rand) Vec3, seed int64) float64 {
+		rng := rand.New(rand.NewSource(seed))
+		var sum float64
+		n := 40000
+		for i := 0; i < n; i++ {
+			sum += float64(integrator(&ray, scene, rng).At(0))
+		}
+		return sum / float64(n)
+	}
+	naive := estimate(RayColorPath, 1)
+	nee := estimate(RayColorNEE, 2)
+	if math.Abs(naive-nee) > 0.05*naive {
+		t.Errorf("path %v, nee %v", naive, nee)
+	}
+}
+
+func TestPreethamSky(t *testing.T) {
+	sky := NewPreethamSky(30, 90, 3)
+	sun_dir := SunDirection(30, 90)
+	if math.Abs(float64(sun_dir.At(0))-math.Cos(Deg_to_Rad(30))) > 1e-5 || math.Abs(float64(sun_dir.At(1))-0.5) > 1e-5 {
+		t.Errorf("sun direction %v", sun_dir)
+	}
+
+	// finite and non negative everywhere, including below the horizon
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		c := sky.Radiance(UniformSampleSphere(randFloat(rng), randFloat(rng)))
+		for a := 0; a < 3; a++ {
+			v := float64(c.At(a))
+			if v < 0 || math.IsNaN(v) || math.IsInf(v, 0) {
+				t.Fatalf("radiance %v", c)
+			}
+		}
+	}
+
+	// brighter around the sun than opposite to it, blue overhead
+	near := luminance(sky.Radiance(SunDirection(35, 90)))
+	away := luminance(sky.Radiance(SunDirection(35, -90)))
+	if near <= away {
+		t.Errorf("sky near the sun %v, away %v", near, away)
+	}
+	zenith := sky.Radiance(NewVec3(0, 1, 0))
+	if zenith.At(2) <= zenith.At(0) {
+		t.Errorf("zenith is not blue: %v", zenith)
+	}
+
+	// the sun gets dimmer and redder towards the horizon and with haze
+	redness := func(l DirectionalLight) float32 { return l.Irradiance.At(0) / l.Irradiance.At(2) }
+	noon := NewPreethamSky(80, 0, 3).Sun(1)
+	sunset := NewPreethamSky(5, 0, 3).Sun(1)
+	hazy := NewPreethamSky(80, 0, 8).Sun(1)
+	if !(luminance(sunset.Irradiance) < luminance(noon.Irradiance) && redness(sunset) > redness(noon)) {
+		t.Errorf("noon %v, sunset %v", noon.Irradiance, sunset.Irradiance)
+	}
+	if !(luminance(hazy.Irradiance) < luminance(noon.Irradiance) && redness(hazy) > redness(noon)) {
+		t.Errorf("clear %v, hazy %v", noon.Irradiance, hazy.Irradiance)
+	}
+	if noon.Direction.Dot(SunDirection(80, 0)) > -0.999 {
+		t.Errorf("sun light travels along %v", noon.Direction)
+	}
+	if night := NewPreethamSky(-10, 0, 3).Sun(1); night.Irradiance.LengthSquared() != 0 {
+		t.Errorf("sun below the horizon: %v", night.Irradiance)
+	}
+}
+
+func TestUVs(t *testing.T) {
+	approx := func(a, b float32) bool { return math.Abs(float64(a-b)) < 1e-4 }
+	rec := NewHitRecord()
+
+	// sphere: u starts at -X and goes around Y, v from the bottom
+	sphere := Sphere{NewVec3(0, 0, 0), 1}
+	r := NewRay(NewVec3(-5, 0, 0), NewVec3(1, 0, 0))
+	if !sphere.Hit(&r, 0, 100, &rec) || !approx(rec.U, 0) && !approx(rec.U, 1) || !approx(rec.V, 0.5) {
+		t.Errorf("sphere -X: %v %v", rec.U, rec.V)
+	}
+	r = NewRay(NewVec3(0, 5, 0), NewVec3(0, -1, 0))
+	if !sphere.Hit(&r, 0, 100, &rec) || !approx(rec.V, 1) {
+		t.Errorf("sphere top: v %v", rec.V)
+	}
+
+	// quad: coordinates along the edges
+	quad := Quad{NewVec3(0, 0, 0), NewVec3(2, 0, 0), NewVec3(0, 4, 0)}
+	r = NewRay(NewVec3(0.5, 3, 1), NewVec3(0, 0, -1))
+	if !quad.Hit(&r, 0, 100, &rec) || !approx(rec.U, 0.25) || !approx(rec.V, 0.75) {
+		t.Errorf("quad: %v %v", rec.U, rec.V)
+	}
+
+	// triangle: barycentrics, interpolated vertex UVs for UVTriangle
+	tri := Triangle{NewVec3(0, 0, 0), NewVec3(1, 0, 0), NewVec3(0, 1, 0)}
+	r = NewRay(NewVec3(0.2, 0.3, 1), NewVec3(0, 0, -1))
+	if !tri.Hit(&r, 0, 100, &rec) || !approx(rec.U, 0.2) || !approx(rec.V, 0.3) {
+		t.Errorf("triangle: %v %v", rec.U, rec.V)
+	}
+	mesh := NewMeshUV([]Vec3{NewVec3(0, 0, 0), NewVec3(1, 0, 0), NewVec3(0, 1, 0)},
+		[][2]float32{{0.5, 0.5}, {1, 0.5}, {0.5, 1}}, []int{0, 1, 2})
+	if !mesh[0].Hit(&r, 0, 100, &rec) || !approx(rec.U, 0.6) || !approx(rec.V, 0.65) {
+		t.Errorf("uv triangle: %v %v", rec.U, rec.V)
+	}
+
+	// cylinder: v along the height, the tube is open
+	cyl := Cylinder{NewVec3(0, 1, 0), 0.5, 2}
+	r = NewRay(NewVec3(0, 1.5, 5), NewVec3(0, 0, -1))
+	if !cyl.Hit(&r, 0, 100, &rec) || !approx(rec.T, 4.5) || !approx(rec.V, 0.75) || !rec.FrontFace {
+		t.Errorf("cylinder: t %v v %v front %v", rec.T, rec.V, rec.FrontFace)
+	}
+	if n := rec.Normal; !approx(n.At(2), 1) {
+		t.Errorf("cylinder normal %v", n)
+	}
+	r = NewRay(NewVec3(0, 3, 5), NewVec3(0, 0, -1))
+	if cyl.Hit(&r, 0, 100, &rec) || cyl.Occluded(&r, 0, 100) {
+		t.Error("hit above the cylinder")
+	}
+	r = NewRay(NewVec3(0, 5, 0), NewVec3(0, -1, 0))
+	if cyl.Hit(&r, 0, 100, &rec) {
+		t.Error("hit along the open axis")
+	}
+}
+
+func TestTextures(t *testing.T) {
+	red := SolidColor{NewVec3(1, 0, 0)}
+	blue := SolidColor{NewVec3(0, 0, 1)}
+	checker := Checker{Even: red, Odd: blue, Scale: 2}
+	if c := checker.Value(0, 0, NewVec3(0.1, 0.1, 0.1)); !c.Equal(red.Color) {
+		t.Errorf("checker %v", c)
+	}
+	if c := checker.Value(0, 0, NewVec3(0.6, 0.1, 0.1)); !c.Equal(blue.Color) {
+		t.Errorf("checker %v", c)
+	}
+	if c := checker.Value(0.6, 0.1, NewVec3(-0.6, 0.1, 0.1)); !c.Equal(red.Color) {
+		t.Errorf("checker at negative coordinates %v", c)
+	}
+	uv_checker := Checker{Even: red, Odd: blue, Scale: 2, UVSpace: true}
+	if c := uv_checker.Value(0.6, 0.1, NewVec3(0, 0, 0)); !c.Equal(blue.Color) {
+		t.Errorf("uv checker %v", c)
+	}
+
+	// 2x1 image: black on the left, white on the right
+	img := NewHDRImage(2, 1)
+	img.Set(1, 0, NewVec3(1, 1, 1))
+	approx := func(c Vec3, want float32) bool { return math.Abs(float64(c.At(0)-want)) < 1e-5 }
+	tex := &ImageTexture{Image: img, WrapU: WrapClamp, WrapV: WrapClamp}
+	for _, tc := range []struct{ u, want float32 }{{0.25, 0}, {0.5, 0.5}, {0.75, 1}, {0, 0}, {1, 1}, {1.5, 1}} {
+		if c := tex.Value(tc.u, 0.5, NewVec3(0, 0, 0)); !approx(c, tc.want) {
+			t.Errorf("clamp at u=%v: %v want %v", tc.u, c, tc.want)
+		}
+	}
+	tex.WrapU = WrapRepeat
+	if c := tex.Value(0, 0.5, NewVec3(0, 0, 0)); !approx(c, 0.5) {
+		t.Errorf("repeat blends across the edge: %v", c)
+	}
+	if c := tex.Value(1.75, 0.5, NewVec3(0, 0, 0)); !approx(c, 1) {
+		t.Errorf("repeat %v", c)
+	}
+	tex.WrapU = WrapMirror
+	if c := tex.Value(1.25, 0.5, NewVec3(0, 0, 0)); !approx(c, 1) {
+		t.Errorf("mirror %v", c)
+	}
+
+	// PNG round trip with sRGB decoding
+	src := image.NewRGBA(image.Rect(0, 0, 2, 2))
+	src.Set(0, 0, color.RGBA{255, 255, 255, 255})
+	src.Set(1, 0, color.RGBA{188, 188, 188, 255})
+	path := filepath.Join(t.TempDir(), "tex.png")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	png.Encode(f, src)
+	f.Close()
+	loaded, err := LoadImageTexture(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := loaded.Image.At(1, 0); math.Abs(float64(c.At(0))-0.5) > 0.01 {
+		t.Errorf("sRGB 188 decoded to %v", c)
+	}
+	if !loaded.Image.At(0, 0).Equal(NewVec3(1, 1, 1)) || !loaded.Image.At(0, 1).Equal(NewVec3(0, 0, 0)) {
+		t.Errorf("loaded %v", loaded.Image.Pix)
+	}
+
+	// noise is repeatable, bounded and continuous
+	noise := NewPerlin(7)
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		p := NewVec3(randFloat(rng)*20-10, randFloat(rng)*20-10, randFloat(rng)*20-10)
+		n := noise.Noise(p)
+		if n < -1.5 || n > 1.5 {
+			t.Fatalf("noise %v at %v", n, p)
+		}
+		if NewPerlin(7).Noise(p) != n && i < 10 {
+			t.Fatal("same seed gives different noise")
+		}
+		if d := math.Abs(float64(noise.Noise(p.AddF(1e-3)) - n)); d > 0.02 {
+			t.Fatalf("noise jumps by %v at %v", d, p)
+		}
+		if turb := noise.Turbulence(p, 5); turb < 0 || turb > 3 {
+			t.Fatalf("turbulence %v", turb)
+		}
+	}
+	if noise.Noise(NewVec3(3, 4, 5)) != 0 {
+		t.Error("gradient noise is zero at lattice points")
+	}
+	marble := NoiseTexture{Noise: noise, Color: NewVec3(1, 1, 1), Scale: 4}
+	if c := marble.Value(0, 0, NewVec3(0.3, 0.2, 0.1)); c.At(0) < 0 || c.At(0) > 1 {
+		t.Errorf("noise texture %v", c)
+	}
+}
+
+func TestTexturedLambertian(t *testing.T) {
+	// the albedo comes from the texture at the hit
+	checker := Checker{Even: SolidColor{NewVec3(1, 1, 1)}, Odd: SolidColor{NewVec3(0, 0, 0)}, Scale: 1, UVSpace: true}
+	mat := Lambertian{Checker{Even: checker, Odd: checker, Scale: 1}}
+	rec := NewHitRecord()
+	rec.Normal = NewVec3(0, 1, 0)
+	wi := NewVec3(0, 1, 0)
+	rec.U, rec.V = 0.5, 0.5
+	if f := mat.Eval(&rec, wi, wi); f.At(0) == 0 {
+		t.Errorf("even cell is black: %v", f)
+	}
+	rec.U = 1.5
+	if f := mat.Eval(&rec, wi, wi); f.At(0) != 0 {
+		t.Errorf("odd cell is white: %v", f)
+	}
+}
+
+func TestTangents(t *testing.T) {
+	// dP/du and dP/dv against finite differences of the hit point
+	rng := rand.New(rand.NewSource(2))
+	check := func(name string, shape Hittable, target func() Vec3) {
+		for i := 0; i < 50; i++ {
+			origin := NewVec3(randFloat(rng)*6-3, randFloat(rng)*6-3, 8)
+			r := NewRay(origin, target().Subtr(origin))
+			rec := NewHitRecord()
+			if !shape.Hit(&r, 0, 100, &rec) {
+				continue
+			}
+			frame := rec.TangentFrame()
+			if math.Abs(float64(frame.W.Dot(rec.Normal))-1) > 1e-4 || math.Abs(float64(frame.U.Dot(frame.V))) > 1e-4 {
+				t.Fatalf("%s: frame %v is not orthonormal", name, frame)
+			}
+			if math.Abs(float64(rec.Tangent.Dot(rec.Normal))) > 1e-3*float64(rec.Tangent.Length()) {
+				t.Fatalf("%s: tangent %v not in the surface (normal %v)", name, rec.Tangent, rec.Normal)
+			}
+			// moving along the tangent by a small du lands on the surface
+			// at the point with texture coordinate u + du
+			du := float32(1e-3)
+			p := rec.P.Add(rec.Tangent.MultF(du))
+			probe := NewRay(p.Add(rec.Normal.MultF(0.01)), rec.Normal.MultF(-1))
+			probe_rec := NewHitRecord()
+			if shape.Hit(&probe, 0, 1, &probe_rec) && math.Abs(float64(probe_rec.U-rec.U-du)) > 2e-4 {
+				t.Fatalf("%s: u %v -> %v moving along %v", name, rec.U, probe_rec.U, rec.Tangent)
+			}
+		}
+	}
+	sphere := Sphere{NewVec3(0, 0, 0), 1.5}
+	check("sphere", sphere, func() Vec3 { return NewVec3(randFloat(rng)-0.5, randFloat(rng)-0.5, 0) })
+	quad := Quad{NewVec3(-1, -1, 0), NewVec3(2, 0.5, 0), NewVec3(0, 2, 0.2)}
+	check("quad", quad, func() Vec3 { return NewVec3(randFloat(rng)-0.5, randFloat(rng)*0.5, 0) })
+	mesh := NewMeshUV([]Vec3{NewVec3(-1, -1, 0), NewVec3(1, -1, 0), NewVec3(0, 1, 0)},
+		[][2]float32{{0.2, 0.1}, {0.9, 0.3}, {0.4, 0.8}}, []int{0, 1, 2})
+	check("uv triangle", mesh[0], func() Vec3 { return NewVec3(randFloat(rng)*0.5-0.25, randFloat(rng)*0.5-0.5, 0) })
+
+	// tangents follow instance transforms
+	inst := NewInstance(quad, NewScale(NewVec3(2, 1, 1)).Then(NewRotate(NewVec3(0, 1, 0), 30)), 0)
+	r := NewRay(NewVec3(0, 0, 8), NewVec3(0, 0, -1))
+	rec := NewHitRecord()
+	if !inst.Hit(&r, 0, 100, &rec) {
+		t.Fatal("missed the instance")
+	}
+	if math.Abs(float64(rec.Tangent.Dot(rec.Normal))) > 1e-3 {
+		t.Errorf("instanced tangent %v, normal %v", rec.Tangent, rec.Normal)
+	}
+}
+
+func TestNormalAndBumpMapping(t *testing.T) {
+	white := Lambertian{SolidColor{NewVec3(1, 1, 1)}}
+	floor := Quad{NewVec3(-1, 0, 1), NewVec3(2, 0, 0), NewVec3(0, 0, -2)}
+	hit := func(origin Vec3) HitRecord {
+		r := NewRay(origin, NewVec3(0, 0, 0).Subtr(origin))
+		rec := NewHitRecord()
+		if !floor.Hit(&r, 0, 100, &rec) {
+			t.Fatal("missed the floor")
+		}
+		return rec
+	}
+	// direction of the shading normal through Eval: a Lambertian is
+	// brightest for wi along the normal
+	shadingNormal := func(m Material, rec HitRecord) Vec3 {
+		best, best_f := Vec3{}, float32(-1)
+		rng := rand.New(rand.NewSource(1))
+		for i := 0; i < 20000; i++ {
+			wi := UniformSampleSphere(randFloat(rng), randFloat(rng))
+			if f := m.Eval(&rec, wi, wi).At(0); f > best_f {
+				best, best_f = wi, f
+			}
+		}
+		return best
+	}
+
+	// a flat normal map leaves the normal alone
+	flat := NormalMapped{white, SolidColor{NewVec3(0.5, 0.5, 1)}, 1}
+	rec := hit(NewVec3(0, 2, 0.1))
+	if n := shadingNormal(flat, rec); n.Dot(NewVec3(0, 1, 0)) < 0.99 {
+		t.Errorf("flat normal map: %v", n)
+	}
+	// tilted along +u (Edge1 = +X)
+	tilted := NormalMapped{white, SolidColor{NewVec3(0.85, 0.5, 0.85)}, 1}
+	if n := shadingNormal(tilted, rec); n.At(0) < 0.5 || n.At(1) < 0.5 {
+		t.Errorf("tilted normal map: %v", n)
+	}
+	// from below the floor the perturbed normal still faces the viewer
+	below := hit(NewVec3(0, -2, 0.1))
+	if below.FrontFace {
+		t.Fatal("expected a back face hit")
+	}
+	if n := shadingNormal(tilted, below); n.At(1) > -0.5 {
+		t.Errorf("normal map on the back face: %v", n)
+	}
+	for _, m := range []Material{tilted, flat} {
+		shaded := m.(NormalMapped).perturb(&below)
+		if shaded.Normal.Dot(below.Normal) <= 0 || shaded.FrontFace != below.FrontFace {
+			t.Errorf("perturbed normal %v left the side of %v", shaded.Normal, below.Normal)
+		}
+	}
+
+	// a ramp rising along u tilts the normal towards -u
+	ramp := BumpMapped{white, rampTexture{}, 2} // rises by 2 over the 2 units long Edge1, 45 degrees
+	if n := shadingNormal(ramp, rec); n.At(0) > -0.6 || n.At(1) < 0.6 {
+		t.Errorf("bump ramp: %v", n)
+	}
+	// constant height is flat
+	no_bump := BumpMapped{white, SolidColor{NewVec3(1, 1, 1)}, 3}
+	if n := no_bump.perturb(&rec).Normal; !n.Equal(rec.Normal) {
+		t.Errorf("constant height changed the normal to %v", n)
+	}
+}
+
+// height equal to u
+type rampTexture struct{}
+
+func (rampTexture) Value(u, v float32, p Vec3) Vec3 { return NewVec3(u, u, u) }
+
+// albedo of a material for light leaving along wo: E[F / Pdf] of its samples
+func materialAlbedo(m Material, rec *HitRecord, wo Vec3, n int, rng *rand.Rand) float64 {
+	var sum float64
+	for i := 0; i < n; i++ {
+		bs, ok := m.Sample(rec, wo, rng)
+		if ok && bs.Pdf > 0 {
+			sum += float64(bs.F.At(1) / bs.Pdf)
+		}
+	}
+	return sum / float64(n)
+}
+
+func TestMicrofacetWhiteFurnace(t *testing.T) {
+	white := SolidColor{NewVec3(1, 1, 1)}
+	materials := []struct {
+		name string
+		mat  Material
+		min  float64 // lower bound of the albedo, energy lost to single scattering
+	}{
+		{"mirror", Conductor{white, 0}, 0.999},
+		{"conductor 0.2", Conductor{white, 0.2}, 0.95},
+		{"conductor 0.6", Conductor{white, 0.6}, 0.75},
+		{"conductor 1", Conductor{white, 1}, 0.3},
+		{"glass", Dielectric{1.5, 0}, 0.999},
+		{"rough glass 0.3", Dielectric{1.5, 0.3}, 0.85},
+		{"rough glass 0.8", Dielectric{1.5, 0.8}, 0.6},
+		{"principled plastic", Principled{BaseColor: white, Roughness: 0.4, Specular: 0.5}, 0.8},
+		{"principled metal", Principled{BaseColor: white, Metallic: 1, Roughness: 0.3}, 0.85},
+		{"principled glass", Principled{BaseColor: white, Roughness: 0.2, Transmission: 1}, 0.85},
+		{"principled coated", Principled{BaseColor: white, Roughness: 0.5, Specular: 0.5, Clearcoat: 1, ClearcoatGloss: 0.8}, 0.75},
+	}
+	rng := rand.New(rand.NewSource(11))
+	for _, front := range []bool{true, false} {
+		rec := NewHitRecord()
+		rec.Normal = NewVec3(0, 1, 0)
+		rec.FrontFace = front // leaving or entering glass
+		for _, tc := range materials {
+			for _, cos := range []float64{1, 0.7, 0.3, 0.1} {
+				wo := NewVec3(float32(math.Sqrt(1-cos*cos)), float32(cos), 0)
+				albedo := materialAlbedo(tc.mat, &rec, wo, 20000, rng)
+				if albedo > 1.01 {
+					t.Errorf("%s (front %v, cos %v) creates energy: %v", tc.name, front, cos, albedo)
+				}
+				// total internal reflection keeps all the energy too
+				if front && cos >= 0.3 && albedo < tc.min {
+					t.Errorf("%s (cos %v) loses too much energy: %v", tc.name, cos, albedo)
+				}
+			}
+		}
+	}
+}
+
+func TestMicrofacetConsistency(t *testing.T) {
+	base := SolidColor{NewVec3(0.8, 0.6, 0.3)}
+	materials := map[string]Material{
+		"conductor":  Conductor{base, 0.5},
+		"dielectric": Dielectric{1.33, 0.8}, // rough enough for uniform sampling to converge
+		"principled": Principled{BaseColor: base, Metallic: 0.3, Roughness: 0.6, Specular: 0.5, Clearcoat: 0.5, Transmission: 0.4},
+	}
+	rng := rand.New(rand.NewSource(5))
+	rec := NewHitRecord()
+	rec.Normal = NewVec3(0, 0, 1)
+	wo := NewVec3(0.5, 0.2, 0.8).UnitVec()
+	for name, m := range materials {
+		// Sample() agrees with Eval() and Pdf()
+		for i := 0; i < 200; i++ {
+			bs, ok := m.Sample(&rec, wo, rng)
+			if !ok {
+				continue
+			}
+			f := m.Eval(&rec, wo, bs.Wi)
+			pdf := m.Pdf(&rec, wo, bs.Wi)
+			if math.Abs(float64(pdf-bs.Pdf)) > 1e-3*float64(pdf) || math.Abs(float64(f.At(0)-bs.F.At(0))) > 1e-3*float64(f.At(0))+1e-6 {
+				t.Fatalf("%s: sample f %v pdf %v, eval %v pdf %v", name, bs.F, bs.Pdf, f, pdf)
+			}
+		}
+		// importance sampling and uniform sampling estimate the same albedo,
+		// and the pdf integrates to at most one
+		n := 200000
+		var uniform, pdf_integral float64
+		for i := 0; i < n; i++ {
+			wi := UniformSampleSphere(randFloat(rng), randFloat(rng))
+			uniform += float64(m.Eval(&rec, wo, wi).At(0)) * 4 * math.Pi
+			pdf_integral += float64(m.Pdf(&rec, wo, wi)) * 4 * math.Pi
+		}
+		uniform /= float64(n)
+		pdf_integral /= float64(n)
+		sampled := 0.0
+		for i := 0; i < n; i++ {
+			if bs, ok := m.Sample(&rec, wo, rng); ok {
+				sampled += float64(bs.F.At(0) / bs.Pdf)
+			}
+		}
+		sampled /= float64(n)
+		if math.Abs(uniform-sampled) > 0.03 {
+			t.Errorf("%s: albedo %v by uniform sampling, %v by importance sampling", name, uniform, sampled)
+		}
+		if pdf_integral > 1.03 {
+			t.Errorf("%s: pdf integrates to %v", name, pdf_integral)
+		}
+	}
+}
+
+func TestMediumTransmittance(t *testing.T) {
+	// slab 0.5 thick along z with density 2
+	slab := &HittableList{NewBox(NewVec3(-50, -50, -0.25), NewVec3(50, 50, 0.25))}
+	medium := ConstantMedium{Boundary: slab, Density: 2, Albedo: NewVec3(1, 1, 1)}
+	want := math.Exp(-2 * 0.5)
+	rng := rand.New(rand.NewSource(4))
+	n := 50000
+	hits, occluded := 0, 0
+	for i := 0; i < n; i++ {
+		origin := NewVec3(randFloat(rng)*10-5, randFloat(rng)*10-5, 3)
+		// length of the direction must not matter
+		r := NewRay(origin, NewVec3(0, 0, -0.5-randFloat(rng)))
+		rec := NewHitRecord()
+		if medium.Hit(&r, 0, float32(math.Inf(1)), &rec) {
+			hits++
+			if z := rec.P.At(2); z > 0.25+1e-4 || z < -0.25-1e-4 {
+				t.Fatalf("scattered outside of the slab at %v", rec.P)
+			}
+			if rec.Mat == nil {
+				t.Fatal("no phase function on the scattering event")
+			}
+		}
+		// shadow rays from inside the slab towards the top
+		inside := NewRay(NewVec3(origin.At(0), origin.At(1), -0.25), NewVec3(0, 0, 1))
+		if medium.Occluded(&inside, 0, 10) {
+			occluded++
+		}
+	}
+	if got := 1 - float64(hits)/float64(n); math.Abs(got-want) > 0.01 {
+		t.Errorf("transmittance %v, want %v", got, want)
+	}
+	if got := 1 - float64(occluded)/float64(n); math.Abs(got-want) > 0.01 {
+		t.Errorf("transmittance from inside %v, want %v", got, want)
+	}
+	// a surface in the middle of the slab cuts the free flight short
+	short := 0
+	for i := 0; i < n; i++ {
+		r := NewRay(NewVec3(randFloat(rng), randFloat(rng), 3), NewVec3(0, 0, -1))
+		if medium.Occluded(&r, 0, 3) {
+			short++
+		}
+	}
+	if got := 1 - float64(short)/float64(n); math.Abs(got-math.Exp(-2*0.25)) > 0.01 {
+		t.Errorf("transmittance to the middle %v, want %v", got, math.Exp(-0.5))
+	}
+
+	// a second slab further along, both stop half of the rays: the free
+	// flights must be independent, a quarter of the rays scatter in both
+	slab2 := &HittableList{NewBox(NewVec3(-50, -50, -2.25), NewVec3(50, 50, -1.75))}
+	half := float32(math.Ln2 / 0.5)
+	media := [2]ConstantMedium{{Boundary: slab, Density: half}, {Boundary: slab2, Density: half}}
+	both := 0
+	for i := 0; i < n; i++ {
+		r := NewRay(NewVec3(randFloat(rng)*10-5, randFloat(rng)*10-5, 3), NewVec3(0, 0, -1))
+		if media[0].Occluded(&r, 0, 10) && media[1].Occluded(&r, 0, 10) {
+			both++
+		}
+	}
+	if got := float64(both) / float64(n); math.Abs(got-0.25) > 0.01 {
+		t.Errorf("scattered in both slabs %v, want 0.25", got)
+	}
+
+	fog := Fog{Density: 0.5}
+	if tr := fog.Transmittance(2); math.Abs(float64(tr)-math.Exp(-1)) > 1e-6 {
+		t.Errorf("fog transmittance %v", tr)
+	}
+}
+
+func TestPhaseFunctions(t *testing.T) {
+	rng := rand.New(rand.NewSource(9))
+	wo := NewVec3(0.3, -0.4, 0.8).UnitVec()
+	for _, g := range []float32{0, 0.7, -0.5} {
+		phases := []PhaseFunction{HenyeyGreenstein{g}}
+		if g == 0 {
+			phases = append(phases, Isotropic{})
+		}
+		for _, phase := range phases {
+			n := 100000
+			var mean_cos, integral float64
+			for i := 0; i < n; i++ {
+				wi, pdf := phase.Sample(wo, randFloat(rng), randFloat(rng))
+				if math.Abs(float64(pdf-phase.P(wo, wi))) > 1e-3*float64(pdf) {
+					t.Fatalf("%T: sample pdf %v, P %v", phase, pdf, phase.P(wo, wi))
+				}
+				mean_cos += float64(wo.MultF(-1).Dot(wi))
+				w := UniformSampleSphere(randFloat(rng), randFloat(rng))
+				integral += float64(phase.P(wo, w)) * 4 * math.Pi
+			}
+			mean_cos /= float64(n)
+			integral /= float64(n)
+			if math.Abs(mean_cos-float64(g)) > 0.01 {
+				t.Errorf("%T g=%v: mean cosine %v", phase, g, mean_cos)
+			}
+			if math.Abs(integral-1) > 0.03 {
+				t.Errorf("%T g=%v: integrates to %v", phase, g, integral)
+			}
+		}
+	}
+}
+
+func TestFog(t *testing.T) {
+	// an emitter 3 units away seen through purely absorbing fog
+	light := RectLight{Quad{NewVec3(-50, -50, -3), NewVec3(100, 0, 0), NewVec3(0, 100, 0)}, NewVec3(1, 1, 1)}
+	scene := &Scene{
+		World:  &HittableList{[]Hittable{light}},
+		Lights: []Light{light},
+		Fog:    &Fog{Density: 0.3, Albedo: NewVec3(0, 0, 0)},
+	}
+	r := NewRay(NewVec3(0, 0, 0), NewVec3(0, 0, -1))
+	want := math.Exp(-0.3 * 3)
+	for name, integrator := range map[string]func(*Ray, *Scene, *rand.Rand) Vec3{"path": RayColorPath, "nee": RayColorNEE} {
+		rng := rand.New(rand.NewSource(1))
+		var sum float64
+		n := 20000
+		for i := 0; i < n; i++ {
+			sum += float64(integrator(&r, scene, rng).At(0))
+		}
+		if got := sum / float64(n); math.Abs(got-want) > 0.02 {
+			t.Errorf("%s: %v through fog, want %v", name, got, want)
+		}
+	}
+
+	// scattering fog lights up the space in front of a lamp, with light
+	// sampling through the fog agreeing with plain path tracing
+	scene.Fog = &Fog{Density: 0.3, Albedo: NewVec3(0.8, 0.8, 0.8), Phase: HenyeyGreenstein{0.3}}
+	lamp := SphereLight{NewVec3(0, 1, -2), 0.3, NewVec3(10, 10, 10)}
+	scene.World = &HittableList{[]Hittable{lamp}}
+	scene.Lights = []Light{lamp}
+	scene.MaxDepth = 3
+	r = NewRay(NewVec3(0, 0, 0), NewVec3(0, 0, -1))
+	estimate := func(integrator func(*Ray, *Scene, *rand.Rand) Vec3) float64 {
+		rng := rand.New(rand.NewSource(2))
+		var sum float64
+		n := 100000
+		for i := 0; i < n; i++ {
+			sum += float64(integrator(&r, scene, rng).At(0))
+		}
+		return sum / float64(n)
+	}
+	path, nee := estimate(RayColorPath), estimate(RayColorNEE)
+	if path == 0 || math.Abs(path-nee) > 0.05*nee {
+		t.Errorf("in scattering fog: path %v, nee %v", path, nee)
+	}
+}
+
+func TestVoxelGrid(t *testing.T) {
+	g := NewVoxelGrid(4, 2, 3, NewVec3(-1, 0, 0), NewVec3(1, 1, 3))
+	for i := range g.Data {
+		g.Data[i] = float32(i)
+	}
+	var buf bytes.Buffer
+	if err := EncodeVoxelGrid(&buf, g); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := DecodeVoxelGrid(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Nx != 4 || loaded.Ny != 2 || loaded.Nz != 3 || loaded.Min != g.Min || loaded.Max != g.Max {
+		t.Fatalf("header %v %v %v %v %v", loaded.Nx, loaded.Ny, loaded.Nz, loaded.Min, loaded.Max)
+	}
+	for i := range g.Data {
+		if loaded.Data[i] != g.Data[i] {
+			t.Fatalf("voxel %d: %v, want %v", i, loaded.Data[i], g.Data[i])
+		}
+	}
+	for _, bad := range [][]byte{buf.Bytes()[:buf.Len()-1], append([]byte("VOX2"), buf.Bytes()[4:]...)} {
+		if _, err := DecodeVoxelGrid(bytes.NewReader(bad)); err == nil {
+			t.Error("expected an error")
+		}
+	}
+
+	// voxels are 0.5 x 0.5 x 1
+	cases := []struct {
+		p    Vec3
+		want float32
+	}{
+		{NewVec3(-0.75, 0.25, 0.5), g.At(0, 0, 0)},
+		{NewVec3(0.75, 0.75, 2.5), g.At(3, 1, 2)},
+		{NewVec3(-0.5, 0.25, 0.5), (g.At(0, 0, 0) + g.At(1, 0, 0)) / 2},
+		{NewVec3(-0.5, 0.5, 1), (g.At(0, 0, 0) + g.At(1, 0, 0) + g.At(0, 1, 0) + g.At(1, 1, 0) +
+			g.At(0, 0, 1) + g.At(1, 0, 1) + g.At(0, 1, 1) + g.At(1, 1, 1)) / 8},
+		{NewVec3(-1, 0, 0), g.At(0, 0, 0)}, // the border half voxel is constant
+		{NewVec3(-1.1, 0.5, 1), 0},
+		{NewVec3(0, 0.5, 3.01), 0},
+	}
+	for _, c := range cases {
+		if got := g.Lookup(c.p); math.Abs(float64(got-c.want)) > 1e-4 {
+			t.Errorf("Lookup(%v) = %v, want %v", c.p, got, c.want)
+		}
+	}
+}
+
+func TestVoxelVolume(t *testing.T) {
+	rng := rand.New(rand.NewSource(5))
+	// a blob in one corner of a mostly empty grid, the bricks elsewhere
+	// have a zero majorant
+	g := NewVoxelGrid(20, 20, 20, NewVec3(-1, -1, -1), NewVec3(1, 1, 1))
+	for z := 0; z < 10; z++ {
+		for y := 0; y < 12; y++ {
+			for x := 0; x < 20; x++ {
+				g.Set(x, y, z, rng.Float32())
+			}
+		}
+	}
+	v := NewVoxelVolume(g, 2, NewVec3(1, 1, 1), nil)
+	box := NewAABBUninit()
+	if !v.BBox(&box) || box.Min() != g.Min || box.Max() != g.Max {
+		t.Fatalf("bbox %v", box)
+	}
+	empty := 0
+	for _, m := range v.majorants {
+		if m == 0 {
+			empty++
+		}
+	}
+	if len(v.majorants) != 27 || empty == 0 {
+		t.Errorf("%d bricks, %d empty", len(v.majorants), empty)
+	}
+	for i := 0; i < 10000; i++ {
+		p := NewVec3(rng.Float32()*2-1, rng.Float32()*2-1, rng.Float32()*2-1)
+		c := g.voxelCoords(p)
+		brick := (int(c[2])/8*3+int(c[1])/8)*3 + int(c[0])/8
+		if e := v.extinction(p); e > v.majorants[brick] {
+			t.Fatalf("extinction %v at %v above the majorant %v", e, p, v.majorants[brick])
+		}
+	}
+
+	for _, line := range []Ray{
+		NewRay(NewVec3(-2, -0.5, -0.5), NewVec3(1, 0, 0)),
+		NewRay(NewVec3(-2, -2, -2), NewVec3(1, 1.1, 0.9)),
+		NewRay(NewVec3(0.3, -0.2, 2), NewVec3(-0.2, 0, -1)),
+	} {
+		dir := line.Direction().UnitVec()
+		// optical depth by quadrature
+		var depth float64
+		steps := 20000
+		for i := 0; i < steps; i++ {
+			s := (float32(i) + 0.5) / float32(steps) * 8
+			depth += float64(v.extinction(line.Origin().Add(dir.MultF(s)))) * 8 / float64(steps)
+		}
+		want := math.Exp(-depth)
+
+		n := 20000
+		misses, visible := 0, 0
+		var ratio float64
+		for i := 0; i < n; i++ {
+			// the same line from varying origins and direction lengths
+			s := rng.Float32()
+			r := NewRay(line.Origin().Subtr(dir.MultF(s)), dir.MultF(0.5+s))
+			rec := NewHitRecord()
+			if !v.Hit(&r, 0, float32(math.Inf(1)), &rec) {
+				misses++
+			} else if v.extinction(rec.P) == 0 {
+				t.Fatalf("scattered at %v with no density", rec.P)
+			}
+			if !v.Occluded(&r, 0, float32(math.Inf(1))) {
+				visible++
+			}
+			rr := newRayRNG(&r, v.salt)
+			ratio += float64(v.transmittance(&r, 0, float32(math.Inf(1)), &rr))
+		}
+		for name, got := range map[string]float64{
+			"delta tracking": float64(misses) / float64(n),
+			"occlusion":      float64(visible) / float64(n),
+			"ratio tracking": ratio / float64(n),
+		} {
+			if math.Abs(got-want) > 0.015 {
+				t.Errorf("ray %v: %s transmittance %v, want %v", line.Direction(), name, got, want)
+			}
+		}
+	}
+}
+
+// readEXR parses the uncompressed float files written by WriteEXR.
+func readEXR(t *testing.T, data []byte) (width, height int, channels map[string][]float32, attributes map[string]string) {
+	t.Helper()
+	le := binary.LittleEndian
+	if !bytes.Equal(data[:4], []byte{0x76, 0x2f, 0x31, 0x01}) || le.Uint32(data[4:])&0xff != 2 {
+		t.Fatalf("bad magic or version % x", data[:8])
+	}
+	pos := 8
+	cstring := func() string {
+		end := bytes.IndexByte(data[pos:], 0)
+		s := string(data[pos : pos+end])
+		pos += end + 1
+		return s
+	}
+	var names []string
+	attributes = map[string]string{}
+	for {
+		name := cstring()
+		if name == "" {
+			break
+		}
+		kind := cstring()
+		size := int(le.Uint32(data[pos:]))
+		value := data[pos+4 : pos+4+size]
+		pos += 4 + size
+		switch kind {
+		case "chlist":
+			for p := 0; value[p] != 0; {
+				end := bytes.IndexByte(value[p:], 0)
+				names = append(names, string(value[p:p+end]))
+				if le.Uint32(value[p+end+1:]) != 2 {
+					t.Fatal("expected float channels")
+				}
+				p += end + 1 + 16
+			}
+		case "box2i":
+			if name == "dataWindow" {
+				width = int(le.Uint32(value[8:])) + 1
+				height = int(le.Uint32(value[12:])) + 1
+			}
+		case "compression":
+			if value[0] != 0 {
+				t.Fatal("expected no compression")
+			}
+		case "string":
+			attributes[name] = string(value)
+		}
+	}
+	if !sort.StringsAreSorted(names) {
+		t.Errorf("channels not sorted: %v", names)
+	}
+	channels = map[string][]float32{}
+	for _, name := range names {
+		channels[name] = make([]float32, width*height)
+	}
+	for y := 0; y < height; y++ {
+		offset := int(binary.LittleEndian.Uint64(data[pos+8*y:]))
+		if int(le.Uint32(data[offset:])) != y || int(le.Uint32(data[offset+4:])) != 4*width*len(names) {
+			t.Fatalf("bad chunk header of line %d", y)
+		}
+		offset += 8
+		for _, name := range names {
+			for x := 0; x < width; x++ {
+				channels[name][y*width+x] = math.Float32frombits(le.Uint32(data[offset:]))
+				offset += 4
+			}
+		}
+	}
+	return
+}
+
+func TestEXR(t *testing.T) {
+	channels := []EXRChannel{
+		{"B", []float32{1, 2, 3, 4, 5, 6}},
+		{"A", []float32{-1, 0.5, float32(math.Inf(1)), 0, 1e-20, 7}},
+		{"a_rather_long_layer_name_over_31_characters.X", []float32{6, 5, 4, 3, 2, 1}},
+	}
+	var buf bytes.Buffer
+	if err := WriteEXR(&buf, 3, 2, channels, map[string]string{"comment": "hello"}); err != nil {
+		t.Fatal(err)
+	}
+	width, height, got, attributes := readEXR(t, buf.Bytes())
+	if width != 3 || height != 2 || len(got) != 3 || attributes["comment"] != "hello" {
+		t.Fatalf("%dx%d %d channels %v", width, height, len(got), attributes)
+	}
+	for _, c := range channels {
+		for i, v := range c.Data {
+			if got[c.Name][i] != v {
+				t.Errorf("%s[%d] = %v, want %v", c.Name, i, got[c.Name][i], v)
+			}
+		}
+	}
+	if err := WriteEXR(&buf, 2, 2, channels, nil); err == nil {
+		t.Error("expected an error for mismatching channel sizes")
+	}
+}
+
+func TestFilmAOVs(t *testing.T) {
+	red := Lambertian{SolidColor{NewVec3(0.8, 0.1, 0.1)}}
+	scene := &Scene{
+		World:      &HittableList{[]Hittable{Surface{Sphere{NewVec3(0, 0, -3), 1}, red}}},
+		Background: ConstantBackground{NewVec3(1, 1, 1)},
+	}
+	cam := NewCamera(NewVec3(0, 0, 0), NewVec3(0, 0, -1), 32)
+	film := NewFilm(cam.Width, cam.Height, AOVDepth, AOVNormal, AOVAlbedo, AOVPosition, AOVObjectId, AOVInstanceId, AOVSampleCount)
+	RenderFilm(context.Background(), cam, 4, scene, film)
+
+	cx, cy := cam.Width/2, cam.Height/2
+	near := func(a, b Vec3, eps float32) bool { return a.Subtr(b).Length() <= eps }
+	checks := []struct {
+		aov  AOV
+		x, y int
+		want Vec3
+		eps  float32
+	}{
+		{AOVDepth, cx, cy, NewVec3(2, 2, 2), 0.1},
+		{AOVNormal, cx, cy, NewVec3(0, 0, 1), 0.4},
+		{AOVAlbedo, cx, cy, NewVec3(0.8, 0.1, 0.1), 1e-4},
+		{AOVPosition, cx, cy, NewVec3(0, 0, -2), 0.4},
+		{AOVObjectId, cx, cy, NewVec3(0, 0, 0), 0},
+		{AOVInstanceId, cx, cy, NewVec3(-1, -1, -1), 0},
+		{AOVSampleCount, cx, cy, NewVec3(4, 4, 4), 0},
+		{AOVAlbedo, 0, 0, NewVec3(0, 0, 0), 0},
+		{AOVObjectId, 0, 0, NewVec3(-1, -1, -1), 0},
+		{AOVSampleCount, 0, 0, NewVec3(4, 4, 4), 0},
+	}
+	for _, c := range checks {
+		if got := film.AOV(c.aov).At(c.x, c.y); !near(got, c.want, c.eps) {
+			t.Errorf("%v at %d,%d: %v, want %v", c.aov, c.x, c.y, got, c.want)
+		}
+	}
+	// the averages of a few samples still lie close to the sphere
+	p, n := film.AOV(AOVPosition).At(cx, cy), film.AOV(AOVNormal).At(cx, cy)
+	if !near(p.Subtr(NewVec3(0, 0, -3)), n, 0.01) || math.Abs(float64(film.AOV(AOVDepth).At(cx, cy).At(0)+p.At(2))) > 1e-4 {
+		t.Errorf("position %v, normal %v", p, n)
+	}
+	if d := film.AOV(AOVDepth).At(0, 0).At(0); !math.IsInf(float64(d), 1) {
+		t.Errorf("background depth %v", d)
+	}
+	if !near(film.Pixel(0, 0), NewVec3(1, 1, 1), 1e-4) {
+		t.Errorf("background color %v", film.Pixel(0, 0))
+	}
+	if film.Image().RGBAAt(cx, cy).R < 10 {
+		t.Error("the sphere is not lit")
+	}
+	if NewFilm(4, 4, AOVNormal).AOV(AOVDepth) != nil {
+		t.Error("depth was not recorded")
+	}
+
+	var buf bytes.Buffer
+	if err := film.WriteEXR(&buf); err != nil {
+		t.Fatal(err)
+	}
+	width, height, channels, _ := readEXR(t, buf.Bytes())
+	if width != cam.Width || height != cam.Height || len(channels) != 3+1+3+3+3+1+1+1 {
+		t.Fatalf("%dx%d with %d channels", width, height, len(channels))
+	}
+	for _, name := range []string{"R", "G", "B", "depth.Z", "normal.X", "albedo.G", "position.Z", "objectid.id", "instanceid.id", "samples.count"} {
+		if _, ok := channels[name]; !ok {
+			t.Errorf("missing channel %s", name)
+		}
+	}
+	if got := channels["position.Z"][cy*width+cx]; got != p.At(2) {
+		t.Errorf("position.Z %v", got)
+	}
+
+	prefix := filepath.Join(t.TempDir(), "film")
+	if err := film.SaveAOVs(prefix); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"film.exr", "film.depth.exr", "film.samples.exr"} {
+		if _, err := os.Stat(filepath.Join(filepath.Dir(prefix), name)); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestCryptomatte(t *testing.T) {
+	for s, want := range map[string]uint32{
+		"":      0,
+		"hello": 0x248bfa47,
+		"bunny": 0x13851a76, // the example of the Cryptomatte specification
+		"The quick brown fox jumps over the lazy dog": 0x2e4ff723,
+	} {
+		if got := murmur3([]byte(s), 0); got != want {
+			t.Errorf("murmur3(%q) = %08x, want %08x", s, got, want)
+		}
+	}
+	for _, hash := range []uint32{0, 0x7f800000, 0xffffffff, 0x00000001, 0x13851a76} {
+		f := float64(hashToFloat(hash))
+		if math.IsNaN(f) || math.IsInf(f, 0) || (f != 0 && math.Abs(f) < math.SmallestNonzeroFloat32*(1<<23)) {
+			t.Errorf("hash %08x gives %v", hash, f)
+		}
+	}
+
+	// two spheres side by side and a third one sharing the name of the first
+	mat := Lambertian{SolidColor{NewVec3(0.5, 0.5, 0.5)}}
+	scene := &Scene{World: &HittableList{[]Hittable{
+		Surface{Sphere{NewVec3(-1, 0, -3), 1}, mat},
+		Surface{Sphere{NewVec3(1, 0, -3), 1}, mat},
+		Surface{Sphere{NewVec3(3.5, 0, -3), 0.5}, mat},
+		Surface{Sphere{NewVec3(-3.5, 0, -3), 0.5}, mat},
+	}}}
+	cam := NewCamera(NewVec3(0, 0, 0), NewVec3(0, 0, -1), 32)
+	film := NewFilm(cam.Width, cam.Height)
+	film.Cryptomatte = NewCryptomatte(cam.Width, cam.Height, "CryptoObject", []string{"left", "right", "left"})
+	RenderFilm(context.Background(), cam, 64, scene, film)
+	matte := film.Cryptomatte
+
+	channels := matte.Channels()
+	if len(channels) != 12 || channels[0].Name != "CryptoObject00.R" || channels[11].Name != "CryptoObject02.A" {
+		t.Fatalf("%d channels", len(channels))
+	}
+	manifest := matte.Manifest()
+	if len(manifest) != 3 || manifest["left"] != fmt.Sprintf("%08x", math.Float32bits(hashToFloat(murmur3([]byte("left"), 0)))) {
+		t.Fatalf("manifest %v", manifest)
+	}
+	ids := map[float32]string{}
+	for name, hex := range manifest {
+		var bits uint32
+		fmt.Sscanf(hex, "%x", &bits)
+		ids[math.Float32frombits(bits)] = name
+	}
+
+	soft := 0
+	for y := 0; y < cam.Height; y++ {
+		for x := 0; x < cam.Width; x++ {
+			i := y*cam.Width + x
+			var sum float32
+			last := float32(2)
+			for rank := 0; rank < 6; rank++ {
+				id, coverage := channels[2*rank].Data[i], channels[2*rank+1].Data[i]
+				if coverage == 0 {
+					continue
+				}
+				name, ok := ids[id]
+				if !ok {
+					t.Fatalf("pixel %d,%d: unknown id %v", x, y, id)
+				}
+				if coverage > last {
+					t.Fatalf("pixel %d,%d: ranks out of order", x, y)
+				}
+				if got := matte.Coverage(x, y, name); got != coverage {
+					t.Fatalf("pixel %d,%d: %s coverage %v, want %v", x, y, name, got, coverage)
+				}
+				last = coverage
+				sum += coverage
+			}
+			if sum > 1+1e-5 {
+				t.Fatalf("pixel %d,%d: coverage sums to %v", x, y, sum)
+			}
+			if sum > 0.05 && sum < 0.95 {
+				soft++
+			}
+		}
+	}
+	if soft == 0 {
+		t.Error("no anti-aliased edges")
+	}
+	// the small spheres are centred around pixels 5 and 26
+	if c := matte.Coverage(26, cam.Height/2, "left"); c == 0 {
+		t.Error("the small sphere on the right is not in the left matte")
+	}
+	if c := matte.Coverage(5, cam.Height/2, "object3"); c == 0 {
+		t.Error("no matte for the unnamed object")
+	}
+
+	var buf bytes.Buffer
+	if err := film.WriteEXR(&buf); err != nil {
+		t.Fatal(err)
+	}
+	_, _, exr, attributes := readEXR(t, buf.Bytes())
+	key := fmt.Sprintf("cryptomatte/%07x/", murmur3([]byte("CryptoObject"), 0)>>4)
+	if attributes[key+"name"] != "CryptoObject" || attributes[key+"hash"] != "MurmurHash3_32" ||
+		attributes[key+"conversion"] != "uint32_to_float32" || !strings.Contains(attributes[key+"manifest"], `"right":`) {
+		t.Errorf("attributes %v", attributes)
+	}
+	if _, ok := exr["CryptoObject01.B"]; !ok {
+		t.Error("missing cryptomatte channels")
+	}
+
+	// the primitive of an instance has ObjectId 0 like the ball, it goes
+	// to the matte of the instance instead
+	blas := &HittableList{[]Hittable{Surface{Sphere{NewVec3(0, 0, 0), 1}, mat}}}
+	scene = &Scene{World: &HittableList{[]Hittable{
+		Surface{Sphere{NewVec3(-1, 0, -3), 1}, mat},
+		NewInstance(blas, NewTranslate(NewVec3(1.2, 0, -3)), 0),
+	}}}
+	film = NewFilm(cam.Width, cam.Height)
+	film.Cryptomatte = NewCryptomatte(cam.Width, cam.Height, "CryptoObject", []string{"ball"})
+	film.Cryptomatte.InstanceNames = []string{"tree"}
+	RenderFilm(context.Background(), cam, 16, scene, film)
+	var encoded bytes.Buffer
+	if err := EncodeCheckpoint(&encoded, &Checkpoint{1, 0, 16, film}); err != nil {
+		t.Fatal(err)
+	}
+	checkpoint, err := DecodeCheckpoint(&encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, matte := range []*Cryptomatte{film.Cryptomatte, checkpoint.Film.Cryptomatte} {
+		y := cam.Height / 2
+		if matte.Coverage(12, y, "ball") != 1 || matte.Coverage(12, y, "tree") != 0 {
+			t.Errorf("ball pixel: ball %v tree %v", matte.Coverage(12, y, "ball"), matte.Coverage(12, y, "tree"))
+		}
+		if matte.Coverage(19, y, "tree") != 1 || matte.Coverage(19, y, "ball") != 0 {
+			t.Errorf("instance pixel: tree %v ball %v", matte.Coverage(19, y, "tree"), matte.Coverage(19, y, "ball"))
+		}
+		if manifest := matte.Manifest(); len(manifest) != 2 || manifest["tree"] == "" {
+			t.Errorf("manifest %v", manifest)
+		}
+	}
+}
+
+func TestDenoiser(t *testing.T) {
+	film := NewFilm(2, 1)
+	film.AddSample(0, 0, NewVec3(1, 1, 1), nil)
+	if v := film.Variance(0, 0); !math.IsInf(float64(v.x), 1) {
+		t.Errorf("variance of a single sample %v", v)
+	}
+	film.AddSample(0, 0, NewVec3(3, 1, 1), nil)
+	if v := film.Variance(0, 0); v != NewVec3(1, 0, 0) {
+		t.Errorf("variance of the mean %v, want 1 0 0", v)
+	}
+
+	// the small light box with a checker floor and a sphere
+	scene := smallLightBox()
+	checker := Lambertian{Checker{SolidColor{NewVec3(0.8, 0.8, 0.8)}, SolidColor{NewVec3(0.2, 0.3, 0.6)}, 4, false}}
+	scene.World = &HittableList{[]Hittable{scene.World,
+		Surface{Quad{NewVec3(-1, 0.001, 1), NewVec3(2, 0, 0), NewVec3(0, 0, -2)}, checker},
+		Surface{Sphere{NewVec3(0.3, 0.4, -0.3), 0.4}, Lambertian{SolidColor{NewVec3(0.8, 0.2, 0.2)}}}}}
+	cam := NewCamera(NewVec3(0, 1.2, 0.95), NewVec3(0, 0.6, -1), 48)
+
+	render := func(samples int) *Film {
+		film := NewFilm(cam.Width, cam.Height, AOVAlbedo, AOVNormal, AOVDepth)
+		RenderFilm(context.Background(), cam, samples, scene, film)
+		return film
+	}
+	reference := render(256).Beauty()
+	mse := func(img *HDRImage) float64 {
+		var sum float64
+		for i, p := range img.Pix {
+			for c := 0; c < 3; c++ {
+				d := float64(Clamp(p.At(c), 0, 1) - Clamp(reference.Pix[i].At(c), 0, 1))
+				sum += d * d
+			}
+		}
+		return sum / float64(3*len(img.Pix))
+	}
+
+	for _, spp := range []int{2, 8} {
+		noisy := render(spp)
+		denoised := Denoiser{}.Denoise(noisy)
+		before, after := mse(noisy.Beauty()), mse(denoised)
+		t.Logf("%d spp: mse %v, denoised %v", spp, before, after)
+		if after > 0.4*before {
+			t.Errorf("%d spp: denoising reduced the mse from %v only to %v", spp, before, after)
+		}
+		// without guides it still helps, if less
+		plain := NewFilm(cam.Width, cam.Height)
+		RenderFilm(context.Background(), cam, spp, scene, plain)
+		if unguided := mse(Denoiser{}.Denoise(plain)); unguided > before {
+			t.Errorf("%d spp: unguided denoising increased the mse to %v", spp, unguided)
+		}
+		noisy.Denoiser = &Denoiser{}
+		if img := noisy.Image(); img.Bounds().Dx() != cam.Width {
+			t.Errorf("image %v", img.Bounds())
+		}
+	}
+}
+
+func TestFilmWelford(t *testing.T) {
+	rng := rand.New(rand.NewSource(3))
+	film := NewFilm(1, 1)
+	var values []float64
+	for i := 0; i < 1000; i++ {
+		// large offset, where the naive sum of squares loses precision
+		v := 1000 + rng.Float64()
+		values = append(values, v)
+		film.AddSample(0, 0, NewVec3(float32(v), 0, 1), nil)
+	}
+	var mean, m2 float64
+	for _, v := range values {
+		mean += v / float64(len(values))
+	}
+	for _, v := range values {
+		m2 += (v - mean) * (v - mean)
+	}
+	want := m2 / float64(len(values)-1) / float64(len(values))
+	if got := film.Variance(0, 0); math.Abs(float64(got.x)-want) > 0.05*want || got.z != 0 {
+		t.Errorf("variance %v, want %v", got, want)
+	}
+	if got := film.Pixel(0, 0).x; math.Abs(float64(got)-mean) > 1e-3 {
+		t.Errorf("mean %v, want %v", got, mean)
+	}
+}
+
+func TestAdaptiveSampling(t *testing.T) {
+	// a wall with a checker too fine for the pixels on the left half of
+	// the frame, flat sky on the right
+	checker := Lambertian{Checker{SolidColor{NewVec3(0.9, 0.9, 0.9)}, SolidColor{NewVec3(0.1, 0.1, 0.1)}, 20, false}}
+	wall := Quad{NewVec3(-6, -4, -2), NewVec3(6, 0, 0), NewVec3(0, 8, 0)}
+	scene := &Scene{
+		World:      &HittableList{[]Hittable{Surface{wall, checker}}},
+		Background: ConstantBackground{NewVec3(0.5, 0.6, 0.8)},
+		MaxDepth:   4,
+	}
+	cam := NewCamera(NewVec3(0, 0, 0), NewVec3(0, 0, -1), 32)
+	film := NewFilm(cam.Width, cam.Height, AOVSampleCount, AOVNoise)
+	adaptive := AdaptiveSampling{MinSamples: 4, MaxSamples: 64, Threshold: 0.05}
+	RenderAdaptive(context.Background(), cam, scene, film, adaptive)
+
+	counts, noise := film.AOV(AOVSampleCount), film.AOV(AOVNoise)
+	if counts == nil || noise == nil {
+		t.Fatal("missing AOVs")
+	}
+	sky, noisy := 0, 0
+	total := 0
+	for y := 0; y < cam.Height; y++ {
+		for x := 0; x < cam.Width; x++ {
+			n := film.Samples(x, y)
+			total += n
+			if int(counts.At(x, y).x) != n {
+				t.Fatalf("sample count AOV %v, want %d", counts.At(x, y), n)
+			}
+			if n < 4 || n > 64 {
+				t.Fatalf("pixel %d,%d: %d samples", x, y, n)
+			}
+			if noise.At(x, y).x > adaptive.Threshold && n < 64 && x > 2 && x < cam.Width-3 && y > 2 && y < cam.Height-3 {
+				// the 3x3 average may stop a pixel slightly above
+				if noise.At(x, y).x > 2*adaptive.Threshold {
+					t.Errorf("pixel %d,%d stopped at %d samples with error %v", x, y, n, noise.At(x, y).x)
+				}
+			}
+			if x > 3*cam.Width/4 {
+				sky += n
+			} else if x < cam.Width/4 {
+				noisy += n
+			}
+		}
+	}
+	if sky != 4*(cam.Width-3*cam.Width/4-1)*cam.Height {
+		t.Errorf("the flat sky took %d samples", sky)
+	}
+	if noisy <= 4*sky {
+		t.Errorf("the checker took %d samples, sky %d", noisy, sky)
+	}
+	// about half the frame is noisy, the rest stays at the minimum
+	if total >= 64*cam.Width*cam.Height*3/5 {
+		t.Errorf("%d samples in total", total)
+	}
+}
+
+func TestProgressive(t *testing.T) {
+	scene := smallLightBox()
+	cam := NewCamera(NewVec3(0, 1, 0.9), NewVec3(0, 0.8, -1), 32)
+	path := filepath.Join(t.TempDir(), "progress.png")
+	film := NewFilm(cam.Width, cam.Height)
+
+	var snapshots []*Snapshot
+	var sums []float64
+	sum := func(img *HDRImage) float64 {
+		var s float64
+		for _, p := range img.Pix {
+			s += float64(p.x + p.y + p.z)
+		}
+		return s
+	}
+	RenderProgressive(context.Background(), cam, scene, film, Progressive{
+		Passes:         5,
+		SamplesPerPass: 2,
+		OnSnapshot: func(s *Snapshot) {
+			snapshots = append(snapshots, s)
+			sums = append(sums, sum(s.Image))
+		},
+		Path:          path,
+		WriteInterval: time.Hour,
+	})
+
+	if len(snapshots) != 5 {
+		t.Fatalf("%d snapshots", len(snapshots))
+	}
+	for i, s := range snapshots {
+		if s.Pass != i+1 || s.Samples != 2*(i+1) || s.Final != (i == 4) {
+			t.Errorf("snapshot %d: pass %d, %d samples, final %v", i, s.Pass, s.Samples, s.Final)
+		}
+		// snapshots are copies, later passes must not change them
+		if got := sum(s.Image); got != sums[i] {
+			t.Errorf("snapshot %d changed after it was sent", i)
+		}
+		if i > 0 && sums[i] == sums[i-1] {
+			t.Errorf("snapshot %d is the same as the previous one", i)
+		}
+	}
+	if film.Samples(0, 0) != 10 {
+		t.Errorf("%d samples", film.Samples(0, 0))
+	}
+
+	// the first and the final snapshot were written, the interval skipped the rest
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := png.Decode(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := snapshots[4].RGBA()
+	for y := 0; y < cam.Height; y++ {
+		for x := 0; x < cam.Width; x++ {
+			if img.At(x, y) != want.At(x, y) {
+				t.Fatalf("%s is not the final snapshot at %d,%d", path, x, y)
+			}
+		}
+	}
+	if files, _ := filepath.Glob(filepath.Join(filepath.Dir(path), "*")); len(files) != 1 {
+		t.Errorf("left over files %v", files)
+	}
+
+	// a snapshot which cannot be written stops the render
+	missing := filepath.Join(t.TempDir(), "missing", "progress.png")
+	result := RenderProgressive(context.Background(), cam, scene, NewFilm(cam.Width, cam.Height), Progressive{Passes: 1000, Path: missing})
+	if !os.IsNotExist(result.Err) || result.Progress >= 1 {
+		t.Errorf("unwritable path: err %v, progress %v", result.Err, result.Progress)
+	}
+
+	// interrupted from the callback, the final snapshot still arrives
+	ctx, cancel := context.WithCancel(context.Background())
+	snapshots = nil
+	result = RenderProgressive(ctx, cam, scene, NewFilm(cam.Width, cam.Height), Progressive{
+		Passes: 1000,
+		OnSnapshot: func(s *Snapshot) {
+			snapshots = append(snapshots, s)
+			if s.Pass == 2 {
+				cancel()
+			}
+		},
+	})
+	last := snapshots[len(snapshots)-1]
+	if !last.Final || last.Pass >= 1000 || len(snapshots) > 10 {
+		t.Errorf("%d snapshots after the interrupt, the last of pass %d", len(snapshots), last.Pass)
+	}
+	if result.Err != context.Canceled || result.Progress <= 0 || result.Progress >= 0.01 {
+		t.Errorf("interrupted with %v at %v", result.Err, result.Progress)
+	}
+
+	// RenderSamples is built on top of it
+	path = filepath.Join(t.TempDir(), "samples.png")
+	world := HittableList{[]Hittable{Sphere{NewVec3(0, 0, -1), 0.5}}}
+	RenderSamples(context.Background(), cam, 3, &world, nil, path)
+	if _, err := os.Stat(path); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRenderContext(t *testing.T) {
+	cam := NewCamera(NewVec3(0, 0, 0), NewVec3(0, 0, -1), 32)
+	world := HittableList{[]Hittable{Sphere{NewVec3(0, 0, -1), 0.5}}}
+
+	// cancelled before it starts
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	result := Render(ctx, cam, 4, &world, nil)
+	if result.Err != context.Canceled || result.Progress != 0 || result.Film.Samples(0, 0) != 0 {
+		t.Errorf("cancelled render: %v at %v", result.Err, result.Progress)
+	}
+
+	// past the deadline, with the passes done so far in the film
+	scene := smallLightBox()
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	result = RenderProgressive(ctx, cam, scene, NewFilm(cam.Width, cam.Height), Progressive{Passes: 1 << 20})
+	if result.Err != context.DeadlineExceeded || result.Progress <= 0 || result.Progress >= 1 {
+		t.Errorf("render past the deadline: %v at %v", result.Err, result.Progress)
+	}
+	if result.Film.Samples(0, 0) == 0 {
+		t.Error("no samples in the film")
+	}
+
+	// concurrent renders share no state
+	results := make(chan RenderResult)
+	for i := 0; i < 4; i++ {
+		go func() {
+			results <- Render(context.Background(), cam, 2, &world, nil)
+		}()
+	}
+	for i := 0; i < 4; i++ {
+		result := <-results
+		if result.Err != nil || result.Progress != 1 || result.Film.Samples(cam.Width-1, cam.Height-1) != 2 {
+			t.Errorf("concurrent render: %v at %v", result.Err, result.Progress)
+		}
+		if c := result.Image().RGBAAt(cam.Width/2, cam.Height/2); c.A != 255 {
+			t.Errorf("center pixel %v", c)
+		}
+	}
+
+	// nil pointers from call sites of the *BVH_node parameter mean the list
+	for _, accel := range []Hittable{(*BVH_node)(nil), (*DynamicBVH)(nil)} {
+		if result := Render(context.Background(), cam, 1, &world, accel); result.Err != nil {
+			t.Errorf("%T(nil): %v", accel, result.Err)
+		}
+	}
+}
+
+func TestCheckpoint(t *testing.T) {
+	scene := smallLightBox()
+	cam := NewCamera(NewVec3(0, 1, 0.9), NewVec3(0, 0.8, -1), 32)
+	newFilm := func() *Film {
+		film := NewFilm(cam.Width, cam.Height, AOVDepth, AOVAlbedo, AOVObjectId)
+		film.Cryptomatte = NewCryptomatte(cam.Width, cam.Height, "CryptoObject", []string{"floor"})
+		return film
+	}
+	p := Progressive{Passes: 4, SamplesPerPass: 2, Seed: 7}
+	want := newFilm()
+	RenderProgressive(context.Background(), cam, scene, want, p)
+
+	// stopped in the middle of the third pass
+	path := filepath.Join(t.TempDir(), "render.ckp")
+	ctx, cancel := context.WithCancel(context.Background())
+	var calls int32
+	interrupted := p
+	interrupted.Checkpoint = path
+	interrupted.CheckpointInterval = time.Hour
+	interrupted.Integrator = func(r *Ray, scene *Scene, rng *rand.Rand) Vec3 {
+		if atomic.AddInt32(&calls, 1) == int32(cam.Width*cam.Height*5) {
+			cancel()
+		}
+		return RayColorNEE(r, scene, rng)
+	}
+	result := RenderProgressive(ctx, cam, scene, newFilm(), interrupted)
+	if result.Err != context.Canceled {
+		t.Fatalf("not interrupted: %v", result.Err)
+	}
+
+	checkpoint, err := LoadCheckpoint(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checkpoint.Pass != 2 || checkpoint.Film.totalSamples() >= 6*cam.Width*cam.Height {
+		t.Errorf("checkpoint of pass %d with %d samples", checkpoint.Pass, checkpoint.Film.totalSamples())
+	}
+	other := p
+	other.Seed++
+	if result := ResumeProgressive(context.Background(), cam, scene, checkpoint, other); result.Err != errCheckpointMismatch {
+		t.Errorf("resumed with another seed: %v", result.Err)
+	}
+	result = ResumeProgressive(context.Background(), cam, scene, checkpoint, p)
+	if result.Err != nil || result.Progress != 1 {
+		t.Fatalf("resumed render: %v at %v", result.Err, result.Progress)
+	}
+
+	// the same film as the uninterrupted render, bit for bit
+	got := result.Film
+	for y := 0; y < cam.Height; y++ {
+		for x := 0; x < cam.Width; x++ {
+			if got.Samples(x, y) != want.Samples(x, y) || got.Pixel(x, y) != want.Pixel(x, y) || got.Variance(x, y) != want.Variance(x, y) {
+				t.Fatalf("pixel %d,%d: %v %v, want %v %v", x, y, got.Samples(x, y), got.Pixel(x, y), want.Samples(x, y), want.Pixel(x, y))
+			}
+		}
+	}
+	var got_exr, want_exr bytes.Buffer
+	if err := got.WriteEXR(&got_exr); err != nil {
+		t.Fatal(err)
+	}
+	if err := want.WriteEXR(&want_exr); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got_exr.Bytes(), want_exr.Bytes()) {
+		t.Error("AOVs or Cryptomatte differ from the uninterrupted render")
+	}
+
+	// a checkpoint which cannot be saved stops the render after the pass
+	unsaved := p
+	unsaved.Checkpoint = filepath.Join(t.TempDir(), "missing", "render.ckp")
+	var snapshots []*Snapshot
+	unsaved.OnSnapshot = func(s *Snapshot) { snapshots = append(snapshots, s) }
+	result = RenderProgressive(context.Background(), cam, scene, newFilm(), unsaved)
+	if !os.IsNotExist(result.Err) || result.Film.Samples(0, 0) != 2 || len(snapshots) != 1 || !snapshots[0].Final {
+		t.Errorf("unsaved checkpoint: err %v, %d samples, %d snapshots", result.Err, result.Film.Samples(0, 0), len(snapshots))
+	}
+
+	if _, err := DecodeCheckpoint(strings.NewReader("CKP1 truncated")); err == nil {
+		t.Error("decoded a truncated checkpoint")
+	}
+}
+
+func TestRenderRegion(t *testing.T) {
+	scene := smallLightBox()
+	cam := NewCamera(NewVec3(0, 1, 0.9), NewVec3(0, 0.8, -1), 32)
+	region := image.Rect(8, 4, 20, 12)
+
+	film := NewFilm(cam.Width, cam.Height)
+	result := RenderRegion(context.Background(), cam, 1, scene, film, region, nil)
+	if result.Err != nil || result.Progress != 1 {
+		t.Fatalf("%v at %v", result.Err, result.Progress)
+	}
+	img := result.Image()
+	for y := 0; y < cam.Height; y++ {
+		for x := 0; x < cam.Width; x++ {
+			inside := image.Pt(x, y).In(region)
+			want := 0
+			if inside {
+				want = 1
+			}
+			if n := film.Samples(x, y); n != want {
+				t.Fatalf("%d samples in %d,%d", n, x, y)
+			}
+			if inside != (img.RGBAAt(x, y).A == 255) {
+				t.Fatalf("alpha of %d,%d", x, y)
+			}
+		}
+	}
+
+	// the same pixels as a full frame render, the ray goes through the
+	// pixel of the full frame
+	full := RenderFilm(context.Background(), cam, 1, scene, NewFilm(cam.Width, cam.Height)).Film
+	if got, want := film.Pixel(10, 6), full.Pixel(10, 6); got != want {
+		t.Errorf("region pixel %v, full frame %v", got, want)
+	}
+
+	// refined with more samples, new ones rather than the same again
+	RenderRegion(context.Background(), cam, 3, scene, film, image.Rect(-5, -5, 12, 8), nil)
+	varied := 0
+	for y := 0; y < cam.Height; y++ {
+		for x := 0; x < cam.Width; x++ {
+			want := 0
+			if image.Pt(x, y).In(region) {
+				want++
+			}
+			if image.Pt(x, y).In(image.Rect(0, 0, 12, 8)) {
+				want += 3
+			}
+			if n := film.Samples(x, y); n != want {
+				t.Fatalf("%d samples in %d,%d, want %d", n, x, y, want)
+			}
+			if v := film.Variance(x, y); want > 1 && v.x > 0 {
+				varied++
+			}
+		}
+	}
+	if varied == 0 {
+		t.Error("the refined samples repeat the first ones")
+	}
+}
+
+func TestFilmMerge(t *testing.T) {
+	colors := []Vec3{NewVec3(1, 0, 0), NewVec3(0.5, 2, 0), NewVec3(0, 1, 1), NewVec3(3, 0, 1), NewVec3(0.2, 0.2, 0.2)}
+	all := NewFilm(3, 2, AOVObjectId)
+	film := NewFilm(3, 2, AOVObjectId)
+	tile := NewFilm(2, 1, AOVObjectId)
+	for i, c := range colors {
+		aov := &AOVSample{ObjectId: i}
+		all.AddSample(2, 1, c, aov)
+		if i < 2 {
+			film.AddSample(2, 1, c, aov)
+		} else {
+			tile.AddSample(1, 0, c, aov)
+		}
+	}
+	tile.AddSample(0, 0, colors[0], &AOVSample{ObjectId: 7})
+	film.Merge(tile, image.Pt(1, 1))
+
+	if film.Samples(2, 1) != 5 || film.Samples(1, 1) != 1 || film.Samples(0, 1) != 0 {
+		t.Errorf("samples %d %d %d", film.Samples(2, 1), film.Samples(1, 1), film.Samples(0, 1))
+	}
+	if d := film.Pixel(2, 1).Subtr(all.Pixel(2, 1)).Length(); d > 1e-5 {
+		t.Errorf("mean %v, want %v", film.Pixel(2, 1), all.Pixel(2, 1))
+	}
+	if d := film.Variance(2, 1).Subtr(all.Variance(2, 1)).Length(); d > 1e-5 {
+		t.Errorf("variance %v, want %v", film.Variance(2, 1), all.Variance(2, 1))
+	}
+	ids := film.AOV(AOVObjectId)
+	if ids.At(2, 1).x != 0 || ids.At(1, 1).x != 7 {
+		t.Errorf("ids %v %v", ids.At(2, 1), ids.At(1, 1))
+	}
+}
+
+func TestDistributed(t *testing.T) {
+	scene := smallLightBox()
+	cam := NewCamera(NewVec3(0, 1, 0.9), NewVec3(0, 0.8, -1), 32)
+	film := NewFilm(cam.Width, cam.Height, AOVDepth)
+	coordinator := NewCoordinator(film, Distributed{TileSize: 8, Passes: 3, SamplesPerPass: 2, Seed: 3, Timeout: 50 * time.Millisecond})
+	server := httptest.NewServer(coordinator)
+	defer server.Close()
+
+	// a worker which takes a unit and dies
+	resp, err := http.Get(server.URL + "/work")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lost WorkUnit
+	err = json.NewDecoder(resp.Body).Decode(&lost)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	errs := make(chan error)
+	for i := 0; i < 3; i++ {
+		go func() {
+			errs <- Worker{Coordinator: server.URL, Camera: cam, Scene: scene, PollInterval: 10 * time.Millisecond}.Run(ctx)
+		}()
+	}
+	result := coordinator.Wait(ctx)
+	for i := 0; i < 3; i++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+	if result.Err != nil || result.Progress != 1 {
+		t.Fatalf("%v at %v", result.Err, result.Progress)
+	}
+
+	// every pixel took all the passes once, the lost unit included
+	want := RenderFilm(context.Background(), cam, 6, scene, NewFilm(cam.Width, cam.Height, AOVDepth)).Film
+	depth, want_depth := film.AOV(AOVDepth), want.AOV(AOVDepth)
+	var sum, want_sum float64
+	edges := 0
+	for y := 0; y < cam.Height; y++ {
+		for x := 0; x < cam.Width; x++ {
+			if n := film.Samples(x, y); n != 6 {
+				t.Fatalf("%d samples in %d,%d", n, x, y)
+			}
+			// the samples differ, which matters at the edges only
+			if d := depth.At(x, y).x - want_depth.At(x, y).x; d > 0.1 || d < -0.1 {
+				edges++
+			}
+			sum += float64(luminance(film.Pixel(x, y)))
+			want_sum += float64(luminance(want.Pixel(x, y)))
+		}
+	}
+	if edges > cam.Width*cam.Height/10 {
+		t.Errorf("depth differs in %d pixels", edges)
+	}
+	if math.Abs(sum-want_sum) > 0.05*want_sum {
+		t.Errorf("mean luminance %v, want %v", sum, want_sum)
+	}
+
+	// the result of the lost unit comes in late and is dropped
+	tile, err := Worker{Camera: cam, Scene: scene}.render(context.Background(), lost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var body bytes.Buffer
+	EncodeCheckpoint(&body, &Checkpoint{lost.Pass, lost.Seed, lost.Samples, tile})
+	resp, err = http.Post(fmt.Sprintf("%s/result?id=%d", server.URL, lost.Id), "application/octet-stream", &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusGone || film.Samples(lost.Tile.Min.X, lost.Tile.Min.Y) != 6 {
+		t.Errorf("late result: %s", resp.Status)
+	}
+
+	// results which do not fit the unit are rejected from the header,
+	// before a film of the claimed size is allocated
+	body.Reset()
+	EncodeCheckpoint(&body, &Checkpoint{lost.Pass + 1, lost.Seed, lost.Samples, tile})
+	wrong_pass := body.Bytes()
+	var huge bytes.Buffer
+	binary.Write(&huge, binary.LittleEndian, checkpointHeader{Magic: [4]byte{'C', 'K', 'P', '1'},
+		Width: 1 << 14, Height: 1 << 14, Seed: lost.Seed, Pass: int32(lost.Pass), SamplesPerPass: int32(lost.Samples), NumAOVs: 1})
+	for name, data := range map[string][]byte{"wrong pass": wrong_pass, "huge": huge.Bytes()} {
+		resp, err = http.Post(fmt.Sprintf("%s/result?id=%d", server.URL, lost.Id), "application/octet-stream", bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s result: %s", name, resp.Status)
+		}
+	}
+	if n := lost.resultSize(); n > 1<<20 {
+		t.Errorf("%d bytes accepted for a %v tile", n, lost.Tile)
+	}
+}
+
+func TestServer(t *testing.T) {
+	server := NewServer(ServerOptions{MaxJobs: 2})
+	defer server.Close()
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	scene := `{
+		"camera": {"from": [0, 1, 1], "at": [0, 0.5, -1], "width": 32},
+		"background": {"top": [0.5, 0.7, 1], "bottom": [1, 1, 1]},
+		"objects": [
+			{"sphere": {"center": [0, 0.5, -1], "radius": 0.5}, "material": {"diffuse": [0.8, 0.3, 0.3]}},
+			{"box": {"min": [-2, -0.1, -3], "max": [2, 0, 1]}, "material": {"metal": [0.9, 0.9, 0.9], "roughness": 0.2}}
+		],
+		"lights": [{"point": [1, 2, 0], "intensity": [5, 5, 5]}]
+	}`
+	submit := func(query string) JobStatus {
+		resp, err := http.Post(ts.URL+"/jobs"+query, "application/json", strings.NewReader(scene))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var status JobStatus
+		if err := json.NewDecoder(resp.Body).Decode(&status); err != nil || resp.StatusCode != http.StatusCreated {
+			t.Fatalf("submit: %s %v", resp.Status, err)
+		}
+		if resp.Header.Get("Location") != fmt.Sprintf("/jobs/%d", status.Id) {
+			t.Errorf("location %q", resp.Header.Get("Location"))
+		}
+		return status
+	}
+	get := func(path string) *http.Response {
+		resp, err := http.Get(ts.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	// the stream ends with the final snapshot, the events with the status
+	status := submit("?passes=4&spp=2")
+	if status.Width != 32 || status.Height != 18 || status.Passes != 4 {
+		t.Errorf("submitted %+v", status)
+	}
+	resp := get(fmt.Sprintf("/jobs/%d/stream", status.Id))
+	_, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := multipart.NewReader(resp.Body, params["boundary"])
+	var last []byte
+	frames := 0
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		last, _ = io.ReadAll(part)
+		frames++
+	}
+	resp.Body.Close()
+	if frames == 0 || frames > 4 {
+		t.Errorf("%d frames", frames)
+	}
+	resp = get(fmt.Sprintf("/jobs/%d/events", status.Id))
+	events, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	lines := strings.Split(strings.TrimSpace(string(events)), "\n\n")
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(lines[len(lines)-1], "data: ")), &status); err != nil {
+		t.Fatal(err)
+	}
+	if status.State != JobDone || status.Pass != 4 || status.Samples != 8 || status.Progress != 1 {
+		t.Errorf("finished %+v", status)
+	}
+	resp = get(fmt.Sprintf("/jobs/%d/image", status.Id))
+	image, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !bytes.Equal(image, last) {
+		t.Error("the last frame of the stream is not the image")
+	}
+	if img, err := png.Decode(bytes.NewReader(image)); err != nil || img.Bounds().Dx() != 32 {
+		t.Errorf("image: %v", err)
+	}
+
+	// cancelled, with the snapshot of the passes done
+	status = submit("?passes=50000")
+	for {
+		if s, _ := server.Status(status.Id); s.Pass > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	req, _ := http.NewRequest(http.MethodDelete, fmt.Sprintf("%s/jobs/%d", ts.URL, status.Id), nil)
+	if resp, err = http.DefaultClient.Do(req); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("cancel: %s", resp.Status)
+	}
+	resp = get(fmt.Sprintf("/jobs/%d/events", status.Id))
+	events, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	lines = strings.Split(strings.TrimSpace(string(events)), "\n\n")
+	json.Unmarshal([]byte(strings.TrimPrefix(lines[len(lines)-1], "data: ")), &status)
+	if status.State != JobCancelled || status.Progress <= 0 || status.Progress >= 1 {
+		t.Errorf("cancelled %+v", status)
+	}
+
+	resp = get("/jobs")
+	var statuses []JobStatus
+	json.NewDecoder(resp.Body).Decode(&statuses)
+	resp.Body.Close()
+	if len(statuses) != 2 || statuses[0].State != JobDone || statuses[1].State != JobCancelled {
+		t.Errorf("jobs %+v", statuses)
+	}
+
+	// deleting a finished job removes it
+	req, _ = http.NewRequest(http.MethodDelete, fmt.Sprintf("%s/jobs/%d", ts.URL, status.Id), nil)
+	if resp, err = http.DefaultClient.Do(req); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp := get(fmt.Sprintf("/jobs/%d", status.Id)); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("deleted job: %s", resp.Status)
+	}
+
+	// beyond MaxFinished the oldest finished jobs are dropped
+	small := NewServer(ServerOptions{MaxFinished: 1})
+	defer small.Close()
+	cam, small_scene, err := LoadSceneJSON([]byte(scene))
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, second := small.Submit(cam, small_scene, 1, 1), small.Submit(cam, small_scene, 1, 1)
+	for start := time.Now(); ; time.Sleep(time.Millisecond) {
+		_, kept := small.Status(first.Id)
+		if s, _ := small.Status(second.Id); !kept && s.State == JobDone {
+			break
+		}
+		if time.Since(start) > 10*time.Second {
+			t.Fatal("the first job was not dropped")
+		}
+	}
+
+	// errors
+	resp, _ = http.Post(ts.URL+"/jobs", "application/json", strings.NewReader(`{"camera": {"width": 32}}`))
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("invalid scene: %s", resp.Status)
+	}
+	for _, path := range []string{"/jobs/9", "/jobs/x/image", "/other"} {
+		if resp := get(path); resp.StatusCode != http.StatusNotFound {
+			t.Errorf("%s: %s", path, resp.Status)
+		}
+	}
+}
@@ -1,12 +1,15 @@
 package raytrace
 
 import(
+	"context"
 	"fmt"
 	"image"
 	"image/color"
-	"image/png"
 	"math"
-	"os"
+	"math/rand"
+	"runtime"
+	"sync"
+	"sync/atomic"
 )
 
 type Camera struct{
@@ -23,7 +26,7 @@ func NewCamera(lookfrom, lookat Vec3, width int) Camera {
 	vfov := 90.0
 	aspect_ratio := 16.0 / 9.0
 	height := int(float64(width) / aspect_ratio)
-	fmt.Printf("image res", width, height)
+	fmt.Println("image res", width, height)
 	
 	// Camera
 	cam := Camera{}
@@ -64,6 +67,12 @@ func (c Camera) GetRay(u,v float32) Ray {
 	return NewRay(c.Origin, dir)
 }
 
+// unit vector along the view axis
+func (c Camera) forward() Vec3 {
+	center := c.Lower_left_corner.Add(c.Horizontal.DivF(2)).Add(c.Vertical.DivF(2))
+	return center.Subtr(c.Origin).UnitVec()
+}
+
 func Write_color(cd Vec3, samples int) color.RGBA {
 	scale := float32(1.0) / float32(samples)
 	R := cd.At(0) * scale
@@ -75,8 +84,10 @@ func Write_color(cd Vec3, samples int) color.RGBA {
 	return color.RGBA{uint8(R*255), uint8(G*255), uint8(B*255), 255}	
 }
 
-func RayColorArray(r *Ray, world HittableList) Vec3 {
-	rec := HitRecord{NewVec3(0,0,0), NewVec3(0,0,0), 1.0, true, -1}
+// RayColor shades the closest hit with its normal, or the sky gradient on a miss.
+// Works with any container: HittableList, BVH_node, DynamicBVH...
+func RayColor(r *Ray, world Hittable) Vec3 {
+	rec := NewHitRecord()
 	hit := world.Hit(r, 0, float32(math.Inf(1.0)), &rec)
 	
 	if hit {
@@ -84,178 +95,302 @@ func RayColorArray(r *Ray, world HittableList) Vec3 {
 		// N = N.UnitVec()
 		return N
 	}
-	// Background
-	unit_direction := r.Direction().UnitVec()
-	t := float32(0.5 * (unit_direction.At(1) + 1.0))
-	sky := NewVec3(0.5, 0.7, 1.0).MultF(t)
-	sky = sky.Add(NewVec3(1, 1, 1).MultF(1 - t))
-	return sky
+	return defaultSky.Radiance(r.Direction())
+}
+
+func RayColorArray(r *Ray, world HittableList) Vec3 {
+	return RayColor(r, world)
 }
 
 func RayColorBVH(r *Ray, world *BVH_node) Vec3 {
-	rec := HitRecord{NewVec3(0,0,0), NewVec3(0,0,0), 1.0, true, -1}
-	hit := world.Hit(r, 0, float32(math.Inf(1.0)), &rec)
-	
-	if hit {
-		N := (rec.Normal.Add(NewVec3(1,1,1))).MultF(float32(0.5))
-		// N = N.UnitVec()
-		return N
-	}
-	// Background
-	unit_direction := r.Direction().UnitVec()
-	t := float32(0.5 * (unit_direction.At(1) + 1.0))
-	sky := NewVec3(0.5, 0.7, 1.0).MultF(t)
-	sky = sky.Add(NewVec3(1, 1, 1).MultF(1 - t))
-	return sky
+	return RayColor(r, world)
+}
+
+// RenderResult is what the renders return, also when they are cancelled.
+type RenderResult struct {
+	Film     *Film   // the samples taken, rows of a cancelled pass may be missing
+	Progress float32 // fraction of the planned samples taken, 1 when complete
+	Err      error   // ctx.Err() when cancelled or past the deadline, or what stopped the render
 }
 
-// helper to store previous results in case rendering gets interrupted
-var img_prev image.RGBA
+// Image returns Film.Image().
+func (r RenderResult) Image() *image.RGBA {
+	return r.Film.Image()
+}
+
+// result of a render which planned to add planned samples to film, which
+// had before samples when it started
+func renderResult(film *Film, before, planned int, err error) RenderResult {
+	if err == nil {
+		return RenderResult{film, 1, nil}
+	}
+	var progress float32
+	if planned > 0 {
+		progress = float32(film.totalSamples()-before) / float32(planned)
+	}
+	return RenderResult{film, progress, err}
+}
 
 // Inner sample render loop
 // The standard render function where samples are generated in the inner loop.
 // This has a simpler structure then the RenderSamples() but we cannot update
 // entire image sooner.
-func Render(cam Camera, samples int, world *HittableList, bvh *BVH_node, done chan int) *image.RGBA {
-
-	upLeft := image.Point{0, 0}
-	lowRight := image.Point{cam.Width, cam.Height}
-	img := image.NewRGBA(image.Rectangle{upLeft, lowRight})
-
-	if len(img_prev.Pix) == len(img.Pix) { // ruse previously rendereed image this should help with interupted renders and avoid black regions
-		img = &img_prev
-	}
-
+//
+// accel is an optional acceleration structure built over the world
+// (*BVH_node, *DynamicBVH). When nil the flat list is traversed, a nil
+// *BVH_node (or pointer to another accelerator of this package) counts as
+// nil too.
+func Render(ctx context.Context, cam Camera, samples int, world *HittableList, accel Hittable) RenderResult {
+	scene := listScene(world, accel)
+	film := NewFilm(cam.Width, cam.Height)
+	err := renderPass(ctx, cam, scene, film, image.Point{}, RayColorWorld, func(x, y int) int { return samples }, 1)
+	return renderResult(film, 0, samples*cam.Width*cam.Height, err)
+}
 
-	// drain the done channel before we start. This prevents cancelling immediately
-	// if there are multiple done signals queued up.
-L:
-	for {
-		select {
-		case <-done:
-		default:
-			break L
+// scene of Render and RenderSamples, callers written when accel was a
+// *BVH_node pass (*BVH_node)(nil) for the flat list
+func listScene(world *HittableList, accel Hittable) *Scene {
+	scene := &Scene{World: world}
+	switch a := accel.(type) {
+	case nil:
+	case *BVH_node:
+		if a != nil {
+			scene.World = a
 		}
-	}
-
-
-	for j := 0; j <= cam.Height; j++ {
-	
-		for i := 0; i < cam.Width; i++ {
-			select {
-				
-			case <-done: // send interrupt signal to  Render()
-				fmt.Println("Interrupt rendering")
-				return &img_prev
-
-			default: // continue with standard inner loop
-
-				pixel_color := NewVec3(0,0,0); _ = pixel_color
-				for s:=0; s < samples; s++ {
-					rr := RandFloat()
-					u := (float32(i) + rr) / float32(cam.Width-1)
-					v := (float32(j) + rr) / float32(cam.Height-1)
-					_, _ = u, v
-					ray := cam.GetRay(u,v)
-
-					if bvh != nil {
-						pixel_color = pixel_color.Add(RayColorBVH(&ray, bvh)) // BVH scene
-					} else {
-						pixel_color = pixel_color.Add(RayColorArray(&ray, *world))  // flat list scene
-					}
-				}
-				px_cd := Write_color(pixel_color, samples)
-				img.SetRGBA(i, cam.Height-j, px_cd)
-			} // end of select
+	case *DynamicBVH:
+		if a != nil {
+			scene.World = a
+		}
+	case *Grid:
+		if a != nil {
+			scene.World = a
 		}
+	case *KdTree:
+		if a != nil {
+			scene.World = a
+		}
+	case *HittableList:
+		if a != nil {
+			scene.World = a
+		}
+	default:
+		scene.World = a
 	}
-
-	img_prev = *img // update fallback image
-	return img
+	return scene
 }
 
+// RayColorWorld is RayColor as an Integrator, without the lights and
+// materials of RayColorNEE.
+func RayColorWorld(r *Ray, scene *Scene, rng *rand.Rand) Vec3 {
+	return RayColor(r, scene.World)
+}
 
-// In this render loop the iteration over samples is moved into the outer loop
-// This allows us to save image/png every sample update
-// The downside is to keep separate array with Vec3 to keep float color values instead of uint8
-// to avoid quantization during consecutive iterations.
-func RenderSamples(cam Camera, samples int, world *HittableList, bvh *BVH_node, done chan int, path string) *image.RGBA {
-
-	upLeft := image.Point{0, 0}
-	lowRight := image.Point{cam.Width, cam.Height}
-	img := image.NewRGBA(image.Rectangle{upLeft, lowRight})
+// RenderScene renders a Scene with the path tracer (RayColorNEE), which
+// handles materials and lights. Rows are split between goroutines, each
+// with its own random generator to avoid contention on the global one.
+func RenderScene(ctx context.Context, cam Camera, samples int, scene *Scene) RenderResult {
+	return RenderFilm(ctx, cam, samples, scene, NewFilm(cam.Width, cam.Height))
+}
 
+// RenderFilm is RenderScene recording into film, together with the AOVs
+// the film was created with.
+func RenderFilm(ctx context.Context, cam Camera, samples int, scene *Scene, film *Film) RenderResult {
+	before := film.totalSamples()
+	err := renderPass(ctx, cam, scene, film, image.Point{}, RayColorNEE, func(x, y int) int { return samples }, 1)
+	return renderResult(film, before, samples*cam.Width*cam.Height, err)
+}
 
-	// To avoid quantization, accumulate results in the Vec3 (instead uint8)
-	imgVec3 := make([]Vec3, cam.Width * cam.Height)
-	
-	// drain the done channel before we start. This prevents cancelling immediately
-	// if there are multiple done signals queued up.
-L:
-	for {
-		select {
-		case <-done:
-		default:
-			break L
-		}
+// RenderRegion adds samples to the pixels of film inside region, in film
+// coordinates with row 0 at the top, and leaves the others untouched.
+// Pass a new film to render only the region, its other pixels stay
+// transparent in Film.Image(), or the film of an earlier render to refine
+// the region. integrator nil is RayColorNEE.
+func RenderRegion(ctx context.Context, cam Camera, samples int, scene *Scene, film *Film, region image.Rectangle, integrator Integrator) RenderResult {
+	if integrator == nil {
+		integrator = RayColorNEE
 	}
+	region = region.Intersect(image.Rect(0, 0, film.Width, film.Height))
+	before := film.totalSamples()
+	err := renderPass(ctx, cam, scene, film, image.Point{}, integrator, func(x, y int) int {
+		if !image.Pt(x, y).In(region) {
+			return 0
+		}
+		return samples
+	}, 1)
+	return renderResult(film, before, samples*region.Dx()*region.Dy(), err)
+}
 
-	// start samples from 1 not 0 as we need to avoid division by 0 in the first run
-	for sample_num:=1; sample_num <= samples; sample_num++ {
-
-		for j := 0; j < cam.Height; j++ {
-			select {
-
-			case <-done: // send interrupt signal to  Render()
-				fmt.Println("Interrupt rendering")
-				return img
-
-			default: // continue with standard inner loop
-
-				for i := 0; i < cam.Width; i++ {
-					pixel_color := imgVec3[cam.Width*j + i]
-					
-					rr := RandFloat()
-					u := (float32(i) + rr) / float32(cam.Width-1)
-					v := (float32(j) + rr) / float32(cam.Height-1)
+// AdaptiveSampling sets up RenderAdaptive. Every pixel takes MinSamples,
+// then passes double the samples of pixels whose Film.Error, averaged
+// over 3x3 pixels, is above Threshold, up to MaxSamples.
+type AdaptiveSampling struct {
+	MinSamples int     // 0 is 8
+	MaxSamples int     // 0 is 256
+	Threshold  float32 // 0 is 0.02
+}
 
-					ray := cam.GetRay(u,v)
+// RenderAdaptive is RenderFilm spending samples where the image is
+// noisy. Record AOVSampleCount and AOVNoise to see where they went. As
+// the number of samples is not known up front, the Progress of the
+// result is the fraction of pixels which were done after the last pass.
+func RenderAdaptive(ctx context.Context, cam Camera, scene *Scene, film *Film, adaptive AdaptiveSampling) RenderResult {
+	min_samples, max_samples, threshold := adaptive.MinSamples, adaptive.MaxSamples, adaptive.Threshold
+	if min_samples <= 0 {
+		min_samples = 8
+	}
+	if max_samples <= 0 {
+		max_samples = 256
+	}
+	if min_samples < 2 { // the error needs a variance
+		min_samples = 2
+	}
+	if max_samples < min_samples {
+		max_samples = min_samples
+	}
+	if threshold <= 0 {
+		threshold = 0.02
+	}
 
-					if bvh != nil {
-						pixel_color = pixel_color.Add(RayColorBVH(&ray, bvh)) // BVH scene
-					} else {
-						pixel_color = pixel_color.Add(RayColorArray(&ray, *world))  // flat list scene
+	pixels := film.Width * film.Height
+	extra := make([]int, pixels)
+	for i := range extra {
+		extra[i] = min_samples
+	}
+	var progress float32
+	for pass := 0; ; pass++ {
+		err := renderPass(ctx, cam, scene, film, image.Point{}, RayColorNEE, func(x, y int) int { return extra[y*film.Width+x] }, passSeed(0, pass))
+		if err != nil {
+			return RenderResult{film, progress, err}
+		}
+		noise := NewHDRImage(film.Width, film.Height)
+		for y := 0; y < film.Height; y++ {
+			for x := 0; x < film.Width; x++ {
+				noise.Set(x, y, NewVec3(film.Error(x, y), 0, 0))
+			}
+		}
+		active := 0
+		for y := 0; y < film.Height; y++ {
+			for x := 0; x < film.Width; x++ {
+				var sum float32
+				for dy := -1; dy <= 1; dy++ {
+					for dx := -1; dx <= 1; dx++ {
+						sum += noise.At(clampIndex(x+dx, film.Width), clampIndex(y+dy, film.Height)).x
 					}
-
-					imgVec3[cam.Width*j + i] = pixel_color
 				}
-			} // end of select
-
-		}
-
-		// save png in a separate thread
-		go func(){
-			for j := 0; j < cam.Height; j++ {
-				for i := 0; i < cam.Width; i++ {
-					pixel_color := imgVec3[(cam.Width-0)*j + i];
-					px_cd := Write_color(pixel_color, sample_num) // divide color by total number of sumples so far
-					img.SetRGBA(i, cam.Height-j, px_cd)
+				n := film.Samples(x, y)
+				i := y*film.Width + x
+				extra[i] = 0
+				if sum/9 > threshold && n < max_samples {
+					extra[i] = n
+					if n+extra[i] > max_samples {
+						extra[i] = max_samples - n
+					}
+					active++
 				}
 			}
+		}
+		if active == 0 {
+			return RenderResult{film, 1, nil}
+		}
+		progress = float32(pixels-active) / float32(pixels)
+	}
+}
 
-			f, err := os.Create(path) // TODO: this at the moment stops over image saved in the previous run by the previous goroutine
-			if err != nil {
-				panic(err)
-			}
-			if err := png.Encode(f, img); err != nil {
-				fmt.Printf("failed to encode: %v", err)
+// renderPass adds samples(x, y) samples to every pixel of film, which
+// holds the pixels of the frame from origin on. Rows are split between
+// goroutines and the random generator is seeded for every pixel from
+// seed, so the samples do not depend on the scheduling. Rows are either
+// done or not touched, returns ctx.Err() when cancelled before all of them
+// were done.
+func renderPass(ctx context.Context, cam Camera, scene *Scene, film *Film, origin image.Point, integrator Integrator, samples func(x, y int) int, seed int64) error {
+	rows := make(chan int, film.Height)
+	for y := film.Height - 1; y >= 0; y-- {
+		rows <- y
+	}
+	close(rows)
+
+	var wg sync.WaitGroup
+	var cancelled int32
+	for w := 0; w < runtime.NumCPU(); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			source := &pixelSource{}
+			rng := rand.New(source)
+			for y := range rows {
+				if ctx.Err() != nil {
+					atomic.StoreInt32(&cancelled, 1)
+					return
+				}
+				frame_y := origin.Y + y
+				j := cam.Height - 1 - frame_y
+				for x := 0; x < film.Width; x++ {
+					n := samples(x, y)
+					if n == 0 {
+						continue
+					}
+					i := origin.X + x
+					source.Seed(pixelSeed(seed, i, frame_y, film.Samples(x, y)))
+					for s := n; s > 0; s-- {
+						u := (float32(i) + rng.Float32()) / float32(cam.Width-1)
+						v := (float32(j) + rng.Float32()) / float32(cam.Height-1)
+						ray := cam.GetRay(u, v)
+						var aov *AOVSample
+						if film.needsAOVs() {
+							primary := primaryAOVs(cam, &ray, scene)
+							aov = &primary
+						}
+						film.AddSample(x, y, integrator(&ray, scene, rng), aov)
+					}
+				}
 			}
-			f.Close()
 		}()
-		
-		fmt.Println("sample", sample_num)
 	}
+	wg.Wait()
+	if atomic.LoadInt32(&cancelled) != 0 {
+		return ctx.Err()
+	}
+	return nil
+}
 
-	return img
+// pixelSource is a splitmix64 rand.Source, cheap enough to be seeded
+// for every pixel.
+type pixelSource struct {
+	state uint64
+}
+
+func (s *pixelSource) Seed(seed int64) {
+	s.state = uint64(seed)
+}
+
+func (s *pixelSource) Uint64() uint64 {
+	s.state += 0x9e3779b97f4a7c15
+	return splitmix(s.state)
+}
+
+func (s *pixelSource) Int63() int64 {
+	return int64(s.Uint64() >> 1)
+}
+
+// Seed of the random generator of pixel x, y in a pass. The samples the
+// pixel has already are mixed in, so that rendering into the same film
+// again takes new samples.
+func pixelSeed(seed int64, x, y, samples int) int64 {
+	return int64(splitmix(splitmix(uint64(seed)^uint64(y)<<32^uint64(x)) + uint64(samples)))
+}
+
+// In this render loop the iteration over samples is moved into the outer loop
+// This allows us to save image/png every sample update
+// The film keeps float color values instead of uint8 to avoid quantization
+// during consecutive iterations. Snapshots are written in order by
+// RenderProgressive, after each pass completes. accel is as in Render().
+func RenderSamples(ctx context.Context, cam Camera, samples int, world *HittableList, accel Hittable, path string) RenderResult {
+	scene := listScene(world, accel)
+	film := NewFilm(cam.Width, cam.Height)
+	return RenderProgressive(ctx, cam, scene, film, Progressive{
+		Passes:     samples,
+		Integrator: RayColorWorld,
+		OnSnapshot: func(s *Snapshot) { fmt.Println("sample", s.Samples) },
+		Path:       path,
+	})
 }
-	
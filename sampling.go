@@ -0,0 +1,166 @@
+package raytrace
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+)
+
+// randFloat draws from rng, or from the global generator when rng is nil.
+// Render loops running in many goroutines should pass their own rng, the
+// global one is guarded by a mutex (see RandFloat()).
+func randFloat(rng *rand.Rand) float32 {
+	if rng == nil {
+		return RandFloat()
+	}
+	return rng.Float32()
+}
+
+// ONB is an orthonormal basis around W, used to move sampled directions
+// from the local frame (Z up) into world space.
+type ONB struct {
+	U, V, W Vec3
+}
+
+// NewONB builds the basis without branches on the normal,
+// "Building an Orthonormal Basis, Revisited" (Duff et al. 2017)
+func NewONB(n Vec3) ONB {
+	w := n.UnitVec()
+	sign := float32(math.Copysign(1, float64(w.z)))
+	a := -1 / (sign + w.z)
+	b := w.x * w.y * a
+	u := NewVec3(1+sign*w.x*w.x*a, sign*b, -sign*w.x)
+	v := NewVec3(b, sign+w.y*w.y*a, -w.y)
+	return ONB{u, v, w}
+}
+
+// Local to world
+func (o ONB) Local(a Vec3) Vec3 {
+	return o.U.MultF(a.x).Add(o.V.MultF(a.y)).Add(o.W.MultF(a.z))
+}
+
+// World to local
+func (o ONB) ToLocal(a Vec3) Vec3 {
+	return NewVec3(a.Dot(o.U), a.Dot(o.V), a.Dot(o.W))
+}
+
+// Cosine weighted direction around +Z, pdf = cos(theta) / Pi
+func RandomCosineDirection(u1, u2 float32) Vec3 {
+	phi := 2 * math.Pi * float64(u1)
+	r := math.Sqrt(float64(u2))
+	z := float32(math.Sqrt(math.Max(0, 1-float64(u2))))
+	return NewVec3(float32(r*math.Cos(phi)), float32(r*math.Sin(phi)), z)
+}
+
+// Uniform direction on the unit sphere, pdf = 1 / (4 Pi)
+func UniformSampleSphere(u1, u2 float32) Vec3 {
+	z := 1 - 2*float64(u1)
+	r := math.Sqrt(math.Max(0, 1-z*z))
+	phi := 2 * math.Pi * float64(u2)
+	return NewVec3(float32(r*math.Cos(phi)), float32(r*math.Sin(phi)), float32(z))
+}
+
+// Distribution1D is a piecewise constant distribution over [0,1) with one
+// bucket per value of f, sampled by inverting its CDF.
+type Distribution1D struct {
+	f       []float32
+	cdf     []float32 // len(f)+1 entries, cdf[0] = 0 and cdf[n] = 1
+	funcInt float32   // integral of f over [0,1)
+}
+
+func NewDistribution1D(f []float32) *Distribution1D {
+	n := len(f)
+	d := &Distribution1D{f: append([]float32(nil), f...), cdf: make([]float32, n+1)}
+	for i := 0; i < n; i++ {
+		d.cdf[i+1] = d.cdf[i] + f[i]/float32(n)
+	}
+	d.funcInt = d.cdf[n]
+	for i := 1; i <= n; i++ {
+		if d.funcInt == 0 { // all zero, fall back to uniform
+			d.cdf[i] = float32(i) / float32(n)
+		} else {
+			d.cdf[i] /= d.funcInt
+		}
+	}
+	return d
+}
+
+func (d *Distribution1D) Count() int {
+	return len(d.f)
+}
+
+// Sample maps u in [0,1) to x in [0,1), returns the pdf of x and the
+// bucket it fell into.
+func (d *Distribution1D) Sample(u float32) (x, pdf float32, offset int) {
+	n := len(d.f)
+	// last cdf entry <= u
+	offset = sort.Search(n+1, func(i int) bool { return d.cdf[i] > u }) - 1
+	if offset < 0 {
+		offset = 0
+	}
+	if offset > n-1 {
+		offset = n - 1
+	}
+	du := u - d.cdf[offset]
+	if width := d.cdf[offset+1] - d.cdf[offset]; width > 0 {
+		du /= width
+	}
+	pdf = d.Pdf(offset)
+	x = (float32(offset) + du) / float32(n)
+	if x >= 1 {
+		x = math.Nextafter32(1, 0)
+	}
+	return x, pdf, offset
+}
+
+// Pdf of bucket i, with respect to x in [0,1)
+func (d *Distribution1D) Pdf(i int) float32 {
+	if d.funcInt == 0 {
+		return 1
+	}
+	return d.f[i] / d.funcInt
+}
+
+// Distribution2D samples (u, v) in [0,1)^2 proportionally to a
+// function given as nu x nv values (row major, v selects the row): first
+// the row from the marginal distribution, then the column within it.
+type Distribution2D struct {
+	conditional []*Distribution1D
+	marginal    *Distribution1D
+}
+
+func NewDistribution2D(f []float32, nu, nv int) *Distribution2D {
+	d := &Distribution2D{conditional: make([]*Distribution1D, nv)}
+	row_int := make([]float32, nv)
+	for v := 0; v < nv; v++ {
+		d.conditional[v] = NewDistribution1D(f[v*nu : (v+1)*nu])
+		row_int[v] = d.conditional[v].funcInt
+	}
+	d.marginal = NewDistribution1D(row_int)
+	return d
+}
+
+func (d *Distribution2D) Sample(u1, u2 float32) (u, v, pdf float32) {
+	v, pdf_v, row := d.marginal.Sample(u2)
+	u, pdf_u, _ := d.conditional[row].Sample(u1)
+	return u, v, pdf_u * pdf_v
+}
+
+// Pdf of Sample() returning (u, v)
+func (d *Distribution2D) Pdf(u, v float32) float32 {
+	nv := d.marginal.Count()
+	nu := d.conditional[0].Count()
+	iu := clampIndex(int(u*float32(nu)), nu)
+	iv := clampIndex(int(v*float32(nv)), nv)
+	return d.conditional[iv].Pdf(iu) * d.marginal.Pdf(iv)
+}
+
+func clampIndex(i, n int) int {
+	if i < 0 {
+		return 0
+	}
+	if i >= n {
+		return n - 1
+	}
+	return i
+}
@@ -0,0 +1,81 @@
+package raytrace
+
+import (
+	"math"
+	"math/rand"
+)
+
+// Scene bundles everything the light transport integrators need.
+type Scene struct {
+	World  Hittable
+	Lights []Light
+	// Radiance of rays which escape the scene, nil (black) for interiors
+	// lit only by lights. An *EnvMap should be added to Lights as well.
+	Background Background
+	MaxDepth   int // path length limit, 0 uses defaultMaxDepth
+	// Optional atmospheric fog filling the whole scene
+	Fog *Fog
+}
+
+const defaultMaxDepth = 8
+
+func (s *Scene) maxDepth() int {
+	if s.MaxDepth <= 0 {
+		return defaultMaxDepth
+	}
+	return s.MaxDepth
+}
+
+func (s *Scene) background(dir Vec3) Vec3 {
+	if s.Background == nil {
+		return NewVec3(0, 0, 0)
+	}
+	return s.Background.Radiance(dir)
+}
+
+// The background when it is also one of the scene's lights (an EnvMap),
+// escaping paths are then weighted against light sampling.
+func (s *Scene) backgroundLight() Light {
+	light, ok := s.Background.(Light)
+	if !ok || !s.hasLight(light) {
+		return nil
+	}
+	return light
+}
+
+// hasLight tells whether light is one of Lights, ie. sampled directly
+func (s *Scene) hasLight(light Light) bool {
+	for _, l := range s.Lights {
+		if l == light {
+			return true
+		}
+	}
+	return false
+}
+
+// transmittance of the global fog over distance
+func (s *Scene) transmittance(distance float32) float32 {
+	if s.Fog == nil {
+		return 1
+	}
+	return s.Fog.Transmittance(distance)
+}
+
+// intersect finds the next scattering event along ray: a surface hit or a
+// scattering event in the global fog in front of it.
+func (s *Scene) intersect(ray *Ray, rec *HitRecord, rng *rand.Rand) bool {
+	hit := s.World.Hit(ray, rayEpsilon, float32(math.Inf(1.0)), rec)
+	if s.Fog == nil {
+		return hit
+	}
+	t_hit := float32(math.Inf(1.0))
+	if hit {
+		t_hit = rec.T
+	}
+	if t, ok := s.Fog.sample(ray, t_hit, rng); ok {
+		mediumRecord(ray, t, mediumMaterial(s.Fog.Phase, s.Fog.Albedo), rec)
+		rec.ObjectId, rec.InstanceId = -1, -1
+		return true
+	}
+	return hit
+}
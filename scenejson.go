@@ -0,0 +1,135 @@
+package raytrace
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+type jsonVec [3]float32
+
+func (v jsonVec) vec() Vec3 {
+	return NewVec3(v[0], v[1], v[2])
+}
+
+type sceneJSON struct {
+	Camera struct {
+		From, At jsonVec
+		Width    int
+	}
+	Background *struct {
+		Top, Bottom jsonVec
+	}
+	Objects []struct {
+		Sphere   *sphereJSON
+		Box      *struct{ Min, Max jsonVec }
+		Material *struct {
+			Diffuse, Metal, Emit *jsonVec
+			Glass                float32 // index of refraction
+			Roughness            float32
+		}
+	}
+	Lights []struct {
+		Sphere    *sphereJSON
+		Emit      jsonVec
+		Point     *jsonVec
+		Intensity jsonVec
+	}
+	MaxDepth int
+}
+
+type sphereJSON struct {
+	Center jsonVec
+	Radius float32
+}
+
+// Widest image LoadSceneJSON accepts
+const maxSceneWidth = 8192
+
+var errSceneCamera = errors.New("scene: invalid camera")
+
+// LoadSceneJSON builds the camera and scene of a small JSON format, ie.
+//
+//	{
+//	  "camera": {"from": [0, 1, 1], "at": [0, 0.5, -1], "width": 400},
+//	  "background": {"top": [0.5, 0.7, 1], "bottom": [1, 1, 1]},
+//	  "objects": [
+//	    {"sphere": {"center": [0, 0.5, -1], "radius": 0.5}, "material": {"diffuse": [0.8, 0.3, 0.3]}},
+//	    {"box": {"min": [-2, -0.1, -3], "max": [2, 0, 1]}, "material": {"metal": [0.9, 0.9, 0.9], "roughness": 0.2}}
+//	  ],
+//	  "lights": [
+//	    {"sphere": {"center": [0, 3, -1], "radius": 0.3}, "emit": [10, 10, 10]},
+//	    {"point": [1, 2, 0], "intensity": [5, 5, 5]}
+//	  ]
+//	}
+//
+// Objects are spheres or boxes, their material one of diffuse, metal (with
+// roughness), glass (the index of refraction, with roughness) or emit.
+// Objects without a material are grey. The background is black when not
+// given.
+func LoadSceneJSON(data []byte) (Camera, *Scene, error) {
+	var s sceneJSON
+	if err := json.Unmarshal(data, &s); err != nil {
+		return Camera{}, nil, err
+	}
+	if s.Camera.Width < 4 || s.Camera.Width > maxSceneWidth || s.Camera.From == s.Camera.At {
+		return Camera{}, nil, errSceneCamera
+	}
+	world := HittableList{}
+	for i, o := range s.Objects {
+		var shapes []Hittable
+		switch {
+		case o.Sphere != nil:
+			if !(o.Sphere.Radius > 0) {
+				return Camera{}, nil, fmt.Errorf("scene: object %d: radius %v", i, o.Sphere.Radius)
+			}
+			shapes = []Hittable{Sphere{o.Sphere.Center.vec(), o.Sphere.Radius}}
+		case o.Box != nil:
+			shapes = NewBox(o.Box.Min.vec(), o.Box.Max.vec())
+		default:
+			return Camera{}, nil, fmt.Errorf("scene: object %d has no shape", i)
+		}
+		var mat Material
+		if m := o.Material; m != nil {
+			switch {
+			case m.Diffuse != nil:
+				mat = Lambertian{SolidColor{m.Diffuse.vec()}}
+			case m.Metal != nil:
+				mat = Conductor{SolidColor{m.Metal.vec()}, m.Roughness}
+			case m.Glass > 0:
+				mat = Dielectric{m.Glass, m.Roughness}
+			case m.Emit != nil:
+				mat = DiffuseLight{Emit: m.Emit.vec()}
+			}
+		}
+		for _, shape := range shapes {
+			world.Add(Surface{shape, mat})
+		}
+	}
+
+	scene := &Scene{MaxDepth: s.MaxDepth}
+	for i, l := range s.Lights {
+		switch {
+		case l.Sphere != nil:
+			if !(l.Sphere.Radius > 0) {
+				return Camera{}, nil, fmt.Errorf("scene: light %d: radius %v", i, l.Sphere.Radius)
+			}
+			light := SphereLight{l.Sphere.Center.vec(), l.Sphere.Radius, l.Emit.vec()}
+			scene.Lights = append(scene.Lights, light)
+			world.Add(light)
+		case l.Point != nil:
+			scene.Lights = append(scene.Lights, PointLight{l.Point.vec(), l.Intensity.vec()})
+		default:
+			return Camera{}, nil, fmt.Errorf("scene: light %d has no shape", i)
+		}
+	}
+	if len(world.Objects) > 0 {
+		scene.World = NewDynamicBVH(world.Objects)
+	} else {
+		scene.World = &world
+	}
+	if b := s.Background; b != nil {
+		scene.Background = GradientBackground{b.Bottom.vec(), b.Top.vec()}
+	}
+	return NewCamera(s.Camera.From.vec(), s.Camera.At.vec(), s.Camera.Width), scene, nil
+}
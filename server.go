@@ -0,0 +1,452 @@
+package raytrace
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"image/png"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Server renders scenes submitted over HTTP with RenderProgressive, for
+// previews in a browser. Mount it on a server with http.Handle or
+// http.StripPrefix:
+//
+//	POST   /jobs?passes=N&spp=M  submit a scene, 201 with the JobStatus as JSON
+//	GET    /jobs                 the status of every job
+//	GET    /jobs/{id}            JobStatus
+//	GET    /jobs/{id}/image      the last snapshot as PNG
+//	GET    /jobs/{id}/stream     every snapshot from now on as PNG, in a
+//	                             multipart/x-mixed-replace stream a browser
+//	                             shows like a video
+//	GET    /jobs/{id}/events     server-sent events with the JobStatus after
+//	                             every pass
+//	DELETE /jobs/{id}            cancel the job, the last snapshot is kept,
+//	                             or remove it once finished
+//
+// Finished jobs are kept until they are deleted, beyond MaxFinished the
+// oldest of them are dropped.
+type Server struct {
+	options ServerOptions
+	slots   chan struct{}
+
+	mu   sync.Mutex
+	jobs map[int]*job
+	next int
+}
+
+// ServerOptions sets up NewServer.
+type ServerOptions struct {
+	// Load builds the camera and scene of a submission, nil is LoadSceneJSON
+	Load func(data []byte) (Camera, *Scene, error)
+
+	Passes         int   // of a job which does not ask, 0 is 64
+	SamplesPerPass int   // 0 is 1
+	MaxJobs        int   // rendered at the same time, the others wait, 0 is 1
+	MaxFinished    int   // finished jobs kept, 0 is 64
+	MaxSceneSize   int64 // bytes, 0 is 1MB
+}
+
+// JobState is where a job is at.
+type JobState string
+
+const (
+	JobQueued    JobState = "queued"
+	JobRendering JobState = "rendering"
+	JobDone      JobState = "done"
+	JobCancelled JobState = "cancelled"
+	JobFailed    JobState = "failed"
+)
+
+func (s JobState) finished() bool {
+	return s == JobDone || s == JobCancelled || s == JobFailed
+}
+
+// JobStatus is the progress of a job, as served by Server.
+type JobStatus struct {
+	Id            int
+	State         JobState
+	Width, Height int
+	Pass, Passes  int     // completed and planned
+	Samples       int     // per pixel so far
+	Progress      float32 // fraction of the planned samples taken
+	Elapsed       float64 // seconds of rendering
+	Error         string  `json:",omitempty"`
+}
+
+type job struct {
+	cancel context.CancelFunc
+
+	mu      sync.Mutex
+	status  JobStatus
+	image   []byte        // PNG of the last snapshot
+	version int           // counts the changes
+	changed chan struct{} // closed and replaced on every change
+}
+
+func NewServer(options ServerOptions) *Server {
+	if options.Load == nil {
+		options.Load = LoadSceneJSON
+	}
+	if options.Passes <= 0 {
+		options.Passes = 64
+	}
+	if options.SamplesPerPass <= 0 {
+		options.SamplesPerPass = 1
+	}
+	if options.MaxJobs <= 0 {
+		options.MaxJobs = 1
+	}
+	if options.MaxFinished <= 0 {
+		options.MaxFinished = 64
+	}
+	if options.MaxSceneSize <= 0 {
+		options.MaxSceneSize = 1 << 20
+	}
+	return &Server{
+		options: options,
+		slots:   make(chan struct{}, options.MaxJobs),
+		jobs:    make(map[int]*job),
+	}
+}
+
+// Submit starts rendering a scene, passes and samples_per_pass 0 take the
+// defaults of the server.
+func (s *Server) Submit(cam Camera, scene *Scene, passes, samples_per_pass int) JobStatus {
+	if passes <= 0 {
+		passes = s.options.Passes
+	}
+	if samples_per_pass <= 0 {
+		samples_per_pass = s.options.SamplesPerPass
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s.mu.Lock()
+	s.next++
+	j := &job{
+		cancel:  cancel,
+		status:  JobStatus{Id: s.next, State: JobQueued, Width: cam.Width, Height: cam.Height, Passes: passes},
+		changed: make(chan struct{}),
+	}
+	s.jobs[j.status.Id] = j
+	s.mu.Unlock()
+
+	status, _, _, _ := j.get()
+	go s.run(ctx, j, cam, scene, Progressive{Passes: passes, SamplesPerPass: samples_per_pass})
+	return status
+}
+
+func (s *Server) run(ctx context.Context, j *job, cam Camera, scene *Scene, p Progressive) {
+	defer s.evict()
+	defer j.cancel()
+	select {
+	case s.slots <- struct{}{}:
+		defer func() { <-s.slots }()
+	case <-ctx.Done():
+		j.update(nil, func(status *JobStatus) {
+			status.State = JobCancelled
+		})
+		return
+	}
+	j.update(nil, func(status *JobStatus) {
+		status.State = JobRendering
+	})
+
+	p.OnSnapshot = func(snapshot *Snapshot) {
+		var image bytes.Buffer
+		if err := png.Encode(&image, snapshot.RGBA()); err != nil {
+			return
+		}
+		j.update(image.Bytes(), func(status *JobStatus) {
+			status.Pass = snapshot.Pass
+			status.Samples = snapshot.Samples
+			status.Progress = float32(snapshot.Pass) / float32(p.Passes)
+			status.Elapsed = snapshot.Elapsed.Seconds()
+		})
+	}
+	start := time.Now()
+	result := RenderProgressive(ctx, cam, scene, NewFilm(cam.Width, cam.Height), p)
+	j.update(nil, func(status *JobStatus) {
+		status.Progress = result.Progress
+		status.Elapsed = time.Since(start).Seconds()
+		switch {
+		case result.Err == nil:
+			status.State = JobDone
+		case result.Err == context.Canceled:
+			status.State = JobCancelled
+		default:
+			status.State = JobFailed
+			status.Error = result.Err.Error()
+		}
+	})
+}
+
+// evict drops the oldest finished jobs beyond MaxFinished
+func (s *Server) evict() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var finished []int
+	for id, j := range s.jobs {
+		if status, _, _, _ := j.get(); status.State.finished() {
+			finished = append(finished, id)
+		}
+	}
+	if len(finished) <= s.options.MaxFinished {
+		return
+	}
+	sort.Ints(finished)
+	for _, id := range finished[:len(finished)-s.options.MaxFinished] {
+		delete(s.jobs, id)
+	}
+}
+
+// Remove drops a finished job with its snapshot, false when there is no
+// such job or it is still queued or rendering.
+func (s *Server) Remove(id int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j, ok := s.jobs[id]
+	if !ok {
+		return false
+	}
+	if status, _, _, _ := j.get(); !status.State.finished() {
+		return false
+	}
+	delete(s.jobs, id)
+	return true
+}
+
+// Cancel stops a job, false when there is no such job.
+func (s *Server) Cancel(id int) bool {
+	s.mu.Lock()
+	j, ok := s.jobs[id]
+	s.mu.Unlock()
+	if ok {
+		j.cancel()
+	}
+	return ok
+}
+
+// Close cancels every job.
+func (s *Server) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, j := range s.jobs {
+		j.cancel()
+	}
+}
+
+// Status returns the status of a job, false when there is no such job.
+func (s *Server) Status(id int) (JobStatus, bool) {
+	s.mu.Lock()
+	j, ok := s.jobs[id]
+	s.mu.Unlock()
+	if !ok {
+		return JobStatus{}, false
+	}
+	status, _, _, _ := j.get()
+	return status, true
+}
+
+// update changes the status, and the image when it is not nil
+func (j *job) update(image []byte, change func(status *JobStatus)) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	change(&j.status)
+	if image != nil {
+		j.image = image
+	}
+	j.version++
+	close(j.changed)
+	j.changed = make(chan struct{})
+}
+
+func (j *job) get() (status JobStatus, image []byte, version int, changed chan struct{}) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.status, j.image, j.version, j.changed
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if parts[0] != "jobs" || len(parts) > 3 {
+		http.NotFound(w, r)
+		return
+	}
+	if len(parts) == 1 {
+		switch r.Method {
+		case http.MethodGet:
+			s.serveJobs(w)
+		case http.MethodPost:
+			s.serveSubmit(w, r)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	id, err := strconv.Atoi(parts[1])
+	s.mu.Lock()
+	j, ok := s.jobs[id]
+	s.mu.Unlock()
+	if err != nil || !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if len(parts) == 2 {
+		switch r.Method {
+		case http.MethodGet:
+			status, _, _, _ := j.get()
+			writeJSON(w, http.StatusOK, status)
+		case http.MethodDelete:
+			if !s.Remove(id) {
+				j.cancel()
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	switch parts[2] {
+	case "image":
+		_, image, _, _ := j.get()
+		if image == nil {
+			http.Error(w, "no snapshot yet", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(image)
+	case "stream":
+		serveStream(w, r, j)
+	case "events":
+		serveEvents(w, r, j)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *Server) serveJobs(w http.ResponseWriter) {
+	s.mu.Lock()
+	jobs := make([]*job, 0, len(s.jobs))
+	for _, j := range s.jobs {
+		jobs = append(jobs, j)
+	}
+	s.mu.Unlock()
+	statuses := make([]JobStatus, len(jobs))
+	for i, j := range jobs {
+		statuses[i], _, _, _ = j.get()
+	}
+	sort.Slice(statuses, func(a, b int) bool { return statuses[a].Id < statuses[b].Id })
+	writeJSON(w, http.StatusOK, statuses)
+}
+
+func (s *Server) serveSubmit(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	var counts [2]int
+	for i, name := range []string{"passes", "spp"} {
+		if v := query.Get(name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 || n > 1<<16 {
+				http.Error(w, "invalid "+name, http.StatusBadRequest)
+				return
+			}
+			counts[i] = n
+		}
+	}
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, s.options.MaxSceneSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	cam, scene, err := s.options.Load(data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	status := s.Submit(cam, scene, counts[0], counts[1])
+	w.Header().Set("Location", fmt.Sprintf("%s/%d", strings.TrimSuffix(r.URL.Path, "/"), status.Id))
+	writeJSON(w, http.StatusCreated, status)
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+// serveStream sends every new snapshot as a part of a multipart stream,
+// until the job is over or the client leaves.
+func serveStream(w http.ResponseWriter, r *http.Request, j *job) {
+	mw := multipart.NewWriter(w)
+	w.Header().Set("Content-Type", "multipart/x-mixed-replace; boundary="+mw.Boundary())
+	w.Header().Set("Cache-Control", "no-cache")
+	flusher, _ := w.(http.Flusher)
+	sent := -1
+	for {
+		status, image, version, changed := j.get()
+		if image != nil && version != sent {
+			part, err := mw.CreatePart(textproto.MIMEHeader{
+				"Content-Type":   {"image/png"},
+				"Content-Length": {strconv.Itoa(len(image))},
+			})
+			if err != nil {
+				return
+			}
+			if _, err := part.Write(image); err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+			sent = version
+		}
+		if status.State.finished() {
+			mw.Close()
+			return
+		}
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// serveEvents sends the status as server-sent events on every change,
+// until the job is over or the client leaves.
+func serveEvents(w http.ResponseWriter, r *http.Request, j *job) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	flusher, _ := w.(http.Flusher)
+	for {
+		status, _, _, changed := j.get()
+		data, _ := json.Marshal(status)
+		if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		if status.State.finished() {
+			return
+		}
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package raytrace
+
+import "math"
+
+// PreethamSky is the analytic daylight model of Preetham, Shirley and
+// Smits, "A Practical Analytic Model for Daylight" (1999). The sky
+// luminance and chromaticity follow the Perez distribution, parameterised
+// by the sun position and the atmospheric turbidity (2 is a very clear
+// sky, 10 hazy).
+//
+// Use Sun() for the matching DirectionalLight, the sky itself does not
+// contain the sun disc.
+type PreethamSky struct {
+	SunDir    Vec3 // unit vector towards the sun
+	Turbidity float64
+	// Luminance is computed in kcd/m^2 and multiplied by Scale, the
+	// default keeps a clear midday sky around 0.5
+	Scale float32
+
+	perez   [3][5]float64 // A..E for Y, x, y
+	zenith  [3]float64    // Y, x, y looking straight up
+	theta_s float64       // sun zenith angle
+}
+
+// SunDirection converts the sun position in degrees to a unit vector
+// towards the sun. Elevation is measured from the horizon, azimuth
+// clockwise from -Z (0 is straight ahead of the default camera, 90 is +X).
+func SunDirection(elevation, azimuth float64) Vec3 {
+	el := Deg_to_Rad(elevation)
+	az := Deg_to_Rad(azimuth)
+	return NewVec3(float32(math.Cos(el)*math.Sin(az)), float32(math.Sin(el)), float32(-math.Cos(el)*math.Cos(az)))
+}
+
+func NewPreethamSky(elevation, azimuth, turbidity float64) *PreethamSky {
+	t := math.Max(1.7, math.Min(10, turbidity))
+	s := &PreethamSky{SunDir: SunDirection(elevation, azimuth), Turbidity: t, Scale: 0.05}
+
+	s.perez[0] = [5]float64{0.1787*t - 1.4630, -0.3554*t + 0.4275, -0.0227*t + 5.3251, 0.1206*t - 2.5771, -0.0670*t + 0.3703}
+	s.perez[1] = [5]float64{-0.0193*t - 0.2592, -0.0665*t + 0.0008, -0.0004*t + 0.2125, -0.0641*t - 0.8989, -0.0033*t + 0.0452}
+	s.perez[2] = [5]float64{-0.0167*t - 0.2608, -0.0950*t + 0.0092, -0.0079*t + 0.2102, -0.0441*t - 1.6537, -0.0109*t + 0.0529}
+
+	// the model is not defined for a sun below the horizon
+	theta_s := math.Pi/2 - Deg_to_Rad(math.Max(0, elevation))
+	s.theta_s = theta_s
+	chi := (4.0/9.0 - t/120) * (math.Pi - 2*theta_s)
+	s.zenith[0] = (4.0453*t-4.9710)*math.Tan(chi) - 0.2155*t + 2.4192
+	th := [4]float64{theta_s * theta_s * theta_s, theta_s * theta_s, theta_s, 1}
+	tt := [3]float64{t * t, t, 1}
+	zenith_x := [3][4]float64{
+		{0.00166, -0.00375, 0.00209, 0},
+		{-0.02903, 0.06377, -0.03202, 0.00394},
+		{0.11693, -0.21196, 0.06052, 0.25886},
+	}
+	zenith_y := [3][4]float64{
+		{0.00275, -0.00610, 0.00317, 0},
+		{-0.04214, 0.08970, -0.04153, 0.00516},
+		{0.15346, -0.26756, 0.06670, 0.26688},
+	}
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 4; j++ {
+			s.zenith[1] += tt[i] * zenith_x[i][j] * th[j]
+			s.zenith[2] += tt[i] * zenith_y[i][j] * th[j]
+		}
+	}
+	return s
+}
+
+// Perez et al. sky distribution for view zenith angle theta (as its
+// cosine) and angle gamma to the sun
+func perez(c [5]float64, cos_theta, gamma float64) float64 {
+	cos_gamma := math.Cos(gamma)
+	return (1 + c[0]*math.Exp(c[1]/cos_theta)) * (1 + c[2]*math.Exp(c[3]*gamma) + c[4]*cos_gamma*cos_gamma)
+}
+
+func (s *PreethamSky) Radiance(dir Vec3) Vec3 {
+	d := dir.UnitVec()
+	// below the horizon repeat the horizon color
+	cos_theta := math.Max(float64(d.y), 0.001)
+	gamma := math.Acos(math.Max(-1, math.Min(1, float64(d.Dot(s.SunDir)))))
+	var xyY [3]float64
+	for i := 0; i < 3; i++ {
+		xyY[i] = s.zenith[i] * perez(s.perez[i], cos_theta, gamma) / perez(s.perez[i], 1, s.theta_s)
+	}
+	return xyYToRGB(xyY[1], xyY[2], xyY[0]).MultF(s.Scale)
+}
+
+// CIE xyY to linear sRGB (D65), negative components are clipped
+func xyYToRGB(x, y, Y float64) Vec3 {
+	if y <= 0 {
+		return NewVec3(0, 0, 0)
+	}
+	X := x * Y / y
+	Z := (1 - x - y) * Y / y
+	r := 3.2406*X - 1.5372*Y - 0.4986*Z
+	g := -0.9689*X + 1.8758*Y + 0.0415*Z
+	b := 0.0557*X - 0.2040*Y + 1.0570*Z
+	return NewVec3(float32(math.Max(0, r)), float32(math.Max(0, g)), float32(math.Max(0, b)))
+}
+
+// Representative wavelengths (micrometers) of the red, green and blue
+// channels, used for the sun transmittance
+var rgbWavelengths = [3]float64{0.680, 0.550, 0.440}
+
+// Sun returns a directional light for the sun of this sky. Intensity is the
+// irradiance of the sun outside the atmosphere, it is attenuated by
+// Rayleigh and aerosol scattering along the path through the atmosphere,
+// which reddens a low or hazy sun. A sun below the horizon is black.
+func (s *PreethamSky) Sun(intensity float32) DirectionalLight {
+	light := DirectionalLight{Direction: s.SunDir.MultF(-1)}
+	if s.SunDir.y <= 0 {
+		return light
+	}
+	theta := math.Acos(float64(s.SunDir.y))
+	theta_deg := theta * 180 / math.Pi
+	// relative optical air mass (Kasten)
+	m := 1 / (math.Cos(theta) + 0.15*math.Pow(93.885-theta_deg, -1.253))
+	// Angstrom turbidity coefficient from the turbidity
+	beta := 0.04608365822050*s.Turbidity - 0.04586025928522
+	const alpha = 1.3
+	var trans [3]float64
+	for i, lambda := range rgbWavelengths {
+		rayleigh := math.Exp(-0.008735 * math.Pow(lambda, -4.08) * m)
+		aerosol := math.Exp(-beta * math.Pow(lambda, -alpha) * m)
+		trans[i] = rayleigh * aerosol
+	}
+	light.Irradiance = NewVec3(float32(trans[0]), float32(trans[1]), float32(trans[2])).MultF(intensity)
+	return light
+}
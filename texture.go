@@ -0,0 +1,258 @@
+package raytrace
+
+import (
+	"image"
+	_ "image/jpeg" // register decoders for LoadImageTexture
+	_ "image/png"
+	"math"
+	"math/rand"
+	"os"
+)
+
+// Texture is a color varying over a surface, looked up with the texture
+// coordinates and the position of a hit (see HitRecord.U, V and P).
+type Texture interface {
+	Value(u, v float32, p Vec3) Vec3
+}
+
+// SolidColor is the same color everywhere.
+type SolidColor struct {
+	Color Vec3
+}
+
+func (t SolidColor) Value(u, v float32, p Vec3) Vec3 {
+	return t.Color
+}
+
+// Checker alternates between two textures. By default the pattern is a
+// solid (3D) checker with Scale cells per unit, with UVSpace set it is
+// drawn in texture space with Scale cells along u and v.
+type Checker struct {
+	Even, Odd Texture
+	Scale     float32
+	UVSpace   bool
+}
+
+func (t Checker) Value(u, v float32, p Vec3) Vec3 {
+	var sum int
+	if t.UVSpace {
+		sum = int(math.Floor(float64(u*t.Scale))) + int(math.Floor(float64(v*t.Scale)))
+	} else {
+		q := p.MultF(t.Scale)
+		sum = int(math.Floor(float64(q.x))) + int(math.Floor(float64(q.y))) + int(math.Floor(float64(q.z)))
+	}
+	if sum%2 == 0 {
+		return t.Even.Value(u, v, p)
+	}
+	return t.Odd.Value(u, v, p)
+}
+
+// WrapMode controls texture lookups outside of [0,1].
+type WrapMode int
+
+const (
+	WrapRepeat WrapMode = iota
+	WrapClamp
+	WrapMirror
+)
+
+func (w WrapMode) texel(i, n int) int {
+	switch w {
+	case WrapClamp:
+		return clampIndex(i, n)
+	case WrapMirror:
+		period := 2 * n
+		i %= period
+		if i < 0 {
+			i += period
+		}
+		if i >= n {
+			i = period - 1 - i
+		}
+		return i
+	default:
+		i %= n
+		if i < 0 {
+			i += n
+		}
+		return i
+	}
+}
+
+// ImageTexture maps an image onto the surface with bilinear filtering,
+// (0,0) is the bottom left corner of the image.
+type ImageTexture struct {
+	Image        *HDRImage // linear colors
+	WrapU, WrapV WrapMode
+}
+
+// LoadImageTexture reads a PNG or JPEG image, converting its sRGB colors
+// to linear, or a Radiance .hdr file which is linear already.
+func LoadImageTexture(path string) (*ImageTexture, error) {
+	if len(path) > 4 && path[len(path)-4:] == ".hdr" {
+		img, err := LoadHDR(path)
+		if err != nil {
+			return nil, err
+		}
+		return &ImageTexture{Image: img}, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	src, _, err := image.Decode(f)
+	if err != nil {
+		return nil, err
+	}
+	return &ImageTexture{Image: ImageToLinear(src)}, nil
+}
+
+// LoadDataTexture reads a PNG or JPEG image without any color conversion,
+// for normal and height maps which store data rather than colors.
+func LoadDataTexture(path string) (*ImageTexture, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	src, _, err := image.Decode(f)
+	if err != nil {
+		return nil, err
+	}
+	return &ImageTexture{Image: imageToFloat(src, false)}, nil
+}
+
+// ImageToLinear converts an 8 or 16 bit sRGB image to linear floats.
+func ImageToLinear(src image.Image) *HDRImage {
+	return imageToFloat(src, true)
+}
+
+func imageToFloat(src image.Image, srgb bool) *HDRImage {
+	decode := func(c uint32) float32 {
+		v := float32(c) / 0xffff
+		if srgb {
+			return srgbToLinear(v)
+		}
+		return v
+	}
+	bounds := src.Bounds()
+	img := NewHDRImage(bounds.Dx(), bounds.Dy())
+	for y := 0; y < img.Height; y++ {
+		for x := 0; x < img.Width; x++ {
+			r, g, b, _ := src.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+			img.Set(x, y, NewVec3(decode(r), decode(g), decode(b)))
+		}
+	}
+	return img
+}
+
+func srgbToLinear(c float32) float32 {
+	if c <= 0.04045 {
+		return c / 12.92
+	}
+	return float32(math.Pow((float64(c)+0.055)/1.055, 2.4))
+}
+
+func (t *ImageTexture) Value(u, v float32, p Vec3) Vec3 {
+	w, h := t.Image.Width, t.Image.Height
+	if w == 0 || h == 0 {
+		return NewVec3(0, 0, 0)
+	}
+	// texel centers are at half integers, v = 0 is the last row
+	x := float64(u)*float64(w) - 0.5
+	y := float64(1-v)*float64(h) - 0.5
+	x0, y0 := math.Floor(x), math.Floor(y)
+	fx, fy := float32(x-x0), float32(y-y0)
+	ix, iy := int(x0), int(y0)
+	x_lo, x_hi := t.WrapU.texel(ix, w), t.WrapU.texel(ix+1, w)
+	y_lo, y_hi := t.WrapV.texel(iy, h), t.WrapV.texel(iy+1, h)
+	top := t.Image.At(x_lo, y_lo).MultF(1 - fx).Add(t.Image.At(x_hi, y_lo).MultF(fx))
+	bottom := t.Image.At(x_lo, y_hi).MultF(1 - fx).Add(t.Image.At(x_hi, y_hi).MultF(fx))
+	return top.MultF(1 - fy).Add(bottom.MultF(fy))
+}
+
+// Perlin is gradient noise with random unit vectors at the lattice points
+// (as in "Ray Tracing: The Next Week").
+type Perlin struct {
+	gradients              [perlinPoints]Vec3
+	perm_x, perm_y, perm_z [perlinPoints]int
+}
+
+const perlinPoints = 256
+
+// NewPerlin builds the lattice from seed, the same seed gives the same
+// noise.
+func NewPerlin(seed int64) *Perlin {
+	rng := rand.New(rand.NewSource(seed))
+	n := &Perlin{}
+	for i := range n.gradients {
+		n.gradients[i] = UniformSampleSphere(rng.Float32(), rng.Float32())
+	}
+	for _, perm := range []*[perlinPoints]int{&n.perm_x, &n.perm_y, &n.perm_z} {
+		for i, j := range rng.Perm(perlinPoints) {
+			perm[i] = j
+		}
+	}
+	return n
+}
+
+// Noise returns a smooth value in about [-1,1].
+func (n *Perlin) Noise(p Vec3) float32 {
+	fx, fy, fz := math.Floor(float64(p.x)), math.Floor(float64(p.y)), math.Floor(float64(p.z))
+	u, v, w := p.x-float32(fx), p.y-float32(fy), p.z-float32(fz)
+	i, j, k := int(fx), int(fy), int(fz)
+
+	// Hermite smoothing of the weights
+	uu := u * u * (3 - 2*u)
+	vv := v * v * (3 - 2*v)
+	ww := w * w * (3 - 2*w)
+	var sum float32
+	for di := 0; di < 2; di++ {
+		for dj := 0; dj < 2; dj++ {
+			for dk := 0; dk < 2; dk++ {
+				g := n.gradients[n.perm_x[(i+di)&(perlinPoints-1)]^n.perm_y[(j+dj)&(perlinPoints-1)]^n.perm_z[(k+dk)&(perlinPoints-1)]]
+				weight := NewVec3(u-float32(di), v-float32(dj), w-float32(dk))
+				sum += lerpWeight(uu, di) * lerpWeight(vv, dj) * lerpWeight(ww, dk) * g.Dot(weight)
+			}
+		}
+	}
+	return sum
+}
+
+func lerpWeight(t float32, corner int) float32 {
+	if corner == 1 {
+		return t
+	}
+	return 1 - t
+}
+
+// Turbulence sums octaves of absolute noise, each at twice the frequency
+// and half the amplitude of the previous one.
+func (n *Perlin) Turbulence(p Vec3, octaves int) float32 {
+	var sum float32
+	weight := float32(1)
+	for i := 0; i < octaves; i++ {
+		sum += weight * float32(math.Abs(float64(n.Noise(p))))
+		weight *= 0.5
+		p = p.MultF(2)
+	}
+	return sum
+}
+
+// NoiseTexture scales Color by solid Perlin noise at Scale times the hit
+// position. With Octaves > 0 turbulence is used instead of plain noise.
+type NoiseTexture struct {
+	Noise   *Perlin
+	Color   Vec3
+	Scale   float32
+	Octaves int
+}
+
+func (t NoiseTexture) Value(u, v float32, p Vec3) Vec3 {
+	q := p.MultF(t.Scale)
+	if t.Octaves > 0 {
+		return t.Color.MultF(t.Noise.Turbulence(q, t.Octaves))
+	}
+	return t.Color.MultF(0.5 * (1 + t.Noise.Noise(q)))
+}
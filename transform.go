@@ -0,0 +1,185 @@
+package raytrace
+
+import "math"
+
+// Transform is an affine transformation stored as a 3x4 matrix (rotation,
+// scale and shear in the first three columns, translation in the last one)
+// together with its inverse, so instances can move rays into object space
+// without inverting a matrix per ray.
+type Transform struct {
+	m, inv [3][4]float32
+}
+
+func identityMat() [3][4]float32 {
+	return [3][4]float32{
+		{1, 0, 0, 0},
+		{0, 1, 0, 0},
+		{0, 0, 1, 0},
+	}
+}
+
+func NewIdentity() Transform {
+	return Transform{identityMat(), identityMat()}
+}
+
+func NewTranslate(offset Vec3) Transform {
+	t := NewIdentity()
+	for a := 0; a < 3; a++ {
+		t.m[a][3] = offset.At(a)
+		t.inv[a][3] = -offset.At(a)
+	}
+	return t
+}
+
+func NewScale(scale Vec3) Transform {
+	t := NewIdentity()
+	for a := 0; a < 3; a++ {
+		t.m[a][a] = scale.At(a)
+		t.inv[a][a] = 1 / scale.At(a)
+	}
+	return t
+}
+
+// NewRotate rotates by deg degrees around axis (right-handed).
+func NewRotate(axis Vec3, deg float64) Transform {
+	a := axis.UnitVec()
+	theta := Deg_to_Rad(deg)
+	s := float32(math.Sin(theta))
+	c := float32(math.Cos(theta))
+	x, y, z := a.At(0), a.At(1), a.At(2)
+
+	t := NewIdentity()
+	t.m[0] = [4]float32{x*x + (1-x*x)*c, x*y*(1-c) - z*s, x*z*(1-c) + y*s, 0}
+	t.m[1] = [4]float32{x*y*(1-c) + z*s, y*y + (1-y*y)*c, y*z*(1-c) - x*s, 0}
+	t.m[2] = [4]float32{x*z*(1-c) - y*s, y*z*(1-c) + x*s, z*z + (1-z*z)*c, 0}
+	// rotation matrices are orthogonal, the inverse is the transpose
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			t.inv[i][j] = t.m[j][i]
+		}
+	}
+	return t
+}
+
+// NewTransform builds a transform from a row-major 3x4 matrix.
+// ok is false when the matrix cannot be inverted.
+func NewTransform(m [3][4]float32) (Transform, bool) {
+	inv, ok := invertMat(m)
+	return Transform{m, inv}, ok
+}
+
+// Then returns the transform which applies t first and u second.
+func (t Transform) Then(u Transform) Transform {
+	return Transform{mulMat(u.m, t.m), mulMat(t.inv, u.inv)}
+}
+
+func (t Transform) Inverse() Transform {
+	return Transform{t.inv, t.m}
+}
+
+func (t Transform) Matrix() [3][4]float32 {
+	return t.m
+}
+
+func (t Transform) Point(p Vec3) Vec3 {
+	return applyMat(&t.m, p, 1)
+}
+
+func (t Transform) Vector(v Vec3) Vec3 {
+	return applyMat(&t.m, v, 0)
+}
+
+// Normal transforms a normal with the inverse transpose. The result is not
+// normalised.
+func (t Transform) Normal(n Vec3) Vec3 {
+	m := &t.inv
+	return NewVec3(
+		m[0][0]*n.x+m[1][0]*n.y+m[2][0]*n.z,
+		m[0][1]*n.x+m[1][1]*n.y+m[2][1]*n.z,
+		m[0][2]*n.x+m[1][2]*n.y+m[2][2]*n.z)
+}
+
+// Transforms a ray into the space of t. The direction is not normalised so
+// the parameter t of a hit stays the same in both spaces.
+func (t Transform) Ray(r *Ray) Ray {
+	return NewRay(t.Point(r.Orig), t.Vector(r.Dir))
+}
+
+// BBox returns the world space box around the transformed box.
+func (t Transform) BBox(box AABB) AABB {
+	min, max := box.Min(), box.Max()
+	var out AABB
+	for i := 0; i < 8; i++ {
+		corner := NewVec3(min.x, min.y, min.z)
+		if i&1 != 0 {
+			corner.x = max.x
+		}
+		if i&2 != 0 {
+			corner.y = max.y
+		}
+		if i&4 != 0 {
+			corner.z = max.z
+		}
+		p := t.Point(corner)
+		if i == 0 {
+			out = NewAABB(p, p)
+		} else {
+			out = Surrounding_box(out, NewAABB(p, p))
+		}
+	}
+	return out
+}
+
+func applyMat(m *[3][4]float32, v Vec3, w float32) Vec3 {
+	return NewVec3(
+		m[0][0]*v.x+m[0][1]*v.y+m[0][2]*v.z+m[0][3]*w,
+		m[1][0]*v.x+m[1][1]*v.y+m[1][2]*v.z+m[1][3]*w,
+		m[2][0]*v.x+m[2][1]*v.y+m[2][2]*v.z+m[2][3]*w)
+}
+
+// a * b, treating both as 4x4 matrices with an implicit (0,0,0,1) row
+func mulMat(a, b [3][4]float32) [3][4]float32 {
+	var out [3][4]float32
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 4; j++ {
+			var sum float32
+			for k := 0; k < 3; k++ {
+				sum += a[i][k] * b[k][j]
+			}
+			if j == 3 {
+				sum += a[i][3]
+			}
+			out[i][j] = sum
+		}
+	}
+	return out
+}
+
+func invertMat(m [3][4]float32) ([3][4]float32, bool) {
+	// inverse of the 3x3 part via the adjugate, computed in float64
+	a := func(i, j int) float64 { return float64(m[i][j]) }
+	c00 := a(1, 1)*a(2, 2) - a(1, 2)*a(2, 1)
+	c01 := a(1, 2)*a(2, 0) - a(1, 0)*a(2, 2)
+	c02 := a(1, 0)*a(2, 1) - a(1, 1)*a(2, 0)
+	det := a(0, 0)*c00 + a(0, 1)*c01 + a(0, 2)*c02
+	if det == 0 || math.IsNaN(det) {
+		return identityMat(), false
+	}
+	inv_det := 1 / det
+	r := [3][3]float64{
+		{c00, a(0, 2)*a(2, 1) - a(0, 1)*a(2, 2), a(0, 1)*a(1, 2) - a(0, 2)*a(1, 1)},
+		{c01, a(0, 0)*a(2, 2) - a(0, 2)*a(2, 0), a(0, 2)*a(1, 0) - a(0, 0)*a(1, 2)},
+		{c02, a(0, 1)*a(2, 0) - a(0, 0)*a(2, 1), a(0, 0)*a(1, 1) - a(0, 1)*a(1, 0)},
+	}
+	var out [3][4]float32
+	for i := 0; i < 3; i++ {
+		var translation float64
+		for j := 0; j < 3; j++ {
+			r[i][j] *= inv_det
+			out[i][j] = float32(r[i][j])
+			translation -= r[i][j] * a(j, 3)
+		}
+		out[i][3] = float32(translation)
+	}
+	return out, true
+}
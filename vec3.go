@@ -90,13 +90,28 @@ func (v Vec3) Cross(u Vec3) Vec3 {
 }
 
 // Ray
+// Always create rays with NewRay() - it caches the inverse direction and
+// the sign of each of its components used by the box tests.
 type Ray struct {
 	Orig Vec3
 	Dir  Vec3
+	InvDir Vec3 // 1/Dir, +-Inf for zero components
+	Sign [3]int // 1 where InvDir is negative
 }
 
 func NewRay(origin, dir Vec3) Ray {
-	return Ray{origin, dir}
+	inv := NewVec3(1/dir.x, 1/dir.y, 1/dir.z)
+	r := Ray{Orig: origin, Dir: dir, InvDir: inv}
+	if inv.x < 0 {
+		r.Sign[0] = 1
+	}
+	if inv.y < 0 {
+		r.Sign[1] = 1
+	}
+	if inv.z < 0 {
+		r.Sign[2] = 1
+	}
+	return r
 }
 
 func (r Ray) Origin() Vec3 {
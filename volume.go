@@ -0,0 +1,327 @@
+package raytrace
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"os"
+)
+
+// VoxelGrid is a dense scalar field (density) sampled at the centres of
+// Nx*Ny*Nz voxels evenly filling the box [Min, Max].
+type VoxelGrid struct {
+	Nx, Ny, Nz int
+	Min, Max   Vec3
+	Data       []float32 // x varies fastest, then y, then z
+}
+
+func NewVoxelGrid(nx, ny, nz int, min, max Vec3) *VoxelGrid {
+	return &VoxelGrid{nx, ny, nz, min, max, make([]float32, nx*ny*nz)}
+}
+
+func (g *VoxelGrid) At(x, y, z int) float32 {
+	return g.Data[(z*g.Ny+y)*g.Nx+x]
+}
+
+func (g *VoxelGrid) Set(x, y, z int, value float32) {
+	g.Data[(z*g.Ny+y)*g.Nx+x] = value
+}
+
+// position of p in voxel units, voxel i spans [i, i+1)
+func (g *VoxelGrid) voxelCoords(p Vec3) [3]float32 {
+	size := g.Max.Subtr(g.Min)
+	res := [3]int{g.Nx, g.Ny, g.Nz}
+	var c [3]float32
+	for a := 0; a < 3; a++ {
+		c[a] = (p.At(a) - g.Min.At(a)) / size.At(a) * float32(res[a])
+	}
+	return c
+}
+
+// Lookup trilinearly interpolates the voxel values at p, the half voxel
+// along the faces is extended and the field is 0 outside of the box.
+func (g *VoxelGrid) Lookup(p Vec3) float32 {
+	c := g.voxelCoords(p)
+	res := [3]int{g.Nx, g.Ny, g.Nz}
+	var i0, i1 [3]int
+	var f [3]float32
+	for a := 0; a < 3; a++ {
+		if !(c[a] >= 0 && c[a] <= float32(res[a])) { // NaN too
+			return 0
+		}
+		x := c[a] - 0.5
+		i := int(math.Floor(float64(x)))
+		f[a] = x - float32(i)
+		i0[a] = clampIndex(i, res[a])
+		i1[a] = clampIndex(i+1, res[a])
+	}
+	lerp := func(a, b, t float32) float32 { return a + (b-a)*t }
+	c00 := lerp(g.At(i0[0], i0[1], i0[2]), g.At(i1[0], i0[1], i0[2]), f[0])
+	c10 := lerp(g.At(i0[0], i1[1], i0[2]), g.At(i1[0], i1[1], i0[2]), f[0])
+	c01 := lerp(g.At(i0[0], i0[1], i1[2]), g.At(i1[0], i0[1], i1[2]), f[0])
+	c11 := lerp(g.At(i0[0], i1[1], i1[2]), g.At(i1[0], i1[1], i1[2]), f[0])
+	return lerp(lerp(c00, c10, f[1]), lerp(c01, c11, f[1]), f[2])
+}
+
+// Voxel grid files are little endian: the magic "VOX1", the resolution as
+// three int32, the Min and Max corners as six float32 and Nx*Ny*Nz float32
+// values in the order of VoxelGrid.Data.
+const voxelMagic = "VOX1"
+
+type voxelHeader struct {
+	Magic      [4]byte
+	Nx, Ny, Nz int32
+	Min, Max   [3]float32
+}
+
+// Largest grid accepted by DecodeVoxelGrid, 4GB of floats
+const maxVoxels = 1 << 30
+
+var errVoxelFormat = errors.New("voxel: invalid format")
+
+// LoadVoxelGrid reads a raw voxel grid file, see EncodeVoxelGrid.
+func LoadVoxelGrid(path string) (*VoxelGrid, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return DecodeVoxelGrid(f)
+}
+
+func DecodeVoxelGrid(r io.Reader) (*VoxelGrid, error) {
+	br := bufio.NewReader(r)
+	var h voxelHeader
+	if err := binary.Read(br, binary.LittleEndian, &h); err != nil {
+		return nil, err
+	}
+	if string(h.Magic[:]) != voxelMagic || h.Nx <= 0 || h.Ny <= 0 || h.Nz <= 0 {
+		return nil, errVoxelFormat
+	}
+	if int64(h.Nx)*int64(h.Ny)*int64(h.Nz) > maxVoxels {
+		return nil, errVoxelFormat
+	}
+	for a := 0; a < 3; a++ {
+		if !(h.Min[a] < h.Max[a]) {
+			return nil, errVoxelFormat
+		}
+	}
+	g := NewVoxelGrid(int(h.Nx), int(h.Ny), int(h.Nz),
+		NewVec3(h.Min[0], h.Min[1], h.Min[2]), NewVec3(h.Max[0], h.Max[1], h.Max[2]))
+	if err := binary.Read(br, binary.LittleEndian, g.Data); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// EncodeVoxelGrid writes g in the raw format read by DecodeVoxelGrid.
+func EncodeVoxelGrid(w io.Writer, g *VoxelGrid) error {
+	h := voxelHeader{
+		Nx: int32(g.Nx), Ny: int32(g.Ny), Nz: int32(g.Nz),
+		Min: [3]float32{g.Min.x, g.Min.y, g.Min.z},
+		Max: [3]float32{g.Max.x, g.Max.y, g.Max.z},
+	}
+	copy(h.Magic[:], voxelMagic)
+	bw := bufio.NewWriter(w)
+	if err := binary.Write(bw, binary.LittleEndian, &h); err != nil {
+		return err
+	}
+	if err := binary.Write(bw, binary.LittleEndian, g.Data); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// Voxels along each side of a brick
+const voxelBrickSize = 8
+
+// VoxelVolume is a heterogeneous medium with the extinction given by a
+// VoxelGrid scaled by Density. Like ConstantMedium a hit is a scattering
+// event, found by delta tracking, and shadow rays use ratio tracking.
+// Both walk the grid in bricks of voxelBrickSize^3 voxels, each with its
+// own majorant, so that empty and thin regions are crossed in few steps.
+type VoxelVolume struct {
+	Grid    *VoxelGrid
+	Density float32
+	Albedo  Vec3
+	Phase   PhaseFunction // nil is isotropic
+
+	bricks    [3]int
+	majorants []float32 // already scaled by Density
+	salt      uint64    // of the ray hashes, see rayRNG
+}
+
+func NewVoxelVolume(grid *VoxelGrid, density float32, albedo Vec3, phase PhaseFunction) *VoxelVolume {
+	v := &VoxelVolume{Grid: grid, Density: density, Albedo: albedo, Phase: phase}
+	v.salt = mediumSalt(NewAABB(grid.Min, grid.Max), density)
+	res := [3]int{grid.Nx, grid.Ny, grid.Nz}
+	for a := 0; a < 3; a++ {
+		v.bricks[a] = (res[a] + voxelBrickSize - 1) / voxelBrickSize
+	}
+	v.majorants = make([]float32, v.bricks[0]*v.bricks[1]*v.bricks[2])
+	for bz := 0; bz < v.bricks[2]; bz++ {
+		for by := 0; by < v.bricks[1]; by++ {
+			for bx := 0; bx < v.bricks[0]; bx++ {
+				// interpolation inside a brick reaches one voxel beyond it,
+				// one more covers rounding of the brick boundaries
+				var lo, hi [3]int
+				for a, b := range [3]int{bx, by, bz} {
+					lo[a] = clampIndex(b*voxelBrickSize-2, res[a])
+					hi[a] = clampIndex((b+1)*voxelBrickSize+1, res[a])
+				}
+				var majorant float32
+				for z := lo[2]; z <= hi[2]; z++ {
+					for y := lo[1]; y <= hi[1]; y++ {
+						for x := lo[0]; x <= hi[0]; x++ {
+							if d := grid.At(x, y, z); d > majorant {
+								majorant = d
+							}
+						}
+					}
+				}
+				v.majorants[(bz*v.bricks[1]+by)*v.bricks[0]+bx] = majorant * density
+			}
+		}
+	}
+	return v
+}
+
+func (v *VoxelVolume) extinction(p Vec3) float32 {
+	return v.Density * v.Grid.Lookup(p)
+}
+
+// walk calls segment with consecutive intervals of r inside the grid and
+// the majorant of the brick they cross, until segment returns true.
+// Same 3D-DDA as Grid.traverse.
+func (v *VoxelVolume) walk(r *Ray, t_min, t_max float32, segment func(t0, t1, majorant float32) bool) {
+	g := v.Grid
+	t_enter, t_exit, ok := NewAABB(g.Min, g.Max).clip(r, t_min, t_max)
+	if !ok {
+		return
+	}
+	res := [3]int{g.Nx, g.Ny, g.Nz}
+	c := g.voxelCoords(r.At(t_enter))
+	var brick, step, out [3]int
+	var t_next, t_delta [3]float32
+	inf := float32(math.Inf(1))
+	for a := 0; a < 3; a++ {
+		brick_size := (g.Max.At(a) - g.Min.At(a)) / float32(res[a]) * voxelBrickSize
+		brick[a] = clampIndex(int(c[a])/voxelBrickSize, v.bricks[a])
+		d := r.Direction().At(a)
+		lo := g.Min.At(a) + float32(brick[a])*brick_size
+		switch {
+		case d > 0:
+			t_next[a] = (lo + brick_size - r.Origin().At(a)) / d
+			t_delta[a] = brick_size / d
+			step[a], out[a] = 1, v.bricks[a]
+		case d < 0:
+			t_next[a] = (lo - r.Origin().At(a)) / d
+			t_delta[a] = -brick_size / d
+			step[a], out[a] = -1, -1
+		default:
+			t_next[a], t_delta[a] = inf, inf
+			step[a], out[a] = 0, -1
+		}
+	}
+
+	t := t_enter
+	for {
+		a := 0
+		if t_next[1] < t_next[a] {
+			a = 1
+		}
+		if t_next[2] < t_next[a] {
+			a = 2
+		}
+		t_end := t_next[a]
+		if t_end > t_exit {
+			t_end = t_exit
+		}
+		majorant := v.majorants[(brick[2]*v.bricks[1]+brick[1])*v.bricks[0]+brick[0]]
+		if t_end > t && segment(t, t_end, majorant) {
+			return
+		}
+		if t_next[a] >= t_exit {
+			return
+		}
+		brick[a] += step[a]
+		if brick[a] == out[a] {
+			return
+		}
+		t = t_next[a]
+		t_next[a] += t_delta[a]
+	}
+}
+
+// Delta tracking, the first real collision along r
+func (v *VoxelVolume) sample(r *Ray, t_min, t_max float32) (float32, bool) {
+	rng := newRayRNG(r, v.salt)
+	length := r.Direction().Length()
+	var t_hit float32
+	found := false
+	v.walk(r, t_min, t_max, func(t0, t1, majorant float32) bool {
+		if majorant <= 0 {
+			return false
+		}
+		for t := t0; ; {
+			t -= float32(math.Log(float64(1-rng.next()))) / (majorant * length)
+			if t >= t1 {
+				return false
+			}
+			if rng.next()*majorant < v.extinction(r.At(t)) {
+				t_hit, found = t, true
+				return true
+			}
+		}
+	})
+	return t_hit, found
+}
+
+// Ratio tracking estimate of the transmittance along r
+func (v *VoxelVolume) transmittance(r *Ray, t_min, t_max float32, rng *rayRNG) float32 {
+	length := r.Direction().Length()
+	tr := float32(1)
+	v.walk(r, t_min, t_max, func(t0, t1, majorant float32) bool {
+		if majorant <= 0 {
+			return false
+		}
+		for t := t0; ; {
+			t -= float32(math.Log(float64(1-rng.next()))) / (majorant * length)
+			if t >= t1 {
+				return false
+			}
+			tr *= 1 - float32(math.Min(1, float64(v.extinction(r.At(t))/majorant)))
+			if tr < 0.1 { // russian roulette
+				if rng.next() < 0.5 {
+					tr = 0
+					return true
+				}
+				tr *= 2
+			}
+		}
+	})
+	return tr
+}
+
+func (v *VoxelVolume) Hit(r *Ray, t_min, t_max float32, rec *HitRecord) bool {
+	t, ok := v.sample(r, t_min, t_max)
+	if !ok {
+		return false
+	}
+	mediumRecord(r, t, mediumMaterial(v.Phase, v.Albedo), rec)
+	return true
+}
+
+// Occluded turns the ratio tracking transmittance into a yes/no answer
+// with the matching probability.
+func (v *VoxelVolume) Occluded(r *Ray, t_min, t_max float32) bool {
+	rng := newRayRNG(r, v.salt)
+	return rng.next() >= v.transmittance(r, t_min, t_max, &rng)
+}
+
+func (v *VoxelVolume) BBox(output_box *AABB) bool {
+	*output_box = NewAABB(v.Grid.Min, v.Grid.Max)
+	return true
+}